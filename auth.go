@@ -0,0 +1,92 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// credentialPassthrough forwards the credentials of each incoming request to
+// the Kubernetes master rather than using a single shared identity. A bearer
+// token is taken from the Authorization header, the WebSocket bearer
+// subprotocol or, failing those, the named cookie. Requests carrying none of
+// them are sent with the fallback token if one is configured and rejected
+// otherwise.
+type credentialPassthrough struct {
+	cookieName    string
+	fallbackToken string
+}
+
+func newCredentialPassthrough(cookieName, fallbackTokenFile string) (*credentialPassthrough, error) {
+	c := &credentialPassthrough{cookieName: cookieName}
+	if len(fallbackTokenFile) > 0 {
+		token, err := ioutil.ReadFile(fallbackTokenFile)
+		if err != nil {
+			return nil, err
+		}
+		c.fallbackToken = strings.TrimSpace(string(token))
+	}
+	return c, nil
+}
+
+// token returns the bearer token to use upstream for r, if any.
+func (c *credentialPassthrough) token(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	if token := webSocketToken(r); len(token) > 0 {
+		return token
+	}
+	if len(c.cookieName) > 0 {
+		if cookie, err := r.Cookie(c.cookieName); err == nil && len(cookie.Value) > 0 {
+			return cookie.Value
+		}
+	}
+	return c.fallbackToken
+}
+
+func (c *credentialPassthrough) Wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := c.token(r)
+		if len(token) == 0 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="k8s-proxy"`)
+			http.Error(w, "401 unauthorized", http.StatusUnauthorized)
+			return
+		}
+		r.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+		stripWebSocketToken(r)
+		// The master has no use for browser cookies, and the token cookie has
+		// already been converted into a header above, as has any token sent
+		// as a WebSocket subprotocol.
+		r.Header.Del("Cookie")
+		h.ServeHTTP(w, r)
+	})
+}
+
+// credentialsKey returns a hash of the credentials req is made to the master
+// with, for keeping what is seen with one set of credentials from ever being
+// shown to another.
+func credentialsKey(req *http.Request) string {
+	h := sha256.New()
+	io.WriteString(h, req.Header.Get("Authorization"))
+	if id := identityFrom(req); id != nil {
+		io.WriteString(h, "\x00"+id.Name)
+		for _, group := range id.Groups {
+			io.WriteString(h, "\x00"+group)
+		}
+		keys := make([]string, 0, len(id.Extra))
+		for key := range id.Extra {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			io.WriteString(h, "\x01"+key+"="+strings.Join(id.Extra[key], "\x00"))
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
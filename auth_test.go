@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCredentialPassthrough(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fallbackFile := filepath.Join(dir, "fallback")
+	if err := ioutil.WriteFile(fallbackFile, []byte("fallback\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	withFallback, err := newCredentialPassthrough("access_token", fallbackFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	withoutFallback, err := newCredentialPassthrough("access_token", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newCredentialPassthrough("access_token", filepath.Join(dir, "missing")); err == nil {
+		t.Errorf("accepted a missing fallback token file")
+	}
+
+	bearerProtocol := bearerProtocolPrefix + base64.RawURLEncoding.EncodeToString([]byte("subprotocol"))
+	tests := []struct {
+		auth, protocols, cookie string
+		withFallback            string
+		withoutFallback         string
+	}{
+		// The header, then the subprotocol, then the cookie, then the fallback.
+		{"Bearer header", bearerProtocol + ", v4.channel.k8s.io", "cookie", "header", "header"},
+		{"bearer  header ", "", "", "header", "header"},
+		{"", bearerProtocol + ", v4.channel.k8s.io", "cookie", "subprotocol", "subprotocol"},
+		{"", "v4.channel.k8s.io", "cookie", "cookie", "cookie"},
+		{"Basic YWRtaW46cGFzcw==", "", "cookie", "cookie", "cookie"},
+		{"Basic YWRtaW46cGFzcw==", "", "", "fallback", ""},
+		{"", bearerProtocolPrefix + "!!!", "", "fallback", ""},
+		{"", "", "", "fallback", ""},
+	}
+	for _, test := range tests {
+		for _, p := range []struct {
+			passthrough *credentialPassthrough
+			want        string
+		}{{withFallback, test.withFallback}, {withoutFallback, test.withoutFallback}} {
+			var upstream *http.Request
+			h := p.passthrough.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				upstream = r
+			}))
+			r := httptest.NewRequest("GET", "/api/v1beta3/pods", nil)
+			if len(test.auth) > 0 {
+				r.Header.Set("Authorization", test.auth)
+			}
+			if len(test.protocols) > 0 {
+				r.Header.Set("Sec-WebSocket-Protocol", test.protocols)
+			}
+			if len(test.cookie) > 0 {
+				r.AddCookie(&http.Cookie{Name: "access_token", Value: test.cookie})
+			}
+			r.AddCookie(&http.Cookie{Name: "session", Value: "s"})
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			if len(p.want) == 0 {
+				if upstream != nil || w.Code != http.StatusUnauthorized || len(w.Header().Get("WWW-Authenticate")) == 0 {
+					t.Errorf("%+v: got %d, want a 401 challenge", test, w.Code)
+				}
+				continue
+			}
+			if upstream == nil {
+				t.Errorf("%+v: got %d, want %q sent upstream", test, w.Code, p.want)
+				continue
+			}
+			if auth := upstream.Header.Get("Authorization"); auth != "Bearer "+p.want {
+				t.Errorf("%+v: sent Authorization %q, want %q", test, auth, p.want)
+			}
+			// The token isn't sent on in any other form, nor are the cookies.
+			if cookies := upstream.Header.Get("Cookie"); len(cookies) > 0 {
+				t.Errorf("%+v: sent cookies %q", test, cookies)
+			}
+			if protocols := upstream.Header.Get("Sec-WebSocket-Protocol"); strings.Contains(protocols, bearerProtocolPrefix) ||
+				strings.Contains(test.protocols, "v4.channel.k8s.io") != (protocols == "v4.channel.k8s.io") {
+				t.Errorf("%+v: sent subprotocols %q, want only the others", test, protocols)
+			}
+		}
+	}
+}
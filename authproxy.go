@@ -0,0 +1,187 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// authProxy trusts an authenticating proxy in front of k8s-proxy, such as
+// oauth2-proxy, to say who the user is in request headers. The headers are
+// only believed from the proxy's addresses or when it presents a client
+// certificate signed by its CA; anyone else sending them is rejected, as they
+// could otherwise claim to be any user.
+type authProxy struct {
+	userHeaders         []string
+	groupHeaders        []string
+	extraHeaderPrefixes []string
+	cidrs               []*net.IPNet
+	cas                 *x509.CertPool
+	caCerts             []*x509.Certificate
+}
+
+func newAuthProxy(userHeaders, groupHeaders, extraHeaderPrefixes, cidrs []string, caFile string) (*authProxy, error) {
+	if len(userHeaders) == 0 {
+		return nil, errors.New("at least one authenticating proxy user header is needed")
+	}
+	a := &authProxy{userHeaders: userHeaders, groupHeaders: groupHeaders}
+	for _, prefix := range extraHeaderPrefixes {
+		a.extraHeaderPrefixes = append(a.extraHeaderPrefixes, http.CanonicalHeaderKey(prefix))
+	}
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		a.cidrs = append(a.cidrs, network)
+	}
+	if len(caFile) > 0 {
+		data, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		a.cas = x509.NewCertPool()
+		for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+			if block.Type != "CERTIFICATE" {
+				continue
+			}
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			a.cas.AddCert(cert)
+			a.caCerts = append(a.caCerts, cert)
+		}
+		if len(a.caCerts) == 0 {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+	}
+	return a, nil
+}
+
+// configureTLS makes tlsConfig ask clients for certificates signed by the
+// authenticating proxy's CA, alongside any other client CAs.
+func (a *authProxy) configureTLS(tlsConfig *tls.Config) {
+	if a.cas == nil {
+		return
+	}
+	if tlsConfig.ClientCAs == nil {
+		tlsConfig.ClientCAs = x509.NewCertPool()
+	}
+	for _, cert := range a.caCerts {
+		tlsConfig.ClientCAs.AddCert(cert)
+	}
+	if tlsConfig.ClientAuth == tls.NoClientCert {
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+}
+
+// fromAddress returns true if r comes from one of the authenticating proxy's
+// addresses.
+func (a *authProxy) fromAddress(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	for _, network := range a.cidrs {
+		if ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// fromCertificate returns true if r was made with a client certificate
+// signed by the authenticating proxy's CA.
+func (a *authProxy) fromCertificate(r *http.Request) bool {
+	if a.cas == nil || r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return false
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range r.TLS.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := r.TLS.PeerCertificates[0].Verify(x509.VerifyOptions{
+		Roots:         a.cas,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	return err == nil
+}
+
+// identity returns the user named in the headers of r, if any, removing
+// the headers so they go no further.
+func (a *authProxy) identity(r *http.Request) (*identity, bool) {
+	var id identity
+	found := false
+	for _, header := range a.userHeaders {
+		if name := strings.TrimSpace(r.Header.Get(header)); len(name) > 0 && len(id.Name) == 0 {
+			id.Name = name
+		}
+		found = found || len(r.Header.Values(header)) > 0
+		r.Header.Del(header)
+	}
+	for _, header := range a.groupHeaders {
+		for _, value := range r.Header.Values(header) {
+			for _, group := range strings.Split(value, ",") {
+				if group = strings.TrimSpace(group); len(group) > 0 {
+					id.Groups = append(id.Groups, group)
+				}
+			}
+		}
+		found = found || len(r.Header.Values(header)) > 0
+		r.Header.Del(header)
+	}
+	for header, values := range r.Header {
+		for _, prefix := range a.extraHeaderPrefixes {
+			if !strings.HasPrefix(header, prefix) || len(header) == len(prefix) {
+				continue
+			}
+			key, err := url.PathUnescape(header[len(prefix):])
+			if err != nil {
+				key = header[len(prefix):]
+			}
+			key = strings.ToLower(key)
+			if id.Extra == nil {
+				id.Extra = make(map[string][]string)
+			}
+			id.Extra[key] = append(id.Extra[key], values...)
+			found = true
+			r.Header.Del(header)
+		}
+	}
+	if len(id.Name) == 0 {
+		return nil, found
+	}
+	return &id, found
+}
+
+// Wrap records the identity given by the authenticating proxy for requests
+// from it, and rejects requests from anywhere else that carry its headers.
+func (a *authProxy) Wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, found := a.identity(r)
+		switch {
+		case a.fromCertificate(r):
+			// The proxy's own certificate doesn't make it a user: its requests
+			// are made as the user it names or anonymously.
+			r = setIdentity(r, id)
+		case a.fromAddress(r):
+			if id != nil {
+				r = setIdentity(r, id)
+			}
+		case found:
+			http.Error(w, "403 identity headers are only accepted from the authenticating proxy", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func newTestAuthProxy(t *testing.T, ca *testCA) *authProxy {
+	caFile := ""
+	if ca != nil {
+		dir, err := ioutil.TempDir("", "authproxy")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		caFile = filepath.Join(dir, "ca.crt")
+		if err := ioutil.WriteFile(caFile, ca.pem, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a, err := newAuthProxy([]string{"X-Remote-User", "X-Forwarded-User"}, []string{"X-Remote-Group"}, []string{"X-Remote-Extra-"}, []string{"10.0.0.0/24", "fd00::/64"}, caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+// serveAuthProxy passes r through a, returning the status code, the
+// identity recorded & the headers that reached the handler.
+func serveAuthProxy(a *authProxy, r *http.Request) (int, *identity, http.Header) {
+	var id *identity
+	var headers http.Header
+	w := httptest.NewRecorder()
+	a.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, headers = identityFrom(r), r.Header
+	})).ServeHTTP(w, r)
+	return w.Code, id, headers
+}
+
+func newAuthProxyRequest(remoteAddr string, headers map[string][]string) *http.Request {
+	r := httptest.NewRequest("GET", "/api/v1beta3/pods", nil)
+	r.RemoteAddr = remoteAddr
+	for k, v := range headers {
+		r.Header[http.CanonicalHeaderKey(k)] = v
+	}
+	return r
+}
+
+func TestAuthProxyTrustedAddress(t *testing.T) {
+	a := newTestAuthProxy(t, nil)
+	r := newAuthProxyRequest("10.0.0.7:41234", map[string][]string{
+		"X-Remote-User":               {" jo "},
+		"X-Forwarded-User":            {"someone-else"},
+		"X-Remote-Group":              {"dev, ops", "admins"},
+		"X-Remote-Extra-Scopes":       {"read", "write"},
+		"X-Remote-Extra-Acme.com%2fx": {"y"},
+		"Accept":                      {"application/json"},
+	})
+	code, id, headers := serveAuthProxy(a, r)
+	if code != http.StatusOK {
+		t.Fatalf("got %d", code)
+	}
+	want := &identity{Name: "jo", Groups: []string{"dev", "ops", "admins"}, Extra: map[string][]string{"scopes": {"read", "write"}, "acme.com/x": {"y"}}}
+	if !reflect.DeepEqual(id, want) {
+		t.Errorf("got identity %+v, want %+v", id, want)
+	}
+	// The headers go no further than the proxy.
+	if want := (http.Header{"Accept": {"application/json"}}); !reflect.DeepEqual(headers, want) {
+		t.Errorf("passed on headers %v, want %v", headers, want)
+	}
+
+	// Requests from the authenticating proxy needn't name a user.
+	if code, id, _ := serveAuthProxy(a, newAuthProxyRequest("[fd00::1]:443", nil)); code != http.StatusOK || id != nil {
+		t.Errorf("without headers: got %d & identity %+v", code, id)
+	}
+}
+
+func TestAuthProxyUntrustedSource(t *testing.T) {
+	a := newTestAuthProxy(t, nil)
+	for _, headers := range []map[string][]string{
+		{"X-Remote-User": {"admin"}},
+		{"X-Forwarded-User": {"admin"}},
+		{"X-Remote-User": {""}},
+		{"X-Remote-Group": {"system:masters"}},
+		{"X-Remote-Extra-Scopes": {"all"}},
+	} {
+		for _, remoteAddr := range []string{"10.0.1.7:41234", "[fd00:0:0:1::1]:443", "not an address"} {
+			if code, id, _ := serveAuthProxy(a, newAuthProxyRequest(remoteAddr, headers)); code != http.StatusForbidden || id != nil {
+				t.Errorf("%v from %s: got %d & identity %+v, want 403", headers, remoteAddr, code, id)
+			}
+		}
+	}
+	// Other requests from elsewhere are left alone.
+	r := newAuthProxyRequest("192.0.2.1:41234", map[string][]string{"Authorization": {"Bearer t0ken"}})
+	if code, id, headers := serveAuthProxy(a, r); code != http.StatusOK || id != nil || headers.Get("Authorization") != "Bearer t0ken" {
+		t.Errorf("without headers: got %d & identity %+v", code, id)
+	}
+}
+
+func TestAuthProxyCertificate(t *testing.T) {
+	ca := newTestCA(t, "auth proxy")
+	a := newTestAuthProxy(t, ca)
+	leaf := func(cert tls.Certificate) *x509.Certificate {
+		c, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	proxyCert := leaf(ca.issue(t, pkix.Name{CommonName: "oauth2-proxy"}))
+	otherCert := leaf(newTestCA(t, "other").issue(t, pkix.Name{CommonName: "oauth2-proxy"}))
+
+	withCert := func(cert *x509.Certificate, headers map[string][]string) *http.Request {
+		r := newAuthProxyRequest("192.0.2.1:41234", headers)
+		r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+		return r
+	}
+	code, id, _ := serveAuthProxy(a, withCert(proxyCert, map[string][]string{"X-Remote-User": {"jo"}}))
+	if code != http.StatusOK || id == nil || id.Name != "jo" {
+		t.Errorf("from the proxy's certificate: got %d & identity %+v", code, id)
+	}
+	if code, id, _ := serveAuthProxy(a, withCert(otherCert, map[string][]string{"X-Remote-User": {"jo"}})); code != http.StatusForbidden || id != nil {
+		t.Errorf("from a certificate of another CA: got %d & identity %+v, want 403", code, id)
+	}
+
+	// The proxy's certificate doesn't itself make its requests those of a
+	// user, even once the client certificate authenticator has named one.
+	r := withCert(proxyCert, nil)
+	r = setIdentity(r, &identity{Name: "oauth2-proxy"})
+	if code, id, _ := serveAuthProxy(a, r); code != http.StatusOK || id != nil {
+		t.Errorf("from the proxy's certificate without headers: got %d & identity %+v", code, id)
+	}
+
+	tlsConfig := &tls.Config{}
+	a.configureTLS(tlsConfig)
+	if tlsConfig.ClientAuth != tls.VerifyClientCertIfGiven || tlsConfig.ClientCAs == nil {
+		t.Errorf("TLS config doesn't ask for the proxy's certificate: %+v", tlsConfig)
+	}
+}
+
+func TestNewAuthProxyErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "authproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	empty := filepath.Join(dir, "empty.crt")
+	ioutil.WriteFile(empty, []byte("no certificates here\n"), 0644)
+
+	if _, err := newAuthProxy(nil, nil, nil, []string{"10.0.0.0/24"}, ""); err == nil {
+		t.Errorf("accepted no user headers")
+	}
+	if _, err := newAuthProxy([]string{"X-Remote-User"}, nil, nil, []string{"10.0.0.0"}, ""); err == nil {
+		t.Errorf("accepted an address as a CIDR")
+	}
+	if _, err := newAuthProxy([]string{"X-Remote-User"}, nil, nil, nil, empty); err == nil {
+		t.Errorf("accepted a CA file without certificates")
+	}
+}
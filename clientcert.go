@@ -0,0 +1,68 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// Client certificate verification modes for --client-auth.
+const (
+	ClientAuthNone             = "none"
+	ClientAuthRequest          = "request"
+	ClientAuthRequireAndVerify = "require-and-verify"
+)
+
+// configureClientAuth sets up tlsConfig to ask for client certificates signed
+// by the CAs in caFile. In request mode a certificate is optional, but is
+// still verified if one is presented.
+func configureClientAuth(tlsConfig *tls.Config, caFile, mode string) error {
+	switch mode {
+	case ClientAuthNone:
+		tlsConfig.ClientAuth = tls.NoClientCert
+		return nil
+	case ClientAuthRequest:
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	case ClientAuthRequireAndVerify:
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return fmt.Errorf("unknown client auth mode %q", mode)
+	}
+	caData, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caData) {
+		return errors.New("no certificates found in " + caFile)
+	}
+	tlsConfig.ClientCAs = pool
+	return nil
+}
+
+// clientCertIdentity maps a verified client certificate to an identity, using
+// the subject common name as the username & the organizations as groups.
+func clientCertIdentity(r *http.Request) *identity {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	subject := r.TLS.VerifiedChains[0][0].Subject
+	if len(subject.CommonName) == 0 {
+		return nil
+	}
+	return &identity{Name: subject.CommonName, Groups: subject.Organization}
+}
+
+// ClientCertAuthenticator records the identity of any verified client
+// certificate presented with a request.
+func ClientCertAuthenticator(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id := clientCertIdentity(r); id != nil {
+			r = setIdentity(r, id)
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCA is an in-memory certificate authority.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns a client certificate for subject signed by the CA.
+func (ca *testCA) issue(t *testing.T, subject pkix.Name) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      subject,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// newClientCertServer returns a TLS server trusting client certificates from
+// ca in mode, that responds with the identity it authenticated.
+func newClientCertServer(t *testing.T, ca *testCA, mode string) *httptest.Server {
+	dir, err := ioutil.TempDir("", "clientcert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.crt")
+	if err := ioutil.WriteFile(caFile, ca.pem, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewUnstartedServer(ClientCertAuthenticator(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id := identityFrom(r); id != nil {
+			w.Write([]byte(id.Name + ":" + strings.Join(id.Groups, ",")))
+		}
+	})))
+	// Refused handshakes are expected.
+	server.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	server.TLS = &tls.Config{}
+	if err := configureClientAuth(server.TLS, caFile, mode); err != nil {
+		t.Fatal(err)
+	}
+	server.StartTLS()
+	return server
+}
+
+func TestClientCertModes(t *testing.T) {
+	ca := newTestCA(t, "clients")
+	trusted := ca.issue(t, pkix.Name{CommonName: "jo", Organization: []string{"dev", "ops"}})
+	noName := ca.issue(t, pkix.Name{Organization: []string{"admins"}})
+	untrusted := newTestCA(t, "other").issue(t, pkix.Name{CommonName: "mallory", Organization: []string{"admins"}})
+
+	const refused = "refused"
+	tests := []struct {
+		mode string
+		cert *tls.Certificate
+		want string
+	}{
+		{ClientAuthNone, nil, ""},
+		// A certificate isn't even asked for, so can't be verified or used.
+		{ClientAuthNone, &trusted, ""},
+		{ClientAuthNone, &untrusted, ""},
+		{ClientAuthRequest, nil, ""},
+		{ClientAuthRequest, &trusted, "jo:dev,ops"},
+		{ClientAuthRequest, &noName, ""},
+		{ClientAuthRequest, &untrusted, refused},
+		{ClientAuthRequireAndVerify, nil, refused},
+		{ClientAuthRequireAndVerify, &trusted, "jo:dev,ops"},
+		{ClientAuthRequireAndVerify, &untrusted, refused},
+	}
+	for _, test := range tests {
+		server := newClientCertServer(t, ca, test.mode)
+		client := server.Client()
+		transport := client.Transport.(*http.Transport)
+		if cert := test.cert; cert != nil {
+			// Send the certificate even when the server doesn't list its CA.
+			transport.TLSClientConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				return cert, nil
+			}
+		}
+		got := refused
+		if resp, err := client.Get(server.URL); err == nil {
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			got = string(body)
+		}
+		if got != test.want {
+			name := "no certificate"
+			if test.cert != nil {
+				leaf, _ := x509.ParseCertificate(test.cert.Certificate[0])
+				name = "certificate for " + leaf.Subject.String()
+			}
+			t.Errorf("%s mode with %s: got %q, want %q", test.mode, name, got, test.want)
+		}
+		server.Close()
+	}
+}
+
+func TestClientCertBadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clientcert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	empty := filepath.Join(dir, "empty.crt")
+	ioutil.WriteFile(empty, []byte("no certificates here\n"), 0644)
+
+	for _, test := range []struct{ caFile, mode string }{
+		{empty, "sometimes"},
+		{empty, ClientAuthRequest},
+		{filepath.Join(dir, "missing.crt"), ClientAuthRequireAndVerify},
+	} {
+		if err := configureClientAuth(&tls.Config{}, test.caFile, test.mode); err == nil {
+			t.Errorf("%s mode with %s: expected an error", test.mode, test.caFile)
+		}
+	}
+	// No CA is needed when certificates aren't asked for.
+	if err := configureClientAuth(&tls.Config{}, "", ClientAuthNone); err != nil {
+		t.Errorf("none mode: %v", err)
+	}
+}
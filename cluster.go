@@ -0,0 +1,316 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	k8sclient "github.com/GoogleCloudPlatform/kubernetes/pkg/client"
+	"github.com/GoogleCloudPlatform/kubernetes/pkg/kubectl"
+	"github.com/ghodss/yaml"
+)
+
+// defaultClusterName is the name given to the cluster configured by the
+// --kubernetes-*, --kubeconfig & --token-file flags.
+const defaultClusterName = "default"
+
+// ClusterConfig describes how to connect to one Kubernetes master in a
+// --clusters file.
+type ClusterConfig struct {
+	Name       string   `json:"name"`
+	Master     string   `json:"master,omitempty"`
+	Masters    []string `json:"masters,omitempty"`
+	APIVersion string   `json:"apiVersion,omitempty"`
+	CACert     string   `json:"caCert,omitempty"`
+	Insecure   bool     `json:"insecure,omitempty"`
+	Token      string   `json:"token,omitempty"`
+	TokenFile  string   `json:"tokenFile,omitempty"`
+	ClientCert string   `json:"clientCert,omitempty"`
+	ClientKey  string   `json:"clientKey,omitempty"`
+	Username   string   `json:"username,omitempty"`
+	Password   string   `json:"password,omitempty"`
+}
+
+var clusterNameRegexp = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+
+// loadClusterConfigs reads the clusters listed in a YAML or JSON file.
+func loadClusterConfigs(path string) ([]ClusterConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseClusterConfigs(data, path)
+}
+
+// parseClusterConfigs parses the YAML or JSON list of clusters read from path.
+func parseClusterConfigs(data []byte, path string) ([]ClusterConfig, error) {
+	var file struct {
+		Clusters []ClusterConfig `json:"clusters"`
+	}
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("couldn't parse %s: %v", path, err)
+	}
+	seen := map[string]bool{}
+	for _, c := range file.Clusters {
+		switch {
+		case !clusterNameRegexp.MatchString(c.Name):
+			return nil, fmt.Errorf("invalid cluster name %q in %s", c.Name, path)
+		case seen[c.Name]:
+			return nil, fmt.Errorf("duplicate cluster name %q in %s", c.Name, path)
+		case len(c.Master) == 0 && len(c.Masters) == 0:
+			return nil, fmt.Errorf("no master given for cluster %q in %s", c.Name, path)
+		}
+		seen[c.Name] = true
+	}
+	return file.Clusters, nil
+}
+
+// masters returns the URLs of the masters of c.
+func (c *ClusterConfig) masters() []string {
+	if len(c.Master) > 0 {
+		return append([]string{c.Master}, c.Masters...)
+	}
+	return c.Masters
+}
+
+// clientConfig returns the Kubernetes client config for c.
+func (c *ClusterConfig) clientConfig(defaultVersion string) *k8sclient.Config {
+	config := &k8sclient.Config{
+		Host:        c.masters()[0],
+		Version:     c.APIVersion,
+		Insecure:    c.Insecure,
+		BearerToken: c.Token,
+		Username:    c.Username,
+		Password:    c.Password,
+		TLSClientConfig: k8sclient.TLSClientConfig{
+			CAFile:   c.CACert,
+			CertFile: c.ClientCert,
+			KeyFile:  c.ClientKey,
+		},
+	}
+	if len(config.Version) == 0 {
+		config.Version = defaultVersion
+	}
+	return config
+}
+
+// upstreamOptions holds the settings that apply to the proxies of every cluster.
+type upstreamOptions struct {
+	passthrough          *credentialPassthrough
+	impersonate          bool
+	metrics              *proxyMetrics
+	redactor             *redactor
+	shareWatches         bool
+	cache                *responseCache
+	rateLimiter          *rateLimiter
+	resilience           *resilienceOptions
+	masterBalance        string
+	tokenRefreshInterval time.Duration
+	// filters are applied to every API & OpenShift API request, outermost first.
+	filters []func(http.Handler) http.Handler
+}
+
+// cluster is a Kubernetes master, or the masters of an HA cluster, along with
+// the proxies to its Kubernetes & OpenShift APIs.
+type cluster struct {
+	name    string
+	config  *k8sclient.Config
+	client  *k8sclient.Client
+	masters *masterPool
+	api     *kubectl.ProxyServer
+	osapi   *httputil.ReverseProxy
+	opts    *upstreamOptions
+	// breaker is shared by the proxies to both APIs, if enabled.
+	breaker *circuitBreaker
+
+	mu            sync.RWMutex
+	serverVersion string
+}
+
+// newCluster creates the proxies for the masters at hosts, connected to as
+// described by config, which authenticates with tokenFile instead if it is set.
+func newCluster(name string, config *k8sclient.Config, hosts []string, tokenFile string, opts *upstreamOptions) (*cluster, error) {
+	proxyConfig := *config
+	if opts.passthrough != nil {
+		// When passing credentials through, the proxies must not add their own,
+		// including a client certificate the master would authenticate first.
+		proxyConfig.BearerToken, proxyConfig.Username, proxyConfig.Password = "", "", ""
+		proxyConfig.CertFile, proxyConfig.KeyFile = "", ""
+		proxyConfig.CertData, proxyConfig.KeyData = nil, nil
+		if len(opts.passthrough.fallbackToken) > 0 {
+			fallbackConfig := *config
+			fallbackConfig.BearerToken, fallbackConfig.Username, fallbackConfig.Password = opts.passthrough.fallbackToken, "", ""
+			config = &fallbackConfig
+		}
+	}
+
+	if len(tokenFile) > 0 {
+		tokens, err := newTokenFile(tokenFile, opts.tokenRefreshInterval)
+		if err != nil {
+			return nil, err
+		}
+		if config, err = withTokenFile(config, tokens); err != nil {
+			return nil, err
+		}
+		if opts.passthrough == nil {
+			proxyConfig = *config
+		}
+	}
+
+	client, err := k8sclient.New(config)
+	if err != nil {
+		return nil, err
+	}
+
+	masters, err := newMasterPool(name, config, hosts, opts.masterBalance, opts.metrics)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &cluster{name: name, config: config, client: client, masters: masters, opts: opts}
+	if opts.resilience != nil && opts.resilience.breakerFailures > 0 {
+		// Both APIs are served by the same master, so share one breaker.
+		c.breaker = newCircuitBreaker(name, opts.resilience.breakerFailures, opts.resilience.breakerCooldown, opts.metrics)
+	}
+	if c.api, err = newApiProxy(&proxyConfig); err != nil {
+		return nil, err
+	}
+	c.api.Transport = c.wrapTransport(c.api.Transport, routeApi)
+	if c.osapi, err = newOsApiProxy(&proxyConfig); err != nil {
+		return nil, err
+	}
+	c.osapi.Transport = c.wrapTransport(c.osapi.Transport, routeOsApi)
+	c.api.ErrorHandler = proxyErrorHandler(name)
+	c.osapi.ErrorHandler = proxyErrorHandler(name)
+	if opts.shareWatches {
+		c.api.Transport = newWatchMultiplexer(c.api.Transport)
+		c.osapi.Transport = newWatchMultiplexer(c.osapi.Transport)
+	}
+	if opts.cache != nil {
+		c.api.Transport = opts.cache.Transport(c.api.Transport)
+		c.osapi.Transport = opts.cache.Transport(c.osapi.Transport)
+	}
+	if opts.redactor != nil {
+		c.api.ModifyResponse = opts.redactor.ModifyResponse
+		c.osapi.ModifyResponse = opts.redactor.ModifyResponse
+	}
+	return c, nil
+}
+
+func (c *cluster) wrapTransport(rt http.RoundTripper, upstream string) http.RoundTripper {
+	rt = c.masters.Transport(rt)
+	if c.opts.impersonate {
+		rt = newImpersonatingTransport(rt)
+	}
+	if c.opts.metrics != nil {
+		rt = c.opts.metrics.InstrumentTransport(rt, c.name, upstream)
+	}
+	if c.opts.resilience != nil {
+		rt = newResilientTransport(rt, c.name, c.opts.resilience, c.breaker, c.opts.metrics)
+	}
+	return rt
+}
+
+// waitForMaster checks a master can be reached, retrying as configured.
+func (c *cluster) waitForMaster(retries int, backoff time.Duration) error {
+	serverVersion, err := waitForMaster(c.masters.checkAll, retries, backoff, 30*time.Second)
+	if err != nil {
+		return fmt.Errorf("couldn't retrieve Kubernetes server version for cluster %s - incorrect URL? %v", c.name, err)
+	}
+	log.Printf("Connecting to Kubernetes master for cluster %s at %v running version %v", c.name, strings.Join(c.masters.hosts(), ", "), serverVersion)
+	c.mu.Lock()
+	c.serverVersion = serverVersion
+	c.mu.Unlock()
+	return nil
+}
+
+// ApiHandler returns the handler for the Kubernetes API, to be mounted at prefix.
+func (c *cluster) ApiHandler(prefix string) http.Handler {
+	return http.StripPrefix(prefix, c.filter(c.api, routeApi))
+}
+
+// OsApiHandler returns the handler for the OpenShift API, to be mounted at prefix.
+func (c *cluster) OsApiHandler(prefix string) http.Handler {
+	return http.StripPrefix(prefix, stripGenericWebhookBody(c.filter(c.osapi, routeOsApi)))
+}
+
+// filter wraps h, the proxy to upstream, in the configured filters and
+// credential passthrough or, when impersonating, the check that the request
+// has been authenticated. Rate limits apply once the user is known.
+func (c *cluster) filter(h http.Handler, upstream string) http.Handler {
+	h = markUpstreamRequest(h)
+	if c.opts.rateLimiter != nil {
+		h = c.opts.rateLimiter.Limit(h, upstream)
+	}
+	if c.opts.passthrough != nil {
+		h = c.opts.passthrough.Wrap(h)
+	}
+	if c.opts.impersonate {
+		h = requireIdentity(h)
+	}
+	for i := len(c.opts.filters) - 1; i >= 0; i-- {
+		h = c.opts.filters[i](h)
+	}
+	return h
+}
+
+// clusterPrefix returns the path prefix the APIs of the named cluster are
+// served under.
+func clusterPrefix(name string) string {
+	return "/clusters/" + name + "/"
+}
+
+type clusterInfo struct {
+	Name          string       `json:"name"`
+	Master        string       `json:"master"`
+	Masters       []masterInfo `json:"masters"`
+	APIVersion    string       `json:"apiVersion"`
+	ServerVersion string       `json:"serverVersion,omitempty"`
+	Api           string       `json:"api"`
+	OsApi         string       `json:"osapi"`
+}
+
+// clusterIndex serves a JSON list of the available clusters at /clusters.
+type clusterIndex []*cluster
+
+func (index clusterIndex) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	infos := make([]clusterInfo, 0, len(index))
+	for _, c := range index {
+		c.mu.RLock()
+		infos = append(infos, clusterInfo{
+			Name:          c.name,
+			Master:        c.config.Host,
+			Masters:       c.masters.info(),
+			APIVersion:    c.config.Version,
+			ServerVersion: c.serverVersion,
+			Api:           clusterPrefix(c.name) + "api/",
+			OsApi:         clusterPrefix(c.name) + "osapi/",
+		})
+		c.mu.RUnlock()
+	}
+	body, _ := json.MarshalIndent(&struct {
+		Clusters []clusterInfo `json:"clusters"`
+	}{infos}, "", "  ")
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// clusterFromPath returns the cluster name and the remainder of a path under
+// /clusters/, e.g. ("prod", "api/v1beta3/pods") for /clusters/prod/api/v1beta3/pods.
+func clusterFromPath(path string) (string, string, bool) {
+	if !strings.HasPrefix(path, "/clusters/") {
+		return "", "", false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(path, "/clusters/"), "/", 2)
+	if len(parts) < 2 {
+		return parts[0], "", true
+	}
+	return parts[0], parts[1], true
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	k8sclient "github.com/GoogleCloudPlatform/kubernetes/pkg/client"
+)
+
+func TestNewClusterPassthroughFallback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cluster")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fallbackFile := filepath.Join(dir, "fallback")
+	if err := ioutil.WriteFile(fallbackFile, []byte("fallback\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	passthrough, err := newCredentialPassthrough("", fallbackFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &k8sclient.Config{Host: "http://master:8080", Version: "v1beta3", BearerToken: "proxy", Username: "u", Password: "p"}
+	c, err := newCluster("test", config, []string{config.Host}, "", &upstreamOptions{passthrough: passthrough, masterBalance: MasterBalanceRoundRobin})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Health checks use the fallback token, without changing the config the
+	// caller passed in.
+	if c.config.BearerToken != "fallback" || len(c.config.Username) > 0 {
+		t.Errorf("cluster config: got %+v, want the fallback token", c.config)
+	}
+	if config.BearerToken != "proxy" || config.Username != "u" || config.Password != "p" {
+		t.Errorf("caller's config changed: %+v", config)
+	}
+}
@@ -0,0 +1,590 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"github.com/jessevdk/go-flags"
+)
+
+// reloadableOptions are the options, by long name, that a config reload puts
+// into effect. Changes to any others need a restart.
+var reloadableOptions = map[string]bool{
+	"policy":                   true,
+	"rate-limit-read":          true,
+	"rate-limit-read-burst":    true,
+	"rate-limit-write":         true,
+	"rate-limit-write-burst":   true,
+	"rate-limit-watch":         true,
+	"rate-limit-watch-burst":   true,
+	"rate-limit-osapi":         true,
+	"rate-limit-osapi-burst":   true,
+	"max-in-flight-per-client": true,
+	"rate-limit-by":            true,
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// configFile is a --config file: values for options by their long names, as
+// they would be given on the command line, plus the policy & clusters, which
+// may be given inline instead of in files of their own.
+type configFile struct {
+	path     string
+	options  map[string][]string
+	policy   *Policy
+	clusters []ClusterConfig
+}
+
+// configError lists what is wrong with a config file, each problem shown as
+// the line in the file & what was expected in its place.
+type configError struct {
+	path     string
+	problems []string
+}
+
+func (e *configError) Error() string {
+	return fmt.Sprintf("invalid config file %s:\n%s", e.path, strings.Join(e.problems, "\n"))
+}
+
+// add records message about the line of the file setting key to value, and
+// the line expected in its place, if there's one to suggest.
+func (e *configError) add(key string, value interface{}, message, expected string) {
+	problem := fmt.Sprintf("  %s: %s\n  - %s: %s", key, message, key, formatConfigValue(value))
+	if len(expected) > 0 {
+		problem += "\n  + " + expected
+	}
+	e.problems = append(e.problems, problem)
+}
+
+func formatConfigValue(value interface{}) string {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(data)
+}
+
+// loadConfigFile reads a YAML or JSON config file, checking every option in
+// it is known & has a valid value.
+func loadConfigFile(path string) (*configFile, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var values map[string]interface{}
+	if err := yaml.Unmarshal(data, &values); err != nil {
+		return nil, fmt.Errorf("couldn't parse config file %s: %v", path, err)
+	}
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	c := &configFile{path: path, options: make(map[string][]string)}
+	e := &configError{path: path}
+	fields := optionFields()
+	for _, key := range keys {
+		value := values[key]
+		switch v := value.(type) {
+		case map[string]interface{}:
+			if key == "policy" {
+				data, _ := json.Marshal(v)
+				if c.policy, err = parsePolicy(data, path); err != nil {
+					e.problems = append(e.problems, fmt.Sprintf("  policy: %v", err))
+				}
+				continue
+			}
+		case []interface{}:
+			if key == "clusters" {
+				data, _ := json.Marshal(map[string]interface{}{"clusters": v})
+				if c.clusters, err = parseClusterConfigs(data, path); err != nil {
+					e.problems = append(e.problems, fmt.Sprintf("  clusters: %v", err))
+				}
+				continue
+			}
+		}
+		if key == "config" {
+			e.add(key, value, "can't be set in a config file", "")
+			continue
+		}
+		field, ok := fields[key]
+		if !ok {
+			expected := ""
+			if closest := closestOption(key, fields); len(closest) > 0 {
+				expected = closest + ": " + formatConfigValue(value)
+			}
+			e.add(key, value, "unknown option", expected)
+			continue
+		}
+		args, expected := optionArgs(value, field.Type)
+		if len(expected) > 0 {
+			e.add(key, value, "expected "+expected, key+": <"+expected+">")
+			continue
+		}
+		c.options[key] = args
+	}
+	if len(e.problems) > 0 {
+		return nil, e
+	}
+	return c, nil
+}
+
+// optionFields returns the fields of Options by their long option names.
+func optionFields() map[string]reflect.StructField {
+	fields := make(map[string]reflect.StructField)
+	t := reflect.TypeOf(Options{})
+	for i := 0; i < t.NumField(); i++ {
+		if name := t.Field(i).Tag.Get("long"); len(name) > 0 {
+			fields[name] = t.Field(i)
+		}
+	}
+	return fields
+}
+
+// optionArgs converts value to the arguments for an option of type t, or
+// describes what was expected if it can't be.
+func optionArgs(value interface{}, t reflect.Type) ([]string, string) {
+	if t.Kind() != reflect.Slice {
+		arg, expected := optionArg(value, t)
+		if len(expected) > 0 {
+			return nil, expected
+		}
+		return []string{arg}, ""
+	}
+	items, ok := value.([]interface{})
+	if !ok {
+		items = []interface{}{value}
+	}
+	args := make([]string, 0, len(items))
+	for _, item := range items {
+		arg, expected := optionArg(item, t.Elem())
+		if len(expected) > 0 {
+			return nil, "a list of values, each " + expected
+		}
+		args = append(args, arg)
+	}
+	return args, ""
+}
+
+func optionArg(value interface{}, t reflect.Type) (string, string) {
+	var arg string
+	switch v := value.(type) {
+	case nil:
+	case string:
+		arg = v
+	case bool:
+		arg = strconv.FormatBool(v)
+	case float64:
+		arg = strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return "", describeOptionType(t)
+	}
+	var err error
+	switch {
+	case t == durationType:
+		_, err = time.ParseDuration(arg)
+	case t.Kind() == reflect.Bool:
+		_, err = strconv.ParseBool(arg)
+	case t.Kind() >= reflect.Int && t.Kind() <= reflect.Int64:
+		_, err = strconv.ParseInt(arg, 10, t.Bits())
+	case t.Kind() >= reflect.Uint && t.Kind() <= reflect.Uint64:
+		_, err = strconv.ParseUint(arg, 10, t.Bits())
+	case t.Kind() == reflect.Float32 || t.Kind() == reflect.Float64:
+		_, err = strconv.ParseFloat(arg, t.Bits())
+	}
+	if err != nil {
+		return "", describeOptionType(t)
+	}
+	return arg, ""
+}
+
+func describeOptionType(t reflect.Type) string {
+	switch {
+	case t == durationType:
+		return "a duration such as 10s"
+	case t.Kind() == reflect.Bool:
+		return "true or false"
+	case t.Kind() >= reflect.Int && t.Kind() <= reflect.Uint64:
+		return "a whole number"
+	case t.Kind() == reflect.Float32 || t.Kind() == reflect.Float64:
+		return "a number"
+	}
+	return "a string"
+}
+
+// closestOption returns the option name most like name, if any is close
+// enough to be a likely typo.
+func closestOption(name string, fields map[string]reflect.StructField) string {
+	closest, best := "", len(name)/4+2
+	for option := range fields {
+		if option == "config" {
+			continue
+		}
+		if d := editDistance(name, option); d < best || (d == best && option < closest) {
+			closest, best = option, d
+		}
+	}
+	return closest
+}
+
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = minInt(prev[j]+1, minInt(cur[j-1]+1, prev[j-1]+cost))
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// apply makes the values in c the defaults of the options of parser, so the
+// command line & environment still take precedence over them.
+func (c *configFile) apply(parser *flags.Parser) {
+	c.applyGroup(parser.Command.Group)
+}
+
+func (c *configFile) applyGroup(group *flags.Group) {
+	for _, option := range group.Options() {
+		if args, ok := c.options[option.LongName]; ok {
+			option.Default = args
+		}
+	}
+	for _, g := range group.Groups() {
+		c.applyGroup(g)
+	}
+}
+
+// parseOptions parses the command line args, and the environment, over the
+// settings in the --config file, if one is given.
+func parseOptions(args []string, parserOptions flags.Options) (*Options, *configFile, error) {
+	args, bools := boolArgs(args)
+	var options Options
+	if _, err := flags.NewParser(&options, parserOptions).ParseArgs(args); err != nil || len(options.ConfigFile) == 0 {
+		bools.apply(&options)
+		return &options, nil, err
+	}
+	config, err := loadConfigFile(options.ConfigFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	options = Options{}
+	parser := flags.NewParser(&options, parserOptions)
+	config.apply(parser)
+	if _, err := parser.ParseArgs(args); err != nil {
+		return nil, nil, err
+	}
+	bools.apply(&options)
+	return &options, config, nil
+}
+
+// boolValues are the values of bool options given as --name=true or
+// --name=false, by field index.
+type boolValues map[int]bool
+
+// boolArgs takes any --name=true or --name=false arguments for bool options
+// out of args, as go-flags only accepts a bare --name for them, which can't
+// turn off an option set in the config file. Those with values that aren't
+// bools are left for go-flags to reject.
+func boolArgs(args []string) ([]string, boolValues) {
+	fields := optionFields()
+	rest := make([]string, 0, len(args))
+	bools := make(boolValues)
+	for i, arg := range args {
+		if arg == "--" {
+			rest = append(rest, args[i:]...)
+			break
+		}
+		eq := strings.Index(arg, "=")
+		if !strings.HasPrefix(arg, "--") || eq < 0 {
+			rest = append(rest, arg)
+			continue
+		}
+		field, ok := fields[arg[2:eq]]
+		if !ok || field.Type.Kind() != reflect.Bool {
+			rest = append(rest, arg)
+			continue
+		}
+		value, err := strconv.ParseBool(arg[eq+1:])
+		if err != nil {
+			rest = append(rest, arg)
+			continue
+		}
+		bools[field.Index[0]] = value
+	}
+	return rest, bools
+}
+
+func (b boolValues) apply(options *Options) {
+	v := reflect.ValueOf(options).Elem()
+	for i, value := range b {
+		v.Field(i).SetBool(value)
+	}
+}
+
+// configuredPolicy returns the policy from the --policy file or, failing
+// that, given inline in the config file, if any.
+func configuredPolicy(options *Options, config *configFile) (*Policy, error) {
+	if len(options.PolicyFile) > 0 {
+		return loadPolicy(options.PolicyFile)
+	}
+	if config != nil {
+		return config.policy, nil
+	}
+	return nil, nil
+}
+
+// rateLimits returns the rate limits of each class of request set by options.
+func rateLimits(options *Options) map[string]rateLimit {
+	return map[string]rateLimit{
+		rateClassRead:  newRateLimit(options.RateLimitRead, options.RateLimitReadBurst),
+		rateClassWrite: newRateLimit(options.RateLimitWrite, options.RateLimitWriteBurst),
+		rateClassWatch: newRateLimit(options.RateLimitWatch, options.RateLimitWatchBurst),
+		rateClassOsApi: newRateLimit(options.RateLimitOsApi, options.RateLimitOsApiBurst),
+	}
+}
+
+// configReloader re-reads the config & policy files on SIGHUP or when either
+// changes, putting the new policy & rate limits into effect without
+// interrupting any requests. Config that can't be loaded is rejected,
+// keeping what is in effect.
+type configReloader struct {
+	args        []string
+	options     *Options
+	config      *configFile
+	policy      *reloadablePolicy
+	rateLimiter *rateLimiter
+	modTimes    map[string]time.Time
+}
+
+func newConfigReloader(args []string, options *Options, config *configFile, policy *reloadablePolicy, rateLimiter *rateLimiter) *configReloader {
+	return &configReloader{args: args, options: options, config: config, policy: policy, rateLimiter: rateLimiter}
+}
+
+// start reloads on SIGHUP, and checks the files for changes every interval.
+func (c *configReloader) start(interval time.Duration) {
+	c.modTimes = c.stat()
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	go func() {
+		tick := time.Tick(interval)
+		for {
+			select {
+			case <-sighup:
+				c.reload()
+			case <-tick:
+				if !reflect.DeepEqual(c.stat(), c.modTimes) {
+					c.reload()
+				}
+			}
+		}
+	}()
+}
+
+// stat returns the modification times of the config & policy files.
+func (c *configReloader) stat() map[string]time.Time {
+	modTimes := make(map[string]time.Time)
+	for _, path := range []string{c.options.ConfigFile, c.options.PolicyFile} {
+		if len(path) == 0 {
+			continue
+		}
+		if fi, err := os.Stat(path); err == nil {
+			modTimes[path] = fi.ModTime()
+		}
+	}
+	return modTimes
+}
+
+func (c *configReloader) reload() {
+	// A file that can't be loaded isn't tried again until it changes.
+	c.modTimes = c.stat()
+	options, config, err := parseOptions(c.args, flags.None)
+	var policy *Policy
+	if err == nil {
+		policy, err = configuredPolicy(options, config)
+	}
+	if err == nil && c.rateLimiter != nil {
+		err = c.rateLimiter.update(rateLimits(options), options.MaxInFlightPerClient, options.RateLimitBy)
+	}
+	if err != nil {
+		log.Printf("Not reloading config: %v", err)
+		return
+	}
+	oldPolicy := c.policy.get()
+	c.policy.set(policy)
+
+	reloaded, restart := optionChanges(c.options, options)
+	if !reflect.DeepEqual(oldPolicy, policy) {
+		reloaded = append(reloaded, "  policy: rules changed")
+	}
+	var oldClusters, clusters []ClusterConfig
+	if c.config != nil {
+		oldClusters = c.config.clusters
+	}
+	if config != nil {
+		clusters = config.clusters
+	}
+	if !reflect.DeepEqual(oldClusters, clusters) {
+		restart = append(restart, "  clusters: changed")
+	}
+	c.options, c.config = options, config
+	c.modTimes = c.stat()
+
+	if len(reloaded) == 0 && len(restart) == 0 {
+		log.Printf("Reloaded config, nothing changed")
+		return
+	}
+	if len(reloaded) > 0 {
+		log.Printf("Reloaded config:\n%s", strings.Join(reloaded, "\n"))
+	}
+	if len(restart) > 0 {
+		log.Printf("Config changes that need a restart to take effect:\n%s", strings.Join(restart, "\n"))
+	}
+}
+
+// optionChanges returns, as diff lines, the options that differ between old
+// & new: those a reload puts into effect and those that need a restart.
+func optionChanges(old, new *Options) (reloaded, restart []string) {
+	oldValue, newValue := reflect.ValueOf(old).Elem(), reflect.ValueOf(new).Elem()
+	t := oldValue.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := t.Field(i).Tag.Get("long")
+		a, b := oldValue.Field(i), newValue.Field(i)
+		if len(name) == 0 || reflect.DeepEqual(a.Interface(), b.Interface()) {
+			continue
+		}
+		diff := fmt.Sprintf("- %s: %s\n+ %s: %s", name, formatOptionValue(a), name, formatOptionValue(b))
+		if reloadableOptions[name] {
+			reloaded = append(reloaded, diff)
+		} else {
+			restart = append(restart, diff)
+		}
+	}
+	return reloaded, restart
+}
+
+// formatOptionValue formats the value of an option field as it would be given
+// in a config file.
+func formatOptionValue(v reflect.Value) string {
+	if v.Type() == durationType {
+		return v.Interface().(time.Duration).String()
+	}
+	if v.Kind() == reflect.Slice {
+		items := make([]string, v.Len())
+		for i := range items {
+			items[i] = formatOptionValue(v.Index(i))
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+	}
+	return fmt.Sprint(v.Interface())
+}
+
+// maskedSecret replaces secrets in printed config.
+const maskedSecret = "********"
+
+// printConfig writes the options in effect to w as a config file, along with
+// any policy & clusters given inline, masking secrets: options tagged secret,
+// passwords in URLs & the credentials of clusters.
+func printConfig(w io.Writer, options *Options, config *configFile) {
+	inline := make(map[string]interface{})
+	if config != nil {
+		if config.policy != nil && len(options.PolicyFile) == 0 {
+			inline["policy"] = config.policy
+		}
+		if len(config.clusters) > 0 && len(options.ClustersFile) == 0 {
+			clusters := make([]ClusterConfig, len(config.clusters))
+			for i, c := range config.clusters {
+				c.Master, c.Masters = maskURLPassword(c.Master), maskURLPasswords(c.Masters)
+				if len(c.Token) > 0 {
+					c.Token = maskedSecret
+				}
+				if len(c.Password) > 0 {
+					c.Password = maskedSecret
+				}
+				clusters[i] = c
+			}
+			inline["clusters"] = clusters
+		}
+	}
+
+	v := reflect.ValueOf(options).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := field.Tag.Get("long")
+		if len(name) == 0 || name == "config" || name == "print-config" || inline[name] != nil {
+			continue
+		}
+		var value interface{}
+		switch x := v.Field(i).Interface().(type) {
+		case time.Duration:
+			value = x.String()
+		case string:
+			value = maskURLPassword(x)
+			if field.Tag.Get("secret") == "true" && len(x) > 0 {
+				value = maskedSecret
+			}
+		case []string:
+			value = maskURLPasswords(x)
+		default:
+			value = x
+		}
+		fmt.Fprintf(w, "%s: %s\n", name, formatConfigValue(value))
+	}
+	if len(inline) > 0 {
+		data, _ := yaml.Marshal(inline)
+		w.Write(data)
+	}
+}
+
+// maskURLPassword masks the password in s if it is a URL with one.
+func maskURLPassword(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.User == nil {
+		return s
+	}
+	if _, ok := u.User.Password(); !ok {
+		return s
+	}
+	// Added after encoding, which would escape the mask.
+	u.User = url.User(u.User.Username())
+	return strings.Replace(u.String(), "@", ":"+maskedSecret+"@", 1)
+}
+
+func maskURLPasswords(values []string) []string {
+	masked := make([]string, len(values))
+	for i, value := range values {
+		masked[i] = maskURLPassword(value)
+	}
+	return masked
+}
@@ -1,30 +1,205 @@
 package main
 
 import (
-	"strings"
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
+)
 
-	restful "github.com/emicklei/go-restful"
+const (
+	CommonLogFormat   = "common"
+	CombinedLogFormat = "combined"
+	JSONLogFormat     = "json"
 )
 
-func NCSACommonLogFormatLogger() restful.FilterFunction {
-	return func(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
-		var username = "-"
-		if req.Request.URL.User != nil {
-			if name := req.Request.URL.User.Username(); name != "" {
-				username = name
+// responseRecorder captures the status code and body size of a response while
+// still allowing streaming and connection upgrades.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int64
+}
+
+func (r *responseRecorder) WriteHeader(code int) {
+	if r.status == 0 {
+		r.status = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *responseRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *responseRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (r *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response does not support hijacking")
+	}
+	if r.status == 0 {
+		r.status = http.StatusSwitchingProtocols
+	}
+	return h.Hijack()
+}
+
+func (r *responseRecorder) statusCode() int {
+	if r.status == 0 {
+		return http.StatusOK
+	}
+	return r.status
+}
+
+type accessLogEntry struct {
+	Host      string  `json:"host"`
+	User      string  `json:"user"`
+	Time      string  `json:"time"`
+	Method    string  `json:"method"`
+	URI       string  `json:"uri"`
+	Proto     string  `json:"proto"`
+	Status    int     `json:"status"`
+	Size      int64   `json:"size"`
+	Referer   string  `json:"referer,omitempty"`
+	UserAgent string  `json:"userAgent,omitempty"`
+	Latency   float64 `json:"latencySeconds"`
+}
+
+// AccessLogger writes a line to logger for every request served by h, in
+// either NCSA Common or Combined Log Format or as JSON. The request latency in
+// microseconds is appended to the NCSA formats.
+func AccessLogger(h http.Handler, format string) (http.Handler, error) {
+	switch format {
+	case CommonLogFormat, CombinedLogFormat, JSONLogFormat:
+	default:
+		return nil, fmt.Errorf("unknown access log format %q", format)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &responseRecorder{ResponseWriter: w}
+		// Capture this before the handler chain gets to modify the request.
+		uri := r.URL.RequestURI()
+		r = withIdentityHolder(r)
+
+		h.ServeHTTP(rec, r)
+
+		latency := time.Since(start)
+		username := accessLogUsername(r)
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		switch format {
+		case CommonLogFormat:
+			logger.Printf("%s - %s [%s] \"%s %s %s\" %d %d %d",
+				host, username, start.Format("02/Jan/2006:15:04:05 -0700"),
+				r.Method, uri, r.Proto, rec.statusCode(), rec.size,
+				latency.Nanoseconds()/int64(time.Microsecond),
+			)
+		case CombinedLogFormat:
+			logger.Printf("%s - %s [%s] \"%s %s %s\" %d %d %q %q %d",
+				host, username, start.Format("02/Jan/2006:15:04:05 -0700"),
+				r.Method, uri, r.Proto, rec.statusCode(), rec.size,
+				orDash(r.Referer()), orDash(r.UserAgent()),
+				latency.Nanoseconds()/int64(time.Microsecond),
+			)
+		case JSONLogFormat:
+			entry, _ := json.Marshal(&accessLogEntry{
+				Host:      host,
+				User:      username,
+				Time:      start.Format(time.RFC3339),
+				Method:    r.Method,
+				URI:       uri,
+				Proto:     r.Proto,
+				Status:    rec.statusCode(),
+				Size:      rec.size,
+				Referer:   r.Referer(),
+				UserAgent: r.UserAgent(),
+				Latency:   latency.Seconds(),
+			})
+			logger.Println(string(entry))
+		}
+	}), nil
+}
+
+// accessLogUsername returns the user the proxy authenticated r as, by client
+// certificate, OIDC or a trusted authenticating proxy. Usernames the client
+// merely claims, such as in Basic credentials passed on to the master, aren't
+// logged as they could be anything.
+func accessLogUsername(r *http.Request) string {
+	if id := identityFrom(r); id != nil && len(id.Name) > 0 {
+		return id.Name
+	}
+	return "-"
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// reopeningFile is an io.Writer for a log file that is reopened on SIGHUP, so
+// that it plays nicely with logrotate and friends.
+type reopeningFile struct {
+	path string
+	mu   sync.Mutex
+	f    *os.File
+}
+
+func newReopeningFile(path string) (*reopeningFile, error) {
+	rf := &reopeningFile{path: path}
+	if err := rf.reopen(); err != nil {
+		return nil, err
+	}
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	go func() {
+		for range sighup {
+			if err := rf.reopen(); err != nil {
+				log.Printf("Couldn't reopen access log %s: %v", rf.path, err)
 			}
 		}
-		chain.ProcessFilter(req, resp)
-		logger.Printf("%s - %s [%s] \"%s %s %s\" %d %d",
-			strings.Split(req.Request.RemoteAddr, ":")[0],
-			username,
-			time.Now().Format("02/Jan/2006:15:04:05 -0700"),
-			req.Request.Method,
-			req.Request.URL.RequestURI(),
-			req.Request.Proto,
-			resp.StatusCode(),
-			resp.ContentLength(),
-		)
+	}()
+	return rf, nil
+}
+
+func (rf *reopeningFile) reopen() error {
+	f, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	rf.mu.Lock()
+	old := rf.f
+	rf.f = f
+	rf.mu.Unlock()
+	if old != nil {
+		old.Close()
 	}
+	return nil
+}
+
+func (rf *reopeningFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	return rf.f.Write(p)
 }
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// logAccess serves r with an access logger in format in front of h, returning
+// the line logged.
+func logAccess(t *testing.T, format string, h http.Handler, r *http.Request) string {
+	var buf bytes.Buffer
+	logger.SetOutput(&buf)
+	defer logger.SetOutput(os.Stdout)
+	handler, err := AccessLogger(h, format)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+func TestAccessLogFormats(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		setIdentity(r, &identity{Name: "jo"})
+		// Changes to the request further down don't change what is logged.
+		r.URL.Path = "/rewritten"
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("hello"))
+	})
+	newRequest := func() *http.Request {
+		r := httptest.NewRequest("POST", "/api/v1beta3/pods?x=1", nil)
+		r.RemoteAddr = "192.0.2.1:41234"
+		r.Header.Set("Referer", "http://console/")
+		r.Header.Set("User-Agent", "kubectl/v0.18")
+		return r
+	}
+
+	common := regexp.MustCompile(`^192\.0\.2\.1 - jo \[\d\d/\w{3}/\d{4}:\d\d:\d\d:\d\d [-+]\d{4}\] "POST /api/v1beta3/pods\?x=1 HTTP/1\.1" 201 5 \d+$`)
+	if line := logAccess(t, CommonLogFormat, h, newRequest()); !common.MatchString(line) {
+		t.Errorf("common: got %q", line)
+	}
+	combined := regexp.MustCompile(`^192\.0\.2\.1 - jo \[[^]]+\] "POST /api/v1beta3/pods\?x=1 HTTP/1\.1" 201 5 "http://console/" "kubectl/v0\.18" \d+$`)
+	if line := logAccess(t, CombinedLogFormat, h, newRequest()); !combined.MatchString(line) {
+		t.Errorf("combined: got %q", line)
+	}
+
+	var entry accessLogEntry
+	line := logAccess(t, JSONLogFormat, h, newRequest())
+	if err := json.Unmarshal([]byte(line), &entry); err != nil {
+		t.Fatalf("json: %v in %q", err, line)
+	}
+	if _, err := time.Parse(time.RFC3339, entry.Time); err != nil {
+		t.Errorf("json: bad time %q", entry.Time)
+	}
+	entry.Time, entry.Latency = "", 0
+	want := accessLogEntry{Host: "192.0.2.1", User: "jo", Method: "POST", URI: "/api/v1beta3/pods?x=1", Proto: "HTTP/1.1",
+		Status: http.StatusCreated, Size: 5, Referer: "http://console/", UserAgent: "kubectl/v0.18"}
+	if entry != want {
+		t.Errorf("json: got %+v, want %+v", entry, want)
+	}
+
+	if _, err := AccessLogger(h, "apache"); err == nil {
+		t.Errorf("accepted an unknown format")
+	}
+}
+
+func TestAccessLogUnauthenticatedUser(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	// Basic credentials are only checked by the master, so the name in them
+	// could be anyone's.
+	r := httptest.NewRequest("GET", "/api/v1beta3/pods", nil)
+	r.SetBasicAuth("admin", "wrong")
+	if line := logAccess(t, CommonLogFormat, h, r); !strings.Contains(line, " - - [") {
+		t.Errorf("logged a user claimed by the client: %q", line)
+	}
+}
+
+func TestReopeningFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "accesslog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.log")
+	rf, err := newReopeningFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rf.Write([]byte("before\n"))
+	reopened := func() bool {
+		rf.mu.Lock()
+		defer rf.mu.Unlock()
+		fi, err := rf.f.Stat()
+		return err == nil && fi.Size() == 0
+	}
+
+	// Rotate the log, as logrotate would, & signal the proxy.
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	syscall.Kill(os.Getpid(), syscall.SIGHUP)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if reopened() {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("log not reopened after SIGHUP")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	rf.Write([]byte("after\n"))
+
+	if data, _ := ioutil.ReadFile(path + ".1"); string(data) != "before\n" {
+		t.Errorf("rotated log has %q", data)
+	}
+	if data, _ := ioutil.ReadFile(path); string(data) != "after\n" {
+		t.Errorf("new log has %q", data)
+	}
+}
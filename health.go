@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// checkResult is the outcome of a single readiness check.
+type checkResult struct {
+	Ok        bool      `json:"ok"`
+	Message   string    `json:"message,omitempty"`
+	CheckedAt time.Time `json:"checkedAt"`
+}
+
+// readiness tracks whether the proxy is able to serve traffic. Checks are
+// either run on every request (cheap ones such as file existence) or run
+// periodically in the background with the last result reported.
+type readiness struct {
+	mu      sync.RWMutex
+	results map[string]checkResult
+	checks  map[string]func() error
+}
+
+func newReadiness() *readiness {
+	return &readiness{
+		results: map[string]checkResult{},
+		checks:  map[string]func() error{},
+	}
+}
+
+// addCheck registers a check that is run every time readiness is requested.
+func (r *readiness) addCheck(name string, check func() error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.checks[name] = check
+}
+
+// addPeriodicCheck registers a check that is run every interval, starting now.
+func (r *readiness) addPeriodicCheck(name string, interval time.Duration, check func() error) {
+	r.set(name, check())
+	go func() {
+		for range time.Tick(interval) {
+			r.set(name, check())
+		}
+	}()
+}
+
+func (r *readiness) set(name string, err error) {
+	result := checkResult{Ok: err == nil, CheckedAt: time.Now()}
+	if err != nil {
+		result.Message = err.Error()
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if prev, ok := r.results[name]; ok && prev.Ok != result.Ok {
+		if result.Ok {
+			log.Printf("Readiness check %s passing again", name)
+		} else {
+			log.Printf("Readiness check %s failing: %v", name, err)
+		}
+	}
+	r.results[name] = result
+}
+
+// status runs the per-request checks and returns all results along with
+// whether every one of them passed.
+func (r *readiness) status() (map[string]checkResult, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	results := make(map[string]checkResult, len(r.results)+len(r.checks))
+	ok := true
+	for name, result := range r.results {
+		results[name] = result
+		ok = ok && result.Ok
+	}
+	for name, check := range r.checks {
+		result := checkResult{Ok: true, CheckedAt: time.Now()}
+		if err := check(); err != nil {
+			result.Ok, result.Message = false, err.Error()
+		}
+		results[name] = result
+		ok = ok && result.Ok
+	}
+	return results, ok
+}
+
+func (r *readiness) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	results, ok := r.status()
+	body, _ := json.MarshalIndent(&struct {
+		Ready  bool                   `json:"ready"`
+		Checks map[string]checkResult `json:"checks"`
+	}{ok, results}, "", "  ")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(body)
+}
+
+// healthz reports that the process is up and serving requests.
+func healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	fmt.Fprint(w, "ok")
+}
+
+// fileExistsCheck returns a check that passes if path exists, and is a
+// directory if dir is true.
+func fileExistsCheck(path string, dir bool) func() error {
+	return func() error {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		if dir && !fi.IsDir() {
+			return fmt.Errorf("%s is not a directory", path)
+		}
+		return nil
+	}
+}
+
+// error404PageCheck returns a check that passes if the --404 page can be
+// found in the static directory.
+func error404PageCheck(staticDir, page string) func() error {
+	return fileExistsCheck(filepath.Join(staticDir, filepath.FromSlash(page)), false)
+}
+
+// waitForMaster retries the master version probe up to retries times with
+// exponential backoff, starting at backoff and capped at maxBackoff.
+func waitForMaster(probe func() (string, error), retries int, backoff, maxBackoff time.Duration) (string, error) {
+	for attempt := 0; ; attempt++ {
+		serverVersion, err := probe()
+		if err == nil {
+			return serverVersion, nil
+		}
+		if attempt >= retries {
+			return "", err
+		}
+		log.Printf("Couldn't retrieve Kubernetes server version, retrying in %v: %v", backoff, err)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// readyz returns the code & body /readyz serves for r.
+func readyz(t *testing.T, r *readiness) (int, map[string]checkResult) {
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/readyz", nil))
+	var body struct {
+		Ready  bool
+		Checks map[string]checkResult
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("%v in %q", err, w.Body)
+	}
+	if body.Ready != (w.Code == http.StatusOK) {
+		t.Errorf("ready %v with status %d", body.Ready, w.Code)
+	}
+	return w.Code, body.Checks
+}
+
+func TestReadiness(t *testing.T) {
+	dir, err := ioutil.TempDir("", "health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "404.html"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	var masterDown int32
+	r := newReadiness()
+	r.addCheck("static", fileExistsCheck(dir, true))
+	r.addCheck("404", error404PageCheck(dir, "/404.html"))
+	r.addPeriodicCheck("master", 10*time.Millisecond, func() error {
+		if atomic.LoadInt32(&masterDown) == 1 {
+			return errors.New("connection refused")
+		}
+		return nil
+	})
+
+	if code, checks := readyz(t, r); code != http.StatusOK || len(checks) != 3 {
+		t.Fatalf("got %d with checks %+v", code, checks)
+	}
+
+	// Per-request checks fail as soon as what they check is gone.
+	os.Remove(filepath.Join(dir, "404.html"))
+	code, checks := readyz(t, r)
+	if code != http.StatusServiceUnavailable || checks["404"].Ok || len(checks["404"].Message) == 0 || !checks["static"].Ok {
+		t.Errorf("without the 404 page: got %d with checks %+v", code, checks)
+	}
+	ioutil.WriteFile(filepath.Join(dir, "404.html"), nil, 0644)
+
+	// Periodic checks fail once next run.
+	atomic.StoreInt32(&masterDown, 1)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		code, checks := readyz(t, r)
+		if code == http.StatusServiceUnavailable {
+			if checks["master"].Ok || checks["master"].Message != "connection refused" {
+				t.Errorf("got master check %+v", checks["master"])
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("still ready with the master down")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := fileExistsCheck(filepath.Join(dir, "404.html"), true)(); err == nil {
+		t.Errorf("a file passed as a directory")
+	}
+}
+
+func TestHealthz(t *testing.T) {
+	w := httptest.NewRecorder()
+	healthz(w, httptest.NewRequest("GET", "/healthz", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "ok" || w.Header().Get("Cache-Control") != "no-cache" {
+		t.Errorf("got %d %q with headers %v", w.Code, w.Body, w.Header())
+	}
+}
+
+func TestWaitForMaster(t *testing.T) {
+	var probes []time.Time
+	failures := 4
+	probe := func() (string, error) {
+		probes = append(probes, time.Now())
+		if len(probes) <= failures {
+			return "", errors.New("connection refused")
+		}
+		return "v0.18.0", nil
+	}
+
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	version, err := waitForMaster(probe, 5, 10*time.Millisecond, 20*time.Millisecond)
+	log.SetOutput(os.Stderr)
+	if err != nil || version != "v0.18.0" {
+		t.Fatalf("got %q, %v", version, err)
+	}
+	// Waiting 10ms, then 20ms & no more each time.
+	for i, min := range []time.Duration{10, 20, 20, 20} {
+		if wait := probes[i+1].Sub(probes[i]); wait < min*time.Millisecond {
+			t.Errorf("waited %v before probe %d, want at least %vms", wait, i+2, min)
+		}
+	}
+	var waits []string
+	for _, m := range regexp.MustCompile(`retrying in (\w+)`).FindAllStringSubmatch(logged.String(), -1) {
+		waits = append(waits, m[1])
+	}
+	if fmt.Sprint(waits) != "[10ms 20ms 20ms 20ms]" {
+		t.Errorf("logged waits %v, want 10ms then 20ms", waits)
+	}
+
+	// Giving up after the retries, with the last error.
+	probes, failures = nil, 10
+	if _, err := waitForMaster(probe, 2, time.Millisecond, time.Millisecond); err == nil || len(probes) != 3 {
+		t.Errorf("got %v after %d probes, want an error after 3", err, len(probes))
+	}
+	probes = nil
+	if _, err := waitForMaster(probe, 0, time.Hour, time.Hour); err == nil || len(probes) != 1 {
+		t.Errorf("got %v after %d probes, want an error without retrying", err, len(probes))
+	}
+}
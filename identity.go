@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// identity is a user authenticated by the proxy itself, as opposed to one
+// whose credentials are simply passed through to the master.
+type identity struct {
+	Name   string
+	Groups []string
+	// Extra holds any further attributes of the user, passed to the master
+	// as Impersonate-Extra-<key> headers when impersonating.
+	Extra map[string][]string
+}
+
+// identityHolder is stored in the request context by the outermost handler so
+// that an identity established further down the chain is visible to handlers
+// that wrap it, such as the access log.
+type identityHolder struct {
+	mu sync.Mutex
+	id *identity
+}
+
+type identityHolderKey struct{}
+
+func withIdentityHolder(r *http.Request) *http.Request {
+	if _, ok := r.Context().Value(identityHolderKey{}).(*identityHolder); ok {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), identityHolderKey{}, &identityHolder{}))
+}
+
+// setIdentity records id as the authenticated user making request r.
+func setIdentity(r *http.Request, id *identity) *http.Request {
+	r = withIdentityHolder(r)
+	holder := r.Context().Value(identityHolderKey{}).(*identityHolder)
+	holder.mu.Lock()
+	holder.id = id
+	holder.mu.Unlock()
+	return r
+}
+
+// contextWithIdentity returns a copy of ctx carrying id, for requests made on
+// behalf of a user other than as part of handling one of theirs.
+func contextWithIdentity(ctx context.Context, id *identity) context.Context {
+	return context.WithValue(ctx, identityHolderKey{}, &identityHolder{id: id})
+}
+
+// identityFrom returns the authenticated user making request r, or nil.
+func identityFrom(r *http.Request) *identity {
+	holder, ok := r.Context().Value(identityHolderKey{}).(*identityHolder)
+	if !ok {
+		return nil
+	}
+	holder.mu.Lock()
+	defer holder.mu.Unlock()
+	return holder.id
+}
+
+// Impersonation headers understood by the Kubernetes master.
+const (
+	impersonateUserHeader        = "Impersonate-User"
+	impersonateGroupHeader       = "Impersonate-Group"
+	impersonateExtraHeaderPrefix = "Impersonate-Extra-"
+)
+
+// impersonatingTransport asks the master to act as the authenticated user of
+// each request, using the proxy's own credentials plus impersonation headers.
+// Impersonation headers supplied by clients are always removed so they can't
+// be used to escalate privileges, as are the client's own credentials, which
+// the master could otherwise authenticate in place of the impersonated user.
+//
+// This is the upstream mode used by both the Kubernetes API proxy & the
+// OpenShift API proxy when impersonating; requests that reach it without an
+// identity have already been rejected by requireIdentity.
+type impersonatingTransport struct {
+	rt http.RoundTripper
+}
+
+func newImpersonatingTransport(rt http.RoundTripper) http.RoundTripper {
+	return &impersonatingTransport{rt}
+}
+
+func (t *impersonatingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	r2 := new(http.Request)
+	*r2 = *req
+	r2.Header = make(http.Header, len(req.Header))
+	for k, v := range req.Header {
+		if strings.HasPrefix(http.CanonicalHeaderKey(k), "Impersonate-") {
+			continue
+		}
+		r2.Header[k] = v
+	}
+	r2.Header.Del("Authorization")
+	r2.Header.Del("Cookie")
+	if id := identityFrom(req); id != nil {
+		r2.Header.Set(impersonateUserHeader, id.Name)
+		for _, group := range id.Groups {
+			r2.Header.Add(impersonateGroupHeader, group)
+		}
+		for key, values := range id.Extra {
+			for _, value := range values {
+				r2.Header.Add(impersonateExtraHeaderPrefix+escapeExtraKey(key), value)
+			}
+		}
+	}
+	return t.rt.RoundTrip(r2)
+}
+
+// escapeExtraKey percent-encodes the characters of key that can't appear in a
+// header name, as the master expects of Impersonate-Extra-<key> headers.
+func escapeExtraKey(key string) string {
+	var b strings.Builder
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		if c != '%' && isTokenChar(c) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func isTokenChar(c byte) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
+	}
+	return c < 0x80 && strings.IndexByte("!#$&'*+-.^_`|~", c) >= 0
+}
+
+// requireIdentity rejects requests the proxy hasn't authenticated, which
+// would otherwise be made to the master with the proxy's own credentials when
+// impersonating.
+func requireIdentity(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if identityFrom(r) == nil {
+			http.Error(w, "401 unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// roundTripperFunc is an http.RoundTripper that calls itself.
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestImpersonatingTransport(t *testing.T) {
+	var sent http.Header
+	rt := newImpersonatingTransport(roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		sent = req.Header
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: req}, nil
+	}))
+
+	r := httptest.NewRequest("GET", "https://master/api/v1beta3/pods", nil)
+	r.Header.Set("Authorization", "Bearer users-token")
+	r.Header.Set("Cookie", "session=users-session")
+	r.Header.Set("Impersonate-User", "admin")
+	r.Header.Add("Impersonate-Group", "system:masters")
+	r.Header.Set("impersonate-extra-scopes", "all")
+	r.Header.Set("Accept", "application/json")
+	r = setIdentity(r, &identity{Name: "jo", Groups: []string{"dev", "ops"}, Extra: map[string][]string{"acme.com/team": {"web"}}})
+	if _, err := rt.RoundTrip(r); err != nil {
+		t.Fatal(err)
+	}
+
+	want := http.Header{
+		"Accept":                            {"application/json"},
+		"Impersonate-User":                  {"jo"},
+		"Impersonate-Group":                 {"dev", "ops"},
+		"Impersonate-Extra-Acme.com%2fteam": {"web"},
+	}
+	if !reflect.DeepEqual(sent, want) {
+		t.Errorf("sent headers %v, want %v", sent, want)
+	}
+	// The client's request is left alone.
+	if r.Header.Get("Authorization") != "Bearer users-token" || r.Header.Get("Impersonate-User") != "admin" {
+		t.Errorf("client request modified: %v", r.Header)
+	}
+}
+
+func TestRequireIdentity(t *testing.T) {
+	h := requireIdentity(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1beta3/pods", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("without an identity: got %d, want 401", w.Code)
+	}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, setIdentity(httptest.NewRequest("GET", "/api/v1beta3/pods", nil), &identity{Name: "jo"}))
+	if w.Code != http.StatusOK {
+		t.Errorf("with an identity: got %d, want 200", w.Code)
+	}
+}
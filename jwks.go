@@ -0,0 +1,421 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How often the issuer's signing keys are fetched again, unless it says
+// otherwise with Cache-Control, and how often at most when a token is signed
+// with a key that isn't known, as happens when the issuer rotates its keys.
+const (
+	jwksRefreshInterval = time.Hour
+	jwksMinRefresh      = 10 * time.Second
+)
+
+// idTokenLeeway allows for clocks being a little out between the proxy and
+// the issuer.
+const idTokenLeeway = time.Minute
+
+// oidcProvider is an OpenID Connect issuer, found through its discovery
+// document, whose signing keys are cached to verify ID tokens.
+type oidcProvider struct {
+	issuer string
+	client *http.Client
+
+	mu          sync.Mutex
+	metadata    *oidcMetadata
+	keys        []jsonWebKey
+	keysFetched time.Time
+	keysExpire  time.Time
+}
+
+// oidcMetadata is the part of an issuer's discovery document the proxy uses.
+type oidcMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// jsonWebKey is a public key of the issuer.
+type jsonWebKey struct {
+	ID        string
+	Algorithm string
+	Key       crypto.PublicKey
+}
+
+func newOIDCProvider(issuer string, client *http.Client) *oidcProvider {
+	return &oidcProvider{issuer: strings.TrimSuffix(issuer, "/"), client: client}
+}
+
+// discover returns the issuer's metadata, fetching it the first time.
+func (p *oidcProvider) discover(ctx context.Context) (*oidcMetadata, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.discoverLocked(ctx)
+}
+
+func (p *oidcProvider) discoverLocked(ctx context.Context) (*oidcMetadata, error) {
+	if p.metadata != nil {
+		return p.metadata, nil
+	}
+	var metadata oidcMetadata
+	if _, err := p.getJSON(ctx, p.issuer+"/.well-known/openid-configuration", &metadata); err != nil {
+		return nil, err
+	}
+	if strings.TrimSuffix(metadata.Issuer, "/") != p.issuer {
+		return nil, fmt.Errorf("issuer %s says it is %s", p.issuer, metadata.Issuer)
+	}
+	if len(metadata.AuthorizationEndpoint) == 0 || len(metadata.TokenEndpoint) == 0 || len(metadata.JWKSURI) == 0 {
+		return nil, fmt.Errorf("issuer %s is missing an authorization, token or JWKS endpoint", p.issuer)
+	}
+	p.metadata = &metadata
+	return p.metadata, nil
+}
+
+// check discovers the issuer & fetches its keys if they are due to be, for
+// the readiness check.
+func (p *oidcProvider) check() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, err := p.discoverLocked(ctx); err != nil {
+		return err
+	}
+	if time.Now().Before(p.keysExpire) {
+		return nil
+	}
+	return p.fetchKeysLocked(ctx)
+}
+
+// verificationKeys returns the keys a token signed with alg by the key kid
+// may have been signed with, fetching the issuer's keys again if they have
+// expired or none match.
+func (p *oidcProvider) verificationKeys(ctx context.Context, kid, alg string) ([]crypto.PublicKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	keys := p.matchingKeys(kid, alg)
+	if len(keys) > 0 && time.Now().Before(p.keysExpire) {
+		return keys, nil
+	}
+	if len(keys) == 0 && time.Since(p.keysFetched) < jwksMinRefresh {
+		return nil, fmt.Errorf("no key %q for %s from %s", kid, alg, p.issuer)
+	}
+	if err := p.fetchKeysLocked(ctx); err != nil {
+		if len(keys) > 0 {
+			// Better the keys we have than none at all.
+			return keys, nil
+		}
+		return nil, err
+	}
+	if keys = p.matchingKeys(kid, alg); len(keys) == 0 {
+		return nil, fmt.Errorf("no key %q for %s from %s", kid, alg, p.issuer)
+	}
+	return keys, nil
+}
+
+func (p *oidcProvider) matchingKeys(kid, alg string) []crypto.PublicKey {
+	var keys []crypto.PublicKey
+	for _, key := range p.keys {
+		if (len(kid) == 0 || key.ID == kid) && (len(key.Algorithm) == 0 || key.Algorithm == alg) {
+			keys = append(keys, key.Key)
+		}
+	}
+	return keys
+}
+
+func (p *oidcProvider) fetchKeysLocked(ctx context.Context) error {
+	metadata, err := p.discoverLocked(ctx)
+	if err != nil {
+		return err
+	}
+	p.keysFetched = time.Now()
+	var set struct {
+		Keys []json.RawMessage `json:"keys"`
+	}
+	header, err := p.getJSON(ctx, metadata.JWKSURI, &set)
+	if err != nil {
+		return err
+	}
+	var keys []jsonWebKey
+	for _, raw := range set.Keys {
+		key, err := parseJSONWebKey(raw)
+		if err != nil {
+			// Keys of types the proxy doesn't know are of no use to it anyway.
+			continue
+		}
+		keys = append(keys, *key)
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("no usable keys at %s", metadata.JWKSURI)
+	}
+	p.keys = keys
+	p.keysExpire = p.keysFetched.Add(maxAge(header, jwksRefreshInterval))
+	return nil
+}
+
+func (p *oidcProvider) getJSON(ctx context.Context, url string, v interface{}) (http.Header, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s from %s", resp.Status, url)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return nil, fmt.Errorf("bad response from %s: %v", url, err)
+	}
+	return resp.Header, nil
+}
+
+// maxAge returns the max-age of a response with header, or def if it hasn't
+// got one.
+func maxAge(header http.Header, def time.Duration) time.Duration {
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		directive = strings.TrimSpace(directive)
+		if strings.HasPrefix(directive, "max-age=") {
+			var seconds int64
+			if _, err := fmt.Sscanf(directive[len("max-age="):], "%d", &seconds); err == nil && seconds > 0 {
+				return time.Duration(seconds) * time.Second
+			}
+		}
+	}
+	return def
+}
+
+func parseJSONWebKey(raw json.RawMessage) (*jsonWebKey, error) {
+	var jwk struct {
+		Type      string `json:"kty"`
+		ID        string `json:"kid"`
+		Use       string `json:"use"`
+		Algorithm string `json:"alg"`
+		N         string `json:"n"`
+		E         string `json:"e"`
+		Curve     string `json:"crv"`
+		X         string `json:"x"`
+		Y         string `json:"y"`
+	}
+	if err := json.Unmarshal(raw, &jwk); err != nil {
+		return nil, err
+	}
+	if len(jwk.Use) > 0 && jwk.Use != "sig" {
+		return nil, fmt.Errorf("key %q is for %s", jwk.ID, jwk.Use)
+	}
+	key := &jsonWebKey{ID: jwk.ID, Algorithm: jwk.Algorithm}
+	switch jwk.Type {
+	case "RSA":
+		n, err := base64BigInt(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64BigInt(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		key.Key = &rsa.PublicKey{N: n, E: int(e.Int64())}
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Curve {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", jwk.Curve)
+		}
+		x, err := base64BigInt(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64BigInt(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("key %q is not on %s", jwk.ID, jwk.Curve)
+		}
+		key.Key = &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", jwk.Type)
+	}
+	return key, nil
+}
+
+func base64BigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// signatureHashes are the hashes used by the JWS algorithms the proxy can
+// verify.
+var signatureHashes = map[string]crypto.Hash{
+	"RS256": crypto.SHA256,
+	"RS384": crypto.SHA384,
+	"RS512": crypto.SHA512,
+	"ES256": crypto.SHA256,
+	"ES384": crypto.SHA384,
+	"ES512": crypto.SHA512,
+}
+
+// idToken is a verified OpenID Connect ID token.
+type idToken struct {
+	Raw    string
+	Expiry time.Time
+	Nonce  string
+	claims map[string]json.RawMessage
+}
+
+// claim unmarshals the claim called name into v, returning false if there is
+// no such claim or it is of the wrong type.
+func (t *idToken) claim(name string, v interface{}) bool {
+	raw, ok := t.claims[name]
+	return ok && json.Unmarshal(raw, v) == nil
+}
+
+// stringsClaim returns the claim called name as a list, whether it is a
+// list or a single string.
+func (t *idToken) stringsClaim(name string) []string {
+	var list []string
+	if t.claim(name, &list) {
+		return list
+	}
+	var s string
+	if t.claim(name, &s) && len(s) > 0 {
+		return []string{s}
+	}
+	return nil
+}
+
+// verify checks raw is an ID token issued to clientID, signed by one of the
+// issuer's keys & still valid.
+func (p *oidcProvider) verify(ctx context.Context, raw, clientID string) (*idToken, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("not a JWT")
+	}
+	var header struct {
+		Algorithm string `json:"alg"`
+		KeyID     string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+	hash, ok := signatureHashes[header.Algorithm]
+	if !ok {
+		return nil, fmt.Errorf("unsupported signing algorithm %q", header.Algorithm)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+	keys, err := p.verificationKeys(ctx, header.KeyID, header.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	h := hash.New()
+	h.Write([]byte(parts[0] + "." + parts[1]))
+	digest := h.Sum(nil)
+	verified := false
+	for _, key := range keys {
+		if verifySignature(key, header.Algorithm, hash, digest, signature) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, errors.New("bad signature")
+	}
+
+	token := &idToken{Raw: raw}
+	if err := decodeJWTPart(parts[1], &token.claims); err != nil {
+		return nil, err
+	}
+	var issuer string
+	if !token.claim("iss", &issuer) || strings.TrimSuffix(issuer, "/") != p.issuer {
+		return nil, fmt.Errorf("issued by %q, not %s", issuer, p.issuer)
+	}
+	audience := token.stringsClaim("aud")
+	if !containsString(audience, clientID) {
+		return nil, fmt.Errorf("issued to %v, not %s", audience, clientID)
+	}
+	var authorizedParty string
+	if token.claim("azp", &authorizedParty) && authorizedParty != clientID {
+		return nil, fmt.Errorf("issued for %s, not %s", authorizedParty, clientID)
+	}
+	now := time.Now()
+	var expiry, notBefore float64
+	if !token.claim("exp", &expiry) {
+		return nil, errors.New("no expiry")
+	}
+	if token.Expiry = time.Unix(int64(expiry), 0); now.After(token.Expiry.Add(idTokenLeeway)) {
+		return nil, fmt.Errorf("expired at %s", token.Expiry)
+	}
+	if token.claim("nbf", &notBefore) && now.Add(idTokenLeeway).Before(time.Unix(int64(notBefore), 0)) {
+		return nil, errors.New("not valid yet")
+	}
+	token.claim("nonce", &token.Nonce)
+	return token, nil
+}
+
+func verifySignature(key crypto.PublicKey, alg string, hash crypto.Hash, digest, signature []byte) bool {
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		return strings.HasPrefix(alg, "RS") && rsa.VerifyPKCS1v15(key, hash, digest, signature) == nil
+	case *ecdsa.PublicKey:
+		if !strings.HasPrefix(alg, "ES") {
+			return false
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		return ecdsa.Verify(key, digest, r, s)
+	}
+	return false
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	k8sclient "github.com/GoogleCloudPlatform/kubernetes/pkg/client"
+	clientcmdapi "github.com/GoogleCloudPlatform/kubernetes/pkg/client/clientcmd/api"
+	clientcmdlatest "github.com/GoogleCloudPlatform/kubernetes/pkg/client/clientcmd/api/latest"
+)
+
+// errNoMaster is returned by kubernetesClientConfig if no master is configured.
+var errNoMaster = errors.New("no Kubernetes master specified")
+
+// Where Kubernetes mounts the service account token & CA into pods.
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// kubernetesClientConfig builds the config used to connect to the Kubernetes
+// master from, in increasing order of precedence: the in-cluster service
+// account, a kubeconfig file and the --kubernetes-* flags. In-cluster, the
+// service account token is used as the default --token-file.
+func kubernetesClientConfig(options *Options) (*k8sclient.Config, error) {
+	config := &k8sclient.Config{}
+
+	if len(options.Kubeconfig) > 0 {
+		kubeconfig, err := loadKubeconfig(options.Kubeconfig, options.KubeconfigContext)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't load kubeconfig %s: %v", options.Kubeconfig, err)
+		}
+		config = kubeconfig
+	} else if len(options.KubernetesMaster) == 0 && len(os.Getenv("KUBERNETES_SERVICE_HOST")) > 0 {
+		config.Host = os.ExpandEnv("https://${KUBERNETES_SERVICE_HOST}:${KUBERNETES_SERVICE_PORT}")
+		// The token is rotated, so it is read via --token-file rather than once.
+		if tokenFile := filepath.Join(serviceAccountDir, "token"); len(options.TokenFile) == 0 && fileExists(tokenFile) {
+			options.TokenFile = tokenFile
+		}
+		if caFile := filepath.Join(serviceAccountDir, "ca.crt"); fileExists(caFile) {
+			config.CAFile = caFile
+		}
+	}
+
+	if masters := splitMasters(options.KubernetesMaster); len(masters) > 0 {
+		// Further masters are found by kubernetesMasters.
+		config.Host = masters[0]
+	}
+	if len(config.Version) == 0 {
+		config.Version = options.KubernetesApiVersion
+	}
+	if len(options.KubernetesCACertFile) > 0 {
+		config.CAFile = options.KubernetesCACertFile
+	}
+	if options.Insecure {
+		config.Insecure = true
+		config.CAFile = ""
+	}
+	if len(config.Host) == 0 {
+		return nil, errNoMaster
+	}
+	return config, nil
+}
+
+// kubernetesMasters returns the URLs of the masters of the cluster configured
+// by config: those given by --kubernetes-master, if any, or else its host.
+func kubernetesMasters(options *Options, config *k8sclient.Config) []string {
+	if masters := splitMasters(options.KubernetesMaster); len(masters) > 0 {
+		return masters
+	}
+	return []string{config.Host}
+}
+
+// loadKubeconfig returns the client config for the named context in the
+// kubeconfig file at path, or for its current context if contextName is empty.
+func loadKubeconfig(path, contextName string) (*k8sclient.Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	kubeconfig := clientcmdapi.NewConfig()
+	if err := clientcmdlatest.Codec.DecodeInto(data, kubeconfig); err != nil {
+		return nil, err
+	}
+
+	if len(contextName) == 0 {
+		contextName = kubeconfig.CurrentContext
+	}
+	if len(contextName) == 0 {
+		return nil, fmt.Errorf("no context specified and no current-context set")
+	}
+	context, ok := kubeconfig.Contexts[contextName]
+	if !ok {
+		return nil, fmt.Errorf("context %q not found", contextName)
+	}
+	cluster, ok := kubeconfig.Clusters[context.Cluster]
+	if !ok {
+		return nil, fmt.Errorf("cluster %q for context %q not found", context.Cluster, contextName)
+	}
+	// Relative paths are relative to the kubeconfig file itself.
+	dir := filepath.Dir(path)
+	config := &k8sclient.Config{
+		Host:     cluster.Server,
+		Version:  cluster.APIVersion,
+		Insecure: cluster.InsecureSkipTLSVerify,
+		TLSClientConfig: k8sclient.TLSClientConfig{
+			CAFile: resolvePath(dir, cluster.CertificateAuthority),
+		},
+	}
+
+	if len(context.AuthInfo) > 0 {
+		authInfo, ok := kubeconfig.AuthInfos[context.AuthInfo]
+		if !ok {
+			return nil, fmt.Errorf("user %q for context %q not found", context.AuthInfo, contextName)
+		}
+		// An auth-path takes the place of the user's other fields, as the
+		// kubeconfig format documents.
+		if len(authInfo.AuthPath) > 0 {
+			if err := loadAuthFile(resolvePath(dir, authInfo.AuthPath), config); err != nil {
+				return nil, err
+			}
+			return config, nil
+		}
+		if len(authInfo.ClientCertificate) > 0 {
+			config.CertFile = resolvePath(dir, authInfo.ClientCertificate)
+			config.KeyFile = resolvePath(dir, authInfo.ClientKey)
+		}
+		if len(authInfo.Token) > 0 {
+			config.BearerToken = authInfo.Token
+		}
+	}
+	return config, nil
+}
+
+// authFile is the format of the legacy ~/.kubernetes_auth file that a
+// kubeconfig user can refer to with auth-path.
+type authFile struct {
+	User        string
+	Password    string
+	CAFile      string
+	CertFile    string
+	KeyFile     string
+	BearerToken string
+	Insecure    *bool
+}
+
+func loadAuthFile(path string, config *k8sclient.Config) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var auth authFile
+	if err := json.Unmarshal(data, &auth); err != nil {
+		return fmt.Errorf("couldn't parse auth file %s: %v", path, err)
+	}
+	config.Username = auth.User
+	config.Password = auth.Password
+	config.BearerToken = auth.BearerToken
+	config.CertFile = auth.CertFile
+	config.KeyFile = auth.KeyFile
+	if len(config.CAFile) == 0 {
+		config.CAFile = auth.CAFile
+	}
+	if auth.Insecure != nil {
+		config.Insecure = *auth.Insecure
+	}
+	return nil
+}
+
+func resolvePath(dir, path string) string {
+	if len(path) == 0 || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testKubeconfig = `apiVersion: v1
+kind: Config
+current-context: token
+clusters:
+- name: prod
+  cluster:
+    server: https://master.example.com:8443
+    api-version: v1beta3
+    certificate-authority: ca.crt
+contexts:
+- name: token
+  context: {cluster: prod, user: token}
+- name: cert
+  context: {cluster: prod, user: cert}
+- name: auth-path
+  context: {cluster: prod, user: auth-path}
+- name: missing-user
+  context: {cluster: prod, user: nobody}
+users:
+- name: token
+  user: {token: t0ken}
+- name: cert
+  user: {client-certificate: certs/client.crt, client-key: /etc/client.key}
+- name: auth-path
+  user: {auth-path: auth.json, token: ignored, client-certificate: ignored.crt, client-key: ignored.key}
+`
+
+func TestLoadKubeconfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kubeconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config")
+	if err := ioutil.WriteFile(path, []byte(testKubeconfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+	auth := `{"User": "admin", "Password": "secret", "CertFile": "/auth/client.crt", "KeyFile": "/auth/client.key"}`
+	if err := ioutil.WriteFile(filepath.Join(dir, "auth.json"), []byte(auth), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := loadKubeconfig(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Host != "https://master.example.com:8443" || config.Version != "v1beta3" ||
+		config.CAFile != filepath.Join(dir, "ca.crt") || config.BearerToken != "t0ken" {
+		t.Errorf("current context: got %+v", config)
+	}
+
+	config, err = loadKubeconfig(path, "cert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.CertFile != filepath.Join(dir, "certs/client.crt") || config.KeyFile != "/etc/client.key" || len(config.BearerToken) > 0 {
+		t.Errorf("cert context: got %+v", config)
+	}
+
+	config, err = loadKubeconfig(path, "auth-path")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Username != "admin" || config.Password != "secret" || len(config.BearerToken) > 0 ||
+		config.CertFile != "/auth/client.crt" || config.KeyFile != "/auth/client.key" {
+		t.Errorf("auth-path context: got %+v, want only the auth file's credentials", config)
+	}
+
+	for _, context := range []string{"missing-user", "missing"} {
+		if _, err := loadKubeconfig(path, context); err == nil {
+			t.Errorf("%s context: expected an error", context)
+		}
+	}
+}
@@ -1,21 +1,20 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"mime"
+	"net"
 	"net/http"
-	"net/http/httputil"
-	"net/url"
 	"os"
 	"strings"
 	"text/template"
+	"time"
 
-	k8sclient "github.com/GoogleCloudPlatform/kubernetes/pkg/client"
-	"github.com/GoogleCloudPlatform/kubernetes/pkg/kubectl"
 	"github.com/bradfitz/http2"
 	flags "github.com/jessevdk/go-flags"
 )
@@ -25,62 +24,337 @@ var logger *log.Logger = log.New(os.Stdout, "", 0)
 const prefix = "/api"
 
 type Options struct {
-	Port                       uint16 `short:"p" long:"port" description:"The port to listen on" default:"9090"`
-	KubernetesMaster           string `short:"k" long:"kubernetes-master" description:"The URL to the Kubernetes master"`
-	KubernetesApiVersion       string `short:"v" long:"kubernetes-api-version" description:"The version of the Kubernetes API to use" default:"v1beta2"`
-	KubernetesCACertFile       string `long:"kubernetes-ca-cert" description:"Kubernetes CA cert file"`
-	Insecure                   bool   `long:"insecure" description:"Trust all server certificates" default:"false"`
-	OpenShiftOAuthClientId     string `short:"o" long:"oauth-client" description:"Kubernetes OAuth client ID to use" default:"fabric8-console"`
-	OpenShiftOAuthAuthorizeUri string `short:"u" long:"oauth-authorize-uri" description:"Kubernetes OAuth authorize URI" default:"https://localhost:8443/oauth/authorize"`
-	StaticDir                  string `short:"w" long:"www" description:"Optional directory to serve static files from" default:"."`
-	StaticPrefix               string `long:"www-prefix" description:"Prefix to serve static files on" default:"/"`
-	ApiPrefix                  string `long:"api-prefix" description:"Prefix to serve Kubernetes API on" default:"/api/"`
-	OsApiPrefix                string `long:"osapi-prefix" description:"Prefix to serve OpenShift API on (optional)"`
-	Error404                   string `long:"404" description:"Page to send on 404 (useful for e.g. Angular html5mode default page)"`
-	TlsCertFile                string `long:"tls-cert" description:"TLS cert file"`
-	TlsKeyFile                 string `long:"tls-key" description:"TLS key file"`
+	ConfigFile                 string        `long:"config" env:"K8S_PROXY_CONFIG" description:"YAML or JSON file of settings by long option name, which the environment & command line override; policy & rate limits are reloaded on SIGHUP or when it changes"`
+	PrintConfig                bool          `long:"print-config" env:"K8S_PROXY_PRINT_CONFIG" description:"Print the effective configuration as a config file, with secrets masked, and exit" default:"false"`
+	ConfigReloadInterval       time.Duration `long:"config-reload-interval" env:"K8S_PROXY_CONFIG_RELOAD_INTERVAL" description:"How often to check --config & --policy for changes" default:"10s"`
+	Port                       uint16        `short:"p" long:"port" env:"K8S_PROXY_PORT" description:"The port to listen on" default:"9090"`
+	KubernetesMaster           []string      `short:"k" long:"kubernetes-master" env:"K8S_PROXY_KUBERNETES_MASTER" env-delim:"," description:"The URL to the Kubernetes master, may be repeated (or comma-separated) for the masters of an HA cluster"`
+	MasterBalance              string        `long:"master-balance" env:"K8S_PROXY_MASTER_BALANCE" description:"How to spread requests across HA masters: round-robin or least-connections" default:"round-robin"`
+	KubernetesApiVersion       string        `short:"v" long:"kubernetes-api-version" env:"K8S_PROXY_KUBERNETES_API_VERSION" description:"The version of the Kubernetes API to use" default:"v1beta2"`
+	KubernetesCACertFile       string        `long:"kubernetes-ca-cert" env:"K8S_PROXY_KUBERNETES_CA_CERT" description:"Kubernetes CA cert file"`
+	Kubeconfig                 string        `long:"kubeconfig" env:"K8S_PROXY_KUBECONFIG" description:"Kubeconfig file to read Kubernetes master connection settings & credentials from"`
+	KubeconfigContext          string        `long:"context" env:"K8S_PROXY_CONTEXT" description:"Kubeconfig context to use (defaults to the current context)"`
+	TokenFile                  string        `long:"token-file" env:"K8S_PROXY_TOKEN_FILE" description:"File to read the bearer token for the Kubernetes master from, re-read when it changes"`
+	TokenRefreshInterval       time.Duration `long:"token-refresh-interval" env:"K8S_PROXY_TOKEN_REFRESH_INTERVAL" description:"How often to check --token-file for changes" default:"1m"`
+	ClustersFile               string        `long:"clusters" env:"K8S_PROXY_CLUSTERS" description:"YAML or JSON file listing further Kubernetes masters to proxy under /clusters/<name>/"`
+	PolicyFile                 string        `long:"policy" env:"K8S_PROXY_POLICY" description:"YAML or JSON file of rules deciding which API requests are allowed"`
+	ReadOnly                   bool          `long:"read-only" env:"K8S_PROXY_READ_ONLY" description:"Reject API requests that could modify anything (POST, PUT, PATCH & DELETE)" default:"false"`
+	ReadOnlyProxy              string        `long:"read-only-proxy" env:"K8S_PROXY_READ_ONLY_PROXY" description:"In read-only mode, whether pod & service proxy requests are pass-through or get-only" default:"pass-through"`
+	Redact                     bool          `long:"redact" env:"K8S_PROXY_REDACT" description:"Blank the data of Secrets (or the kinds given by --redact-kind) in API responses" default:"false"`
+	RedactKinds                []string      `long:"redact-kind" env:"K8S_PROXY_REDACT_KIND" env-delim:"," description:"Kind of object to redact, may be repeated" default:"Secret"`
+	RedactExemptHeader         string        `long:"redact-exempt-header" env:"K8S_PROXY_REDACT_EXEMPT_HEADER" secret:"true" description:"Header (\"Name: value\") exempting requests that carry it from redaction"`
+	ShareWatches               bool          `long:"share-watches" env:"K8S_PROXY_SHARE_WATCHES" description:"Serve watches of the same resources from a single watch on the Kubernetes master" default:"false"`
+	Cache                      bool          `long:"cache" env:"K8S_PROXY_CACHE" description:"Cache responses to GET requests for API objects & lists until they change" default:"false"`
+	CacheSize                  int           `long:"cache-size" env:"K8S_PROXY_CACHE_SIZE" description:"Maximum size of the response cache in MB" default:"64"`
+	CacheTTL                   time.Duration `long:"cache-ttl" env:"K8S_PROXY_CACHE_TTL" description:"How long to cache responses for resources that can't be watched for changes" default:"10s"`
+	RateLimitRead              float64       `long:"rate-limit-read" env:"K8S_PROXY_RATE_LIMIT_READ" description:"API reads per second allowed per client (0 for no limit)" default:"0"`
+	RateLimitReadBurst         int           `long:"rate-limit-read-burst" env:"K8S_PROXY_RATE_LIMIT_READ_BURST" description:"API reads allowed per client in a burst (defaults to the rate)" default:"0"`
+	RateLimitWrite             float64       `long:"rate-limit-write" env:"K8S_PROXY_RATE_LIMIT_WRITE" description:"API writes per second allowed per client (0 for no limit)" default:"0"`
+	RateLimitWriteBurst        int           `long:"rate-limit-write-burst" env:"K8S_PROXY_RATE_LIMIT_WRITE_BURST" description:"API writes allowed per client in a burst (defaults to the rate)" default:"0"`
+	RateLimitWatch             float64       `long:"rate-limit-watch" env:"K8S_PROXY_RATE_LIMIT_WATCH" description:"API watches per second allowed per client (0 for no limit)" default:"0"`
+	RateLimitWatchBurst        int           `long:"rate-limit-watch-burst" env:"K8S_PROXY_RATE_LIMIT_WATCH_BURST" description:"API watches allowed per client in a burst (defaults to the rate)" default:"0"`
+	RateLimitOsApi             float64       `long:"rate-limit-osapi" env:"K8S_PROXY_RATE_LIMIT_OSAPI" description:"OpenShift API requests per second allowed per client (0 for no limit)" default:"0"`
+	RateLimitOsApiBurst        int           `long:"rate-limit-osapi-burst" env:"K8S_PROXY_RATE_LIMIT_OSAPI_BURST" description:"OpenShift API requests allowed per client in a burst (defaults to the rate)" default:"0"`
+	MaxInFlightPerClient       int           `long:"max-in-flight-per-client" env:"K8S_PROXY_MAX_IN_FLIGHT_PER_CLIENT" description:"API requests, other than watches & streams, each client may have in flight at once (0 for no limit)" default:"0"`
+	RateLimitBy                string        `long:"rate-limit-by" env:"K8S_PROXY_RATE_LIMIT_BY" description:"How to tell clients apart for rate limits: user (the authenticated user, else the address) or ip" default:"user"`
+	UpstreamRetries            int           `long:"upstream-retries" env:"K8S_PROXY_UPSTREAM_RETRIES" description:"How many times to retry GET & HEAD requests to the Kubernetes master after a connection error or 503" default:"2"`
+	UpstreamRetryBackoff       time.Duration `long:"upstream-retry-backoff" env:"K8S_PROXY_UPSTREAM_RETRY_BACKOFF" description:"Delay before retrying a request to the Kubernetes master, doubled (with jitter) after each attempt" default:"200ms"`
+	UpstreamTimeout            time.Duration `long:"upstream-timeout" env:"K8S_PROXY_UPSTREAM_TIMEOUT" description:"How long requests to the Kubernetes master, other than watches & streams, may take (0 for no limit)" default:"0"`
+	CircuitBreakerFailures     int           `long:"circuit-breaker-failures" env:"K8S_PROXY_CIRCUIT_BREAKER_FAILURES" description:"Consecutive failures of the Kubernetes master after which requests fail fast (0 to disable)" default:"5"`
+	CircuitBreakerCooldown     time.Duration `long:"circuit-breaker-cooldown" env:"K8S_PROXY_CIRCUIT_BREAKER_COOLDOWN" description:"How long to fail requests fast before trying the Kubernetes master again" default:"10s"`
+	Insecure                   bool          `long:"insecure" env:"K8S_PROXY_INSECURE" description:"Trust all server certificates" default:"false"`
+	OpenShiftOAuthClientId     string        `short:"o" long:"oauth-client" env:"K8S_PROXY_OAUTH_CLIENT" description:"Kubernetes OAuth client ID to use" default:"fabric8-console"`
+	OpenShiftOAuthAuthorizeUri string        `short:"u" long:"oauth-authorize-uri" env:"K8S_PROXY_OAUTH_AUTHORIZE_URI" description:"Kubernetes OAuth authorize URI" default:"https://localhost:8443/oauth/authorize"`
+	OAuthLogin                 bool          `long:"oauth-login" env:"K8S_PROXY_OAUTH_LOGIN" description:"Log users in with the OAuth server at /oauth/login, keeping their token in a session cookie (implies --passthrough-auth)" default:"false"`
+	OAuthClientSecretFile      string        `long:"oauth-client-secret-file" env:"K8S_PROXY_OAUTH_CLIENT_SECRET_FILE" description:"File to read the OAuth client secret from"`
+	OAuthTokenUri              string        `long:"oauth-token-uri" env:"K8S_PROXY_OAUTH_TOKEN_URI" description:"OAuth token URI (defaults to the authorize URI ending in /token)"`
+	OAuthRedirectUri           string        `long:"oauth-redirect-uri" env:"K8S_PROXY_OAUTH_REDIRECT_URI" description:"OAuth redirect URI registered for the client (defaults to /oauth/callback on the requested host)"`
+	SessionSecretFile          string        `long:"session-secret-file" env:"K8S_PROXY_SESSION_SECRET_FILE" description:"File with a secret of at least 32 bytes to encrypt & sign session cookies with (random if not set)"`
+	SessionCookie              string        `long:"session-cookie" env:"K8S_PROXY_SESSION_COOKIE" description:"Name of the session cookie" default:"k8s_proxy_session"`
+	SessionTimeout             time.Duration `long:"session-timeout" env:"K8S_PROXY_SESSION_TIMEOUT" description:"Maximum length of a login session" default:"24h"`
+	OidcIssuer                 string        `long:"oidc-issuer" env:"K8S_PROXY_OIDC_ISSUER" description:"OpenID Connect issuer URL to log users in with at /oauth/login (enables OIDC authentication)"`
+	OidcCAFile                 string        `long:"oidc-ca" env:"K8S_PROXY_OIDC_CA" description:"CA bundle to verify the OIDC issuer's certificate against (defaults to the system roots)"`
+	OidcClientId               string        `long:"oidc-client-id" env:"K8S_PROXY_OIDC_CLIENT_ID" description:"OIDC client ID"`
+	OidcClientSecretFile       string        `long:"oidc-client-secret-file" env:"K8S_PROXY_OIDC_CLIENT_SECRET_FILE" description:"File to read the OIDC client secret from"`
+	OidcScopes                 []string      `long:"oidc-scope" env:"K8S_PROXY_OIDC_SCOPE" env-delim:"," description:"Scope to request from the OIDC provider, may be repeated" default:"openid" default:"email" default:"profile"`
+	OidcUsernameClaim          string        `long:"oidc-username-claim" env:"K8S_PROXY_OIDC_USERNAME_CLAIM" description:"ID token claim to use as the user name" default:"email"`
+	OidcGroupsClaim            string        `long:"oidc-groups-claim" env:"K8S_PROXY_OIDC_GROUPS_CLAIM" description:"ID token claim to use as the user's groups" default:"groups"`
+	OidcExtraClaims            []string      `long:"oidc-extra-claim" env:"K8S_PROXY_OIDC_EXTRA_CLAIM" env-delim:"," description:"ID token claim to pass to the master as Impersonate-Extra-<claim> when impersonating, may be repeated"`
+	OidcAllowedGroups          []string      `long:"oidc-allowed-group" env:"K8S_PROXY_OIDC_ALLOWED_GROUP" env-delim:"," description:"Group allowed to use the proxy, may be repeated (all if not set)"`
+	OidcAllowedEmails          []string      `long:"oidc-allowed-email" env:"K8S_PROXY_OIDC_ALLOWED_EMAIL" env-delim:"," description:"Email address, or @domain, allowed to use the proxy, may be repeated (all if not set)"`
+	OidcForward                string        `long:"oidc-forward" env:"K8S_PROXY_OIDC_FORWARD" description:"What to send the Kubernetes master: id-token or impersonate" default:"id-token"`
+	StaticDir                  string        `short:"w" long:"www" env:"K8S_PROXY_WWW" description:"Optional directory to serve static files from" default:"."`
+	StaticPrefix               string        `long:"www-prefix" env:"K8S_PROXY_WWW_PREFIX" description:"Prefix to serve static files on" default:"/"`
+	ApiPrefix                  string        `long:"api-prefix" env:"K8S_PROXY_API_PREFIX" description:"Prefix to serve Kubernetes API on" default:"/api/"`
+	OsApiPrefix                string        `long:"osapi-prefix" env:"K8S_PROXY_OSAPI_PREFIX" description:"Prefix to serve OpenShift API on (optional)"`
+	Error404                   string        `long:"404" env:"K8S_PROXY_404" description:"Page to send on 404 (useful for e.g. Angular html5mode default page)"`
+	TlsCertFile                string        `long:"tls-cert" env:"K8S_PROXY_TLS_CERT" description:"TLS cert file"`
+	TlsKeyFile                 string        `long:"tls-key" env:"K8S_PROXY_TLS_KEY" description:"TLS key file"`
+	TlsCertDir                 string        `long:"tls-cert-dir" env:"K8S_PROXY_TLS_CERT_DIR" description:"Directory of TLS secrets (<name>/tls.crt & <name>/tls.key) to select from by SNI"`
+	TlsReloadInterval          time.Duration `long:"tls-reload-interval" env:"K8S_PROXY_TLS_RELOAD_INTERVAL" description:"How often to check TLS certificates for changes" default:"1m"`
+	ClientCAFile               string        `long:"client-ca" env:"K8S_PROXY_CLIENT_CA" description:"CA bundle to verify client certificates against (enables client certificate authentication)"`
+	ClientAuth                 string        `long:"client-auth" env:"K8S_PROXY_CLIENT_AUTH" description:"Client certificate verification: none, request or require-and-verify" default:"require-and-verify"`
+	AuthProxyCIDRs             []string      `long:"auth-proxy-cidr" env:"K8S_PROXY_AUTH_PROXY_CIDR" env-delim:"," description:"Address range of an authenticating proxy (e.g. oauth2-proxy) trusted to send user headers, may be repeated"`
+	AuthProxyCAFile            string        `long:"auth-proxy-ca" env:"K8S_PROXY_AUTH_PROXY_CA" description:"CA bundle of the client certificates an authenticating proxy trusted to send user headers connects with"`
+	AuthProxyUserHeaders       []string      `long:"auth-proxy-user-header" env:"K8S_PROXY_AUTH_PROXY_USER_HEADER" env-delim:"," description:"Header naming the user, from a trusted authenticating proxy, may be repeated" default:"X-Forwarded-User" default:"X-Remote-User"`
+	AuthProxyGroupHeaders      []string      `long:"auth-proxy-group-header" env:"K8S_PROXY_AUTH_PROXY_GROUP_HEADER" env-delim:"," description:"Header listing the user's groups, comma separated, from a trusted authenticating proxy, may be repeated" default:"X-Forwarded-Groups" default:"X-Remote-Group"`
+	AuthProxyExtraHeaderPrefix []string      `long:"auth-proxy-extra-header-prefix" env:"K8S_PROXY_AUTH_PROXY_EXTRA_HEADER_PREFIX" env-delim:"," description:"Prefix of headers giving further user attributes, from a trusted authenticating proxy, may be repeated" default:"X-Remote-Extra-"`
+	Impersonate                bool          `long:"impersonate" env:"K8S_PROXY_IMPERSONATE" description:"Call the Kubernetes master as the authenticated user using impersonation headers" default:"false"`
+	PassthroughAuth            bool          `long:"passthrough-auth" env:"K8S_PROXY_PASSTHROUGH_AUTH" description:"Forward each request's own bearer token to the Kubernetes master" default:"false"`
+	TokenCookie                string        `long:"token-cookie" env:"K8S_PROXY_TOKEN_COOKIE" description:"Cookie to read the bearer token from if there is no Authorization header" default:"access_token"`
+	FallbackTokenFile          string        `long:"fallback-token-file" env:"K8S_PROXY_FALLBACK_TOKEN_FILE" description:"Token to use for requests without credentials when passing auth through (rejected otherwise)"`
+	AccessLog                  string        `long:"access-log" env:"K8S_PROXY_ACCESS_LOG" description:"Where to write access logs: - for stdout, a file path (reopened on SIGHUP) or empty to disable" default:"-"`
+	AccessLogFormat            string        `long:"access-log-format" env:"K8S_PROXY_ACCESS_LOG_FORMAT" description:"Access log format: common, combined or json" default:"common"`
+	MetricsPath                string        `long:"metrics-path" env:"K8S_PROXY_METRICS_PATH" description:"Path to serve Prometheus metrics on (optional)"`
+	MetricsPort                uint16        `long:"metrics-port" env:"K8S_PROXY_METRICS_PORT" description:"Port to serve metrics on if not the main port (optional)"`
+	StartupRetries             int           `long:"startup-retries" env:"K8S_PROXY_STARTUP_RETRIES" description:"Number of times to retry connecting to the Kubernetes master on startup" default:"0"`
+	StartupBackoff             time.Duration `long:"startup-backoff" env:"K8S_PROXY_STARTUP_BACKOFF" description:"Delay before retrying to connect on startup, doubled after each attempt" default:"1s"`
+	ReadinessInterval          time.Duration `long:"readiness-interval" env:"K8S_PROXY_READINESS_INTERVAL" description:"How often to check each Kubernetes master is reachable, for /readyz & HA failover" default:"10s"`
+	ShutdownDelay              time.Duration `long:"shutdown-delay" env:"K8S_PROXY_SHUTDOWN_DELAY" description:"How long to keep serving, with /readyz failing, on SIGTERM before draining connections" default:"0s"`
+	ShutdownTimeout            time.Duration `long:"shutdown-timeout" env:"K8S_PROXY_SHUTDOWN_TIMEOUT" description:"How long to wait for in-flight requests to complete on SIGTERM" default:"30s"`
 }
 
 func main() {
-	var options Options
-	var parser = flags.NewParser(&options, flags.Default)
-
-	if _, err := parser.Parse(); err != nil {
-		if e, ok := err.(*flags.Error); !ok || e.Type != flags.ErrHelp {
-			parser.WriteHelp(os.Stderr)
+	options, config, err := parseOptions(os.Args[1:], flags.Default)
+	if err != nil {
+		e, ok := err.(*flags.Error)
+		if !ok {
+			log.Panic(err)
+		}
+		if e.Type != flags.ErrHelp {
+			flags.NewParser(&Options{}, flags.Default).WriteHelp(os.Stderr)
 			os.Exit(1)
 		}
 		os.Exit(0)
 	}
+	if options.PrintConfig {
+		printConfig(os.Stdout, options, config)
+		os.Exit(0)
+	}
+
+	if options.OAuthLogin && len(options.OidcIssuer) > 0 {
+		log.Panic("--oauth-login and --oidc-issuer can't be used together")
+	}
+	oidcImpersonate := len(options.OidcIssuer) > 0 && options.OidcForward == oidcForwardImpersonate
+	if oidcImpersonate && options.PassthroughAuth {
+		log.Panic("--passthrough-auth can't be used with --oidc-forward=impersonate")
+	}
 
-	if len(options.KubernetesMaster) == 0 && len(os.Getenv("KUBERNETES_SERVICE_HOST")) > 0 {
-		options.KubernetesMaster = "https://${KUBERNETES_SERVICE_HOST}:${KUBERNETES_SERVICE_PORT}"
+	var passthrough *credentialPassthrough
+	if options.PassthroughAuth || options.OAuthLogin || (len(options.OidcIssuer) > 0 && !oidcImpersonate) {
+		var err error
+		if passthrough, err = newCredentialPassthrough(options.TokenCookie, options.FallbackTokenFile); err != nil {
+			log.Panic(err)
+		}
 	}
 
-	options.KubernetesMaster = os.ExpandEnv(options.KubernetesMaster)
+	if options.Impersonate {
+		if passthrough != nil {
+			log.Panic("--impersonate calls the Kubernetes master with the proxy's own credentials, so can't be used when passing user credentials through")
+		}
+		if len(options.ClientCAFile) == 0 && len(options.OidcIssuer) == 0 && len(options.AuthProxyCIDRs) == 0 && len(options.AuthProxyCAFile) == 0 {
+			log.Panic("--impersonate needs users to be authenticated by the proxy, with --client-ca, --oidc-issuer, --auth-proxy-cidr or --auth-proxy-ca")
+		}
+	}
 
-	kubernetesUrl, _ := url.Parse(options.KubernetesMaster)
+	var metrics *proxyMetrics
+	if len(options.MetricsPath) > 0 {
+		metrics = newProxyMetrics()
+		if options.MetricsPort > 0 {
+			metricsMux := http.NewServeMux()
+			metricsMux.Handle(options.MetricsPath, metrics.registry)
+			go func() {
+				log.Printf("Serving metrics on port %d", options.MetricsPort)
+				log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", options.MetricsPort), metricsMux))
+			}()
+		} else {
+			http.Handle(options.MetricsPath, metrics.registry)
+		}
+	}
 
-	k8sConfig := &k8sclient.Config{
-		Host:     options.KubernetesMaster,
-		Version:  options.KubernetesApiVersion,
-		Insecure: options.Insecure,
-		TLSClientConfig: k8sclient.TLSClientConfig{
-			CAFile: options.KubernetesCACertFile,
+	upstream := &upstreamOptions{
+		passthrough:          passthrough,
+		impersonate:          options.Impersonate || oidcImpersonate,
+		metrics:              metrics,
+		tokenRefreshInterval: options.TokenRefreshInterval,
+		masterBalance:        options.MasterBalance,
+		resilience: &resilienceOptions{
+			retries:         options.UpstreamRetries,
+			backoff:         options.UpstreamRetryBackoff,
+			timeout:         options.UpstreamTimeout,
+			breakerFailures: options.CircuitBreakerFailures,
+			breakerCooldown: options.CircuitBreakerCooldown,
 		},
 	}
 
-	k8sClient, err := k8sclient.New(k8sConfig)
+	var login loginFlow
+	var oauth *oauthLogin
+	var oidc *oidcLogin
+	if options.OAuthLogin || len(options.OidcIssuer) > 0 {
+		sessions, err := newSessionCookies(options.SessionCookie, options.SessionSecretFile, options.SessionTimeout)
+		if err != nil {
+			log.Panic(err)
+		}
+		if options.OAuthLogin {
+			oauth, err = newOAuthLogin(options.OpenShiftOAuthClientId, options.OAuthClientSecretFile, options.OpenShiftOAuthAuthorizeUri, options.OAuthTokenUri, options.OAuthRedirectUri, sessions)
+			if err != nil {
+				log.Panic(err)
+			}
+			login = oauth
+			upstream.filters = append(upstream.filters, sessions.Wrap)
+		} else {
+			oidc, err = newOIDCLogin(&oidcOptions{
+				issuer:           options.OidcIssuer,
+				caFile:           options.OidcCAFile,
+				clientID:         options.OidcClientId,
+				clientSecretFile: options.OidcClientSecretFile,
+				scopes:           options.OidcScopes,
+				redirectURI:      options.OAuthRedirectUri,
+				usernameClaim:    options.OidcUsernameClaim,
+				groupsClaim:      options.OidcGroupsClaim,
+				extraClaims:      options.OidcExtraClaims,
+				allowedGroups:    options.OidcAllowedGroups,
+				allowedEmails:    options.OidcAllowedEmails,
+				forward:          options.OidcForward,
+			}, sessions)
+			if err != nil {
+				log.Panic(err)
+			}
+			login = oidc
+			upstream.filters = append(upstream.filters, oidc.Wrap)
+		}
+		http.HandleFunc(oauthLoginPath, login.Login)
+		http.HandleFunc(oauthCallbackPath, login.Callback)
+		http.HandleFunc(oauthLogoutPath, login.Logout)
+	}
+
+	policy, err := configuredPolicy(options, config)
 	if err != nil {
 		log.Panic(err)
 	}
+	// The policy filter is always in place, as a reload may add a policy.
+	reloadable := &reloadablePolicy{policy: policy}
+	upstream.filters = append(upstream.filters, reloadable.Enforce)
 
-	if serverVersion, err := k8sClient.ServerVersion(); err != nil {
-		log.Panic("Couldn't retrieve Kubernetes server version - incorrect URL?", err)
-	} else {
-		log.Printf("Connecting to Kubernetes master at %v running version %v", options.KubernetesMaster, serverVersion.String())
+	if options.ReadOnly {
+		readOnly, err := ReadOnly(options.ReadOnlyProxy)
+		if err != nil {
+			log.Panic(err)
+		}
+		upstream.filters = append(upstream.filters, readOnly)
 	}
 
+	if options.Redact {
+		redactor, err := newRedactor(options.RedactKinds, options.RedactExemptHeader)
+		if err != nil {
+			log.Panic(err)
+		}
+		upstream.redactor = redactor
+		upstream.filters = append(upstream.filters, redactor.Filter)
+	}
+
+	if options.ShareWatches {
+		upstream.shareWatches = true
+		upstream.filters = append(upstream.filters, ShareWatches)
+	}
+
+	if options.Cache {
+		if options.CacheSize <= 0 {
+			log.Panicf("Cache size must be positive, got %d", options.CacheSize)
+		}
+		upstream.cache = newResponseCache(int64(options.CacheSize)<<20, options.CacheTTL)
+		upstream.filters = append(upstream.filters, upstream.cache.Filter)
+	}
+
+	// With a config file the limiter is always in place, as a reload may add
+	// limits.
+	if config != nil || options.RateLimitRead > 0 || options.RateLimitWrite > 0 || options.RateLimitWatch > 0 || options.RateLimitOsApi > 0 || options.MaxInFlightPerClient > 0 {
+		rateLimiter, err := newRateLimiter(rateLimits(options), options.MaxInFlightPerClient, options.RateLimitBy, metrics)
+		if err != nil {
+			log.Panic(err)
+		}
+		upstream.rateLimiter = rateLimiter
+	}
+
+	if config != nil || len(options.PolicyFile) > 0 {
+		newConfigReloader(os.Args[1:], options, config, reloadable, upstream.rateLimiter).start(options.ConfigReloadInterval)
+	}
+
+	var clusterConfigs []ClusterConfig
+	if len(options.ClustersFile) > 0 {
+		if clusterConfigs, err = loadClusterConfigs(options.ClustersFile); err != nil {
+			log.Panic(err)
+		}
+	} else if config != nil {
+		clusterConfigs = config.clusters
+	}
+
+	var clusters clusterIndex
+	k8sConfig, err := kubernetesClientConfig(options)
+	switch {
+	case err == errNoMaster && len(clusterConfigs) > 0:
+		// Only the clusters in the file are proxied.
+	case err != nil:
+		log.Panic(err)
+	default:
+		defaultCluster, err := newCluster(defaultClusterName, k8sConfig, kubernetesMasters(options, k8sConfig), options.TokenFile, upstream)
+		if err != nil {
+			log.Panic(err)
+		}
+		clusters = append(clusters, defaultCluster)
+		if oauth != nil {
+			if err := oauth.trust(k8sConfig); err != nil {
+				log.Panic(err)
+			}
+		}
+		http.Handle(options.ApiPrefix, defaultCluster.ApiHandler(options.ApiPrefix))
+		if len(options.OsApiPrefix) > 0 {
+			http.Handle(options.OsApiPrefix, defaultCluster.OsApiHandler(options.OsApiPrefix))
+		}
+	}
+
+	for _, clusterConfig := range clusterConfigs {
+		if clusterConfig.Name == defaultClusterName && len(clusters) > 0 {
+			log.Panicf("Cluster name %q is reserved for the cluster given by the --kubernetes-* flags", defaultClusterName)
+		}
+		c, err := newCluster(clusterConfig.Name, clusterConfig.clientConfig(options.KubernetesApiVersion), clusterConfig.masters(), clusterConfig.TokenFile, upstream)
+		if err != nil {
+			log.Panic(err)
+		}
+		clusters = append(clusters, c)
+	}
+
+	for _, c := range clusters {
+		if err := c.waitForMaster(options.StartupRetries, options.StartupBackoff); err != nil {
+			log.Panic(err)
+		}
+		prefix := clusterPrefix(c.name)
+		http.Handle(prefix+"api/", c.ApiHandler(prefix+"api/"))
+		http.Handle(prefix+"osapi/", c.OsApiHandler(prefix+"osapi/"))
+	}
+	http.Handle("/clusters", clusters)
+
+	drain := newDrainer()
+	ready := newReadiness()
+	ready.addCheck("shutdown", drain.check)
+	for _, c := range clusters {
+		name := "master"
+		if c.name != defaultClusterName {
+			name = "master/" + c.name
+		}
+		c.masters.start(options.ReadinessInterval)
+		ready.addCheck(name, c.masters.check)
+	}
+	if oidc != nil {
+		ready.addPeriodicCheck("oidc-issuer", options.ReadinessInterval, oidc.provider.check)
+	}
+	ready.addCheck("static-dir", fileExistsCheck(options.StaticDir, true))
+	if len(options.Error404) > 0 {
+		ready.addCheck("404-page", error404PageCheck(options.StaticDir, options.Error404))
+	}
+	http.HandleFunc("/healthz", healthz)
+	http.Handle("/readyz", ready)
+
 	// Add SVG mimetype...
 	mime.AddExtensionType(".svg", "image/svg+xml")
 
@@ -90,19 +364,24 @@ window.OPENSHIFT_CONFIG = {
 	auth: {
 		oauth_authorize_uri: "{{ .AuthorizeUri }}",
 		oauth_client_id: "{{ .ClientId }}",
-		logout_uri: "",
+		logout_uri: "{{ .LogoutUri }}",
 	}
 };
 `
 
 		type oauthConfig struct {
-			AuthorizeUri, ClientId string
+			AuthorizeUri, ClientId, LogoutUri string
 		}
 
 		config := &oauthConfig{
 			AuthorizeUri: options.OpenShiftOAuthAuthorizeUri,
 			ClientId:     options.OpenShiftOAuthClientId,
 		}
+		if login != nil {
+			// The proxy holds the token, so the console logs in & out through it.
+			config.AuthorizeUri = oauthLoginPath
+			config.LogoutUri = oauthLogoutPath
+		}
 
 		t := template.Must(template.New("config.js").Parse(configJsTemplate))
 		var doc bytes.Buffer
@@ -111,24 +390,11 @@ window.OPENSHIFT_CONFIG = {
 
 		http.HandleFunc("/osconsole/config.js", func(w http.ResponseWriter, r *http.Request) {
 			w.Header().Set("Content-Type", "application/javascript")
-			fmt.Fprintf(w, configJs)
+			fmt.Fprint(w, configJs)
 		})
 	}
 
-	_, err = kubectl.NewProxyServer(options.StaticDir, options.ApiPrefix, options.StaticPrefix, k8sConfig)
-
-	if len(options.OsApiPrefix) > 0 {
-		transport, _ := k8sclient.TransportFor(k8sConfig)
-
-		osapiRP := httputil.NewSingleHostReverseProxy(&url.URL{
-			Scheme: kubernetesUrl.Scheme,
-			Host:   kubernetesUrl.Host,
-			Path:   "/osapi/",
-		})
-		osapiRP.Transport = transport
-
-		http.Handle(options.OsApiPrefix, http.StripPrefix(options.OsApiPrefix, stripGenericWebhookBody(osapiRP)))
-	}
+	http.Handle(options.StaticPrefix, http.StripPrefix(options.StaticPrefix, http.FileServer(http.Dir(options.StaticDir))))
 
 	log.Printf("Listening on port %d", options.Port)
 
@@ -138,15 +404,85 @@ window.OPENSHIFT_CONFIG = {
 
 	http2.ConfigureServer(srv, &http2.Server{})
 
-	if len(options.Error404) > 0 {
-		srv.Handler = Handle404(http.DefaultServeMux, http.Dir(options.StaticDir), options.Error404)
+	useTLS := (len(options.TlsCertFile) > 0 && len(options.TlsKeyFile) > 0) || len(options.TlsCertDir) > 0
+	if useTLS {
+		certs, err := newCertStore(options.TlsCertFile, options.TlsKeyFile, options.TlsCertDir)
+		if err != nil {
+			log.Panic(err)
+		}
+		srv.TLSConfig.GetCertificate = certs.GetCertificate
+		go certs.watch(options.TlsReloadInterval)
+	}
+	if len(options.ClientCAFile) > 0 {
+		if !useTLS {
+			log.Panic("--client-ca requires TLS to be enabled")
+		}
+		if err := configureClientAuth(srv.TLSConfig, options.ClientCAFile, options.ClientAuth); err != nil {
+			log.Panic(err)
+		}
+	}
+	var authenticatingProxy *authProxy
+	if len(options.AuthProxyCIDRs) > 0 || len(options.AuthProxyCAFile) > 0 {
+		if len(options.AuthProxyCAFile) > 0 && !useTLS {
+			log.Panic("--auth-proxy-ca requires TLS to be enabled")
+		}
+		if authenticatingProxy, err = newAuthProxy(options.AuthProxyUserHeaders, options.AuthProxyGroupHeaders, options.AuthProxyExtraHeaderPrefix, options.AuthProxyCIDRs, options.AuthProxyCAFile); err != nil {
+			log.Panic(err)
+		}
+		if useTLS {
+			authenticatingProxy.configureTLS(srv.TLSConfig)
+		}
 	}
 
-	if len(options.TlsCertFile) > 0 && len(options.TlsKeyFile) > 0 {
-		log.Fatal(srv.ListenAndServeTLS(options.TlsCertFile, options.TlsKeyFile))
-	} else {
-		log.Fatal(srv.ListenAndServe())
+	var handler http.Handler = drain.EndStreams(http.DefaultServeMux)
+	if len(options.Error404) > 0 {
+		handler = Handle404(handler, http.Dir(options.StaticDir), options.Error404)
 	}
+	if authenticatingProxy != nil {
+		handler = authenticatingProxy.Wrap(handler)
+	}
+	if len(options.ClientCAFile) > 0 {
+		handler = ClientCertAuthenticator(handler)
+	}
+	if metrics != nil {
+		routes := &routeClassifier{
+			apiPrefix:      options.ApiPrefix,
+			osApiPrefix:    options.OsApiPrefix,
+			has404Fallback: len(options.Error404) > 0,
+		}
+		if options.MetricsPort == 0 {
+			routes.metricsPath = options.MetricsPath
+		}
+		handler = metrics.Instrument(handler, routes)
+	}
+	if len(options.AccessLog) > 0 {
+		if options.AccessLog != "-" {
+			accessLog, err := newReopeningFile(options.AccessLog)
+			if err != nil {
+				log.Panic(err)
+			}
+			logger.SetOutput(accessLog)
+		}
+		if handler, err = AccessLogger(handler, options.AccessLogFormat); err != nil {
+			log.Panic(err)
+		}
+	}
+	srv.Handler = handler
+
+	go func() {
+		var err error
+		if useTLS {
+			// Certificates come from srv.TLSConfig.GetCertificate.
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	drain.waitForSignal(srv, options.ShutdownDelay, options.ShutdownTimeout)
 }
 
 func stripGenericWebhookBody(h http.Handler) http.Handler {
@@ -189,6 +525,20 @@ func (h *hijack404) Write(p []byte) (int, error) {
 	return h.ResponseWriter.Write(p)
 }
 
+func (h *hijack404) Flush() {
+	if f, ok := h.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (h *hijack404) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := h.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response does not support hijacking")
+	}
+	return hj.Hijack()
+}
+
 func (h *hijack404) WriteHeader(code int) {
 	if code == http.StatusNotFound {
 		h.ResponseWriter.Header().Set("Content-Type", "text/html; charset=utf-8")
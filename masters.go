@@ -0,0 +1,358 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	k8sclient "github.com/GoogleCloudPlatform/kubernetes/pkg/client"
+)
+
+// How requests are spread across the masters of a cluster, for
+// --master-balance.
+const (
+	MasterBalanceRoundRobin       = "round-robin"
+	MasterBalanceLeastConnections = "least-connections"
+)
+
+// An ejected master is checked again after masterRecheckMin, doubling after
+// each failed check up to masterRecheckMax.
+const (
+	masterRecheckMin = time.Second
+	masterRecheckMax = time.Minute
+)
+
+// splitMasters returns the master URLs in values, which may each be a
+// comma-separated list, with environment variables expanded.
+func splitMasters(values []string) []string {
+	var masters []string
+	for _, value := range values {
+		for _, master := range strings.Split(os.ExpandEnv(value), ",") {
+			if master = strings.TrimSpace(master); len(master) > 0 {
+				masters = append(masters, master)
+			}
+		}
+	}
+	return masters
+}
+
+// master is one of the API servers of an HA cluster.
+type master struct {
+	host   string
+	url    *url.URL
+	client *k8sclient.Client
+
+	// Guarded by the pool's mutex.
+	healthy  bool
+	lastErr  error
+	inFlight int
+	checking bool
+	checkAt  time.Time
+	recheck  time.Duration
+}
+
+// masterPool spreads the requests to a cluster across its masters, sending
+// them only to those that are healthy. Each master is health-checked with the
+// version call made at startup; one that fails a check, or that a request
+// can't connect to, is ejected and checked again with backoff until it
+// answers. A request stays on the master it was sent to, so watches & other
+// streams aren't moved when the healthy masters change.
+type masterPool struct {
+	cluster          string
+	masters          []*master
+	leastConnections bool
+	metrics          *proxyMetrics
+
+	mu   sync.Mutex
+	next int
+}
+
+// newMasterPool creates the pool of the masters at hosts, each reached with
+// config, spreading requests across them as balance says.
+func newMasterPool(cluster string, config *k8sclient.Config, hosts []string, balance string, metrics *proxyMetrics) (*masterPool, error) {
+	if balance != MasterBalanceRoundRobin && balance != MasterBalanceLeastConnections {
+		return nil, fmt.Errorf("unknown master balancing %q, expected %s or %s", balance, MasterBalanceRoundRobin, MasterBalanceLeastConnections)
+	}
+	if len(hosts) == 0 {
+		hosts = []string{config.Host}
+	}
+	p := &masterPool{cluster: cluster, leastConnections: balance == MasterBalanceLeastConnections, metrics: metrics}
+	for _, host := range hosts {
+		u, err := url.Parse(host)
+		if err != nil {
+			return nil, err
+		}
+		if len(u.Scheme) == 0 || len(u.Host) == 0 {
+			return nil, fmt.Errorf("invalid Kubernetes master URL %q for cluster %s", host, cluster)
+		}
+		masterConfig := *config
+		masterConfig.Host = host
+		client, err := k8sclient.New(&masterConfig)
+		if err != nil {
+			return nil, err
+		}
+		p.masters = append(p.masters, &master{host: host, url: u, client: client, healthy: true})
+		p.report(host, true)
+	}
+	return p, nil
+}
+
+// pick returns the master to send a request to, preferring healthy ones but
+// trying them all if none is.
+func (p *masterPool) pick() *master {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	candidates := make([]*master, 0, len(p.masters))
+	for _, m := range p.masters {
+		if m.healthy {
+			candidates = append(candidates, m)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = p.masters
+	}
+	// Starting from the next in turn also breaks ties between masters with as
+	// few connections as each other.
+	start := p.next % len(candidates)
+	p.next++
+	picked := candidates[start]
+	if p.leastConnections {
+		for i := 1; i < len(candidates); i++ {
+			if m := candidates[(start+i)%len(candidates)]; m.inFlight < picked.inFlight {
+				picked = m
+			}
+		}
+	}
+	picked.inFlight++
+	return picked
+}
+
+func (p *masterPool) release(m *master) {
+	p.mu.Lock()
+	m.inFlight--
+	p.mu.Unlock()
+}
+
+// eject takes m out of the pool after a request to it failed with err.
+func (p *masterPool) eject(m *master, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if m.healthy {
+		p.setHealthLocked(m, err)
+	}
+}
+
+// setHealthLocked records the outcome of checking m, scheduling its next check.
+func (p *masterPool) setHealthLocked(m *master, err error) {
+	healthy := err == nil
+	if healthy != m.healthy && len(p.masters) > 1 {
+		if healthy {
+			log.Printf("Kubernetes master %s for cluster %s is back, re-adding it", m.host, p.cluster)
+		} else {
+			log.Printf("Kubernetes master %s for cluster %s is unhealthy, ejecting it: %v", m.host, p.cluster, err)
+		}
+	}
+	m.healthy, m.lastErr = healthy, err
+	if healthy {
+		m.recheck = 0
+	} else {
+		if m.recheck *= 2; m.recheck < masterRecheckMin {
+			m.recheck = masterRecheckMin
+		} else if m.recheck > masterRecheckMax {
+			m.recheck = masterRecheckMax
+		}
+		m.checkAt = time.Now().Add(m.recheck)
+	}
+	p.report(m.host, healthy)
+}
+
+func (p *masterPool) report(host string, healthy bool) {
+	if p.metrics != nil {
+		value := 0.0
+		if healthy {
+			value = 1
+		}
+		p.metrics.masterHealthy.Set(value, p.cluster, host)
+	}
+}
+
+// checkMaster asks m for its version, recording whether it answered.
+func (p *masterPool) checkMaster(m *master, interval time.Duration) (string, error) {
+	version, err := m.client.ServerVersion()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	m.checking = false
+	p.setHealthLocked(m, err)
+	if err != nil {
+		return "", err
+	}
+	m.checkAt = time.Now().Add(interval)
+	return version.String(), nil
+}
+
+// checkAll checks every master at once, returning the version of a healthy
+// one or, if none is, the error of the last.
+func (p *masterPool) checkAll() (string, error) {
+	type result struct {
+		version string
+		err     error
+	}
+	results := make(chan result, len(p.masters))
+	for _, m := range p.masters {
+		go func(m *master) {
+			version, err := p.checkMaster(m, 0)
+			if err != nil && len(p.masters) > 1 {
+				err = fmt.Errorf("%s: %v", m.host, err)
+			}
+			results <- result{version, err}
+		}(m)
+	}
+	var version string
+	var err error
+	for range p.masters {
+		if r := <-results; r.err != nil {
+			err = r.err
+		} else if len(version) == 0 {
+			version = r.version
+		}
+	}
+	if len(version) > 0 {
+		return version, nil
+	}
+	return "", err
+}
+
+// start health-checks each healthy master every interval and each ejected
+// one when its backoff is up.
+func (p *masterPool) start(interval time.Duration) {
+	p.mu.Lock()
+	for _, m := range p.masters {
+		if m.healthy {
+			m.checkAt = time.Now().Add(interval)
+		}
+	}
+	p.mu.Unlock()
+	tick := masterRecheckMin
+	if interval < tick {
+		tick = interval
+	}
+	go func() {
+		for now := range time.Tick(tick) {
+			p.mu.Lock()
+			for _, m := range p.masters {
+				if !m.checking && !now.Before(m.checkAt) {
+					m.checking = true
+					go p.checkMaster(m, interval)
+				}
+			}
+			p.mu.Unlock()
+		}
+	}()
+}
+
+// check is the readiness check of the pool: it passes while any master is
+// healthy.
+func (p *masterPool) check() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var errs []string
+	for _, m := range p.masters {
+		if m.healthy {
+			return nil
+		}
+		if len(p.masters) == 1 {
+			return m.lastErr
+		}
+		errs = append(errs, fmt.Sprintf("%s: %v", m.host, m.lastErr))
+	}
+	return fmt.Errorf("no healthy Kubernetes master: %s", strings.Join(errs, "; "))
+}
+
+// hosts returns the URLs of the masters.
+func (p *masterPool) hosts() []string {
+	hosts := make([]string, 0, len(p.masters))
+	for _, m := range p.masters {
+		hosts = append(hosts, m.host)
+	}
+	return hosts
+}
+
+type masterInfo struct {
+	Master   string `json:"master"`
+	Healthy  bool   `json:"healthy"`
+	InFlight int    `json:"inFlight"`
+}
+
+func (p *masterPool) info() []masterInfo {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	infos := make([]masterInfo, 0, len(p.masters))
+	for _, m := range p.masters {
+		infos = append(infos, masterInfo{Master: m.host, Healthy: m.healthy, InFlight: m.inFlight})
+	}
+	return infos
+}
+
+// Transport returns rt sending each request to a master picked from the pool.
+func (p *masterPool) Transport(rt http.RoundTripper) http.RoundTripper {
+	return &balancingTransport{rt: rt, pool: p}
+}
+
+type balancingTransport struct {
+	rt   http.RoundTripper
+	pool *masterPool
+}
+
+func (t *balancingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	m := t.pool.pick()
+	out := req.Clone(req.Context())
+	out.URL.Scheme, out.URL.Host = m.url.Scheme, m.url.Host
+	resp, err := t.rt.RoundTrip(out)
+	if err != nil {
+		t.pool.release(m)
+		if req.Context().Err() == nil {
+			t.pool.eject(m, err)
+		}
+		return nil, err
+	}
+	var once sync.Once
+	release := func() { once.Do(func() { t.pool.release(m) }) }
+	// The connection of a switched protocol must stay writable for
+	// httputil.ReverseProxy to splice it to the client.
+	if rwc, ok := resp.Body.(io.ReadWriteCloser); ok {
+		resp.Body = &releasingReadWriteBody{rwc, release}
+	} else {
+		resp.Body = &releasingBody{resp.Body, release}
+	}
+	return resp, nil
+}
+
+// releasingBody gives back a master's connection once the response from it
+// has been read.
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
+
+type releasingReadWriteBody struct {
+	io.ReadWriteCloser
+	release func()
+}
+
+func (b *releasingReadWriteBody) Close() error {
+	err := b.ReadWriteCloser.Close()
+	b.release()
+	return err
+}
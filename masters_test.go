@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	k8sclient "github.com/GoogleCloudPlatform/kubernetes/pkg/client"
+)
+
+func newTestMasterPool(t *testing.T, balance string, hosts ...string) *masterPool {
+	p, err := newMasterPool("test", &k8sclient.Config{Host: hosts[0], Version: "v1beta3"}, hosts, balance, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestMasterPoolBalance(t *testing.T) {
+	hosts := []string{"http://a:8080", "http://b:8080", "http://c:8080"}
+	for _, test := range []struct {
+		balance string
+		want    string
+	}{
+		// Taking turns regardless of the requests still open on a & b...
+		{MasterBalanceRoundRobin, "[http://c:8080 http://a:8080 http://b:8080 http://c:8080]"},
+		// ...or sending everything to c, which has none.
+		{MasterBalanceLeastConnections, "[http://c:8080 http://c:8080 http://c:8080 http://c:8080]"},
+	} {
+		p := newTestMasterPool(t, test.balance, hosts...)
+		if a, b := p.pick(), p.pick(); a.host != hosts[0] || b.host != hosts[1] {
+			t.Fatalf("%s: first picked %s & %s", test.balance, a.host, b.host)
+		}
+		var picked []string
+		for i := 0; i < 4; i++ {
+			m := p.pick()
+			picked = append(picked, m.host)
+			p.release(m)
+		}
+		if got := fmt.Sprint(picked); got != test.want {
+			t.Errorf("%s: got %s, want %s", test.balance, got, test.want)
+		}
+	}
+
+	if _, err := newMasterPool("test", &k8sclient.Config{Host: hosts[0]}, hosts, "random", nil); err == nil {
+		t.Errorf("accepted an unknown balancing")
+	}
+}
+
+func TestMasterPoolEject(t *testing.T) {
+	live := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/version" {
+			fmt.Fprint(w, `{"major":"0","minor":"18","gitVersion":"v0.18.0"}`)
+		}
+	}))
+	defer live.Close()
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+	p := newTestMasterPool(t, MasterBalanceRoundRobin, dead.URL, live.URL)
+	client := &http.Client{Transport: p.Transport(http.DefaultTransport)}
+
+	// The request that can't connect ejects the master, & the rest all go to
+	// the one left.
+	if _, err := client.Get("http://master/api"); err == nil {
+		t.Fatal("request to the dead master succeeded")
+	}
+	for i := 0; i < 3; i++ {
+		resp, err := client.Get("http://master/version")
+		if err != nil {
+			t.Fatalf("request %d: %v", i+1, err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	deadMaster, liveMaster := p.masters[0], p.masters[1]
+	if deadMaster.healthy || deadMaster.recheck != masterRecheckMin || !liveMaster.healthy {
+		t.Fatalf("got dead master healthy %v rechecked in %v, live master healthy %v", deadMaster.healthy, deadMaster.recheck, liveMaster.healthy)
+	}
+	if err := p.check(); err != nil {
+		t.Errorf("pool not ready with a master left: %v", err)
+	}
+
+	// Each failed check doubles the time to the next, up to the maximum.
+	for _, want := range []time.Duration{2 * time.Second, 4 * time.Second} {
+		if _, err := p.checkMaster(deadMaster, time.Minute); err == nil {
+			t.Fatal("check of the dead master passed")
+		}
+		if deadMaster.recheck != want || time.Until(deadMaster.checkAt) > want {
+			t.Errorf("got recheck %v at %v, want %v", deadMaster.recheck, deadMaster.checkAt, want)
+		}
+	}
+	deadMaster.recheck = 40 * time.Second
+	p.checkMaster(deadMaster, time.Minute)
+	if deadMaster.recheck != masterRecheckMax {
+		t.Errorf("got recheck %v, want the maximum", deadMaster.recheck)
+	}
+
+	// A passing check re-adds a master, & resets its backoff.
+	if version, err := p.checkMaster(liveMaster, time.Minute); err != nil || version != "v0.18.0" {
+		t.Errorf("check of the live master: got %q, %v", version, err)
+	}
+	if !liveMaster.healthy || liveMaster.recheck != 0 {
+		t.Errorf("live master healthy %v with recheck %v", liveMaster.healthy, liveMaster.recheck)
+	}
+
+	p.eject(liveMaster, fmt.Errorf("gone away"))
+	if err := p.check(); err == nil {
+		t.Errorf("pool ready without a healthy master")
+	}
+}
+
+func TestMasterPoolCancelledRequest(t *testing.T) {
+	master := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer master.Close()
+	p := newTestMasterPool(t, MasterBalanceRoundRobin, master.URL)
+
+	// A client giving up says nothing about the master.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", "http://master/api", nil)
+	if _, err := p.Transport(http.DefaultTransport).RoundTrip(req); err == nil {
+		t.Fatal("cancelled request succeeded")
+	}
+	if info := p.info(); !info[0].Healthy || info[0].InFlight != 0 {
+		t.Errorf("got %+v", info)
+	}
+}
+
+func TestMasterPoolRelease(t *testing.T) {
+	master := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer master.Close()
+	p := newTestMasterPool(t, MasterBalanceLeastConnections, master.URL)
+	rt := p.Transport(http.DefaultTransport)
+
+	req, _ := http.NewRequest("GET", "http://master/api", nil)
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(resp.Body)
+	// The connection counts until the body is closed, even once it is read,
+	// & only once however often it is closed.
+	if n := p.info()[0].InFlight; n != 1 {
+		t.Errorf("got %d in flight before the body was closed, want 1", n)
+	}
+	resp.Body.Close()
+	resp.Body.Close()
+	if n := p.info()[0].InFlight; n != 0 {
+		t.Errorf("got %d in flight after the body was closed, want 0", n)
+	}
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A small, dependency free implementation of the parts of the Prometheus data
+// model we need: labelled counters, gauges & histograms, exposed in the text
+// format (version 0.0.4).
+
+type metric interface {
+	writeTo(w io.Writer)
+}
+
+// metricsRegistry holds metrics in registration order and serves them over HTTP.
+type metricsRegistry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{}
+}
+
+func (m *metricsRegistry) register(mt metric) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.metrics = append(m.metrics, mt)
+}
+
+// Write writes all registered metrics in the Prometheus text format.
+func (m *metricsRegistry) Write(w io.Writer) {
+	m.mu.Lock()
+	metrics := append([]metric(nil), m.metrics...)
+	m.mu.Unlock()
+	for _, mt := range metrics {
+		mt.writeTo(w)
+	}
+}
+
+func (m *metricsRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	m.Write(&buf)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buf.Bytes())
+}
+
+type series struct {
+	labelValues []string
+	value       float64
+}
+
+// metricVec is a counter or gauge partitioned by a set of labels.
+type metricVec struct {
+	name, help, typ string
+	labels          []string
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+func (m *metricsRegistry) newCounterVec(name, help string, labels ...string) *metricVec {
+	v := &metricVec{name: name, help: help, typ: "counter", labels: labels, series: map[string]*series{}}
+	m.register(v)
+	return v
+}
+
+func (m *metricsRegistry) newGaugeVec(name, help string, labels ...string) *metricVec {
+	v := &metricVec{name: name, help: help, typ: "gauge", labels: labels, series: map[string]*series{}}
+	m.register(v)
+	return v
+}
+
+// Add adds delta to the series identified by labelValues, which must be given
+// in the same order as the labels the vector was created with.
+func (v *metricVec) Add(delta float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	s, ok := v.series[key]
+	if !ok {
+		s = &series{labelValues: labelValues}
+		v.series[key] = s
+	}
+	s.value += delta
+}
+
+func (v *metricVec) Inc(labelValues ...string) {
+	v.Add(1, labelValues...)
+}
+
+func (v *metricVec) Dec(labelValues ...string) {
+	v.Add(-1, labelValues...)
+}
+
+// Set sets the series identified by labelValues to value.
+func (v *metricVec) Set(value float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	s, ok := v.series[key]
+	if !ok {
+		s = &series{labelValues: labelValues}
+		v.series[key] = s
+	}
+	s.value = value
+}
+
+func (v *metricVec) writeTo(w io.Writer) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, v.help, v.name, v.typ)
+	for _, key := range sortedKeys(v.series) {
+		s := v.series[key]
+		fmt.Fprintf(w, "%s%s %s\n", v.name, formatLabels(v.labels, s.labelValues), formatFloat(s.value))
+	}
+}
+
+type histogramSeries struct {
+	labelValues []string
+	counts      []uint64
+	count       uint64
+	sum         float64
+}
+
+// histogramVec is a histogram partitioned by a set of labels.
+type histogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+
+	mu     sync.Mutex
+	series map[string]*histogramSeries
+}
+
+// defaultLatencyBuckets are suitable for request latencies in seconds.
+var defaultLatencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+func (m *metricsRegistry) newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	h := &histogramVec{name: name, help: help, labels: labels, buckets: buckets, series: map[string]*histogramSeries{}}
+	m.register(h)
+	return h
+}
+
+// Observe records value in the series identified by labelValues.
+func (h *histogramVec) Observe(value float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{labelValues: labelValues, counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, upper := range h.buckets {
+		if value <= upper {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += value
+}
+
+func (h *histogramVec) writeTo(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	labels := append(append([]string(nil), h.labels...), "le")
+	for _, key := range sortedHistogramKeys(h.series) {
+		s := h.series[key]
+		values := append(append([]string(nil), s.labelValues...), "")
+		for i, upper := range h.buckets {
+			values[len(values)-1] = formatFloat(upper)
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(labels, values), s.counts[i])
+		}
+		values[len(values)-1] = "+Inf"
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(labels, values), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, s.labelValues), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, s.labelValues), s.count)
+	}
+}
+
+func sortedKeys(m map[string]*series) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedHistogramKeys(m map[string]*histogramSeries) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = fmt.Sprintf(`%s="%s"`, name, labelValueEscaper.Replace(values[i]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// Route classes used to partition request metrics.
+const (
+	routeApi         = "api"
+	routeOsApi       = "osapi"
+	routeStatic      = "static"
+	routeConfigJs    = "config.js"
+	routeOAuth       = "oauth"
+	route404Fallback = "404-fallback"
+	routeMetrics     = "metrics"
+	routeHealth      = "health"
+	routeClusters    = "clusters"
+)
+
+// routeClassifier maps a request path onto one of the route classes above.
+type routeClassifier struct {
+	apiPrefix, osApiPrefix, metricsPath string
+	has404Fallback                      bool
+}
+
+func (c *routeClassifier) classify(path string) string {
+	switch {
+	case path == "/osconsole/config.js":
+		return routeConfigJs
+	case path == oauthLoginPath || path == oauthCallbackPath || path == oauthLogoutPath:
+		return routeOAuth
+	case path == "/healthz" || path == "/readyz":
+		return routeHealth
+	case len(c.metricsPath) > 0 && path == c.metricsPath:
+		return routeMetrics
+	case path == "/clusters":
+		return routeClusters
+	}
+	if _, rest, ok := clusterFromPath(path); ok {
+		switch {
+		case strings.HasPrefix(rest, "api/"):
+			return routeApi
+		case strings.HasPrefix(rest, "osapi/"):
+			return routeOsApi
+		}
+	}
+	switch {
+	case len(c.osApiPrefix) > 0 && strings.HasPrefix(path, c.osApiPrefix):
+		return routeOsApi
+	case strings.HasPrefix(path, c.apiPrefix):
+		return routeApi
+	}
+	return routeStatic
+}
+
+// proxyMetrics holds the metrics k8s-proxy reports about itself.
+type proxyMetrics struct {
+	registry        *metricsRegistry
+	requests        *metricVec
+	inFlight        *metricVec
+	upstreamLatency *histogramVec
+
+	upstreamRetries *metricVec
+	breakerOpen     *metricVec
+	masterHealthy   *metricVec
+
+	rateLimited       *metricVec
+	rateLimitInFlight *metricVec
+	rateLimitClients  *metricVec
+}
+
+func newProxyMetrics() *proxyMetrics {
+	r := newMetricsRegistry()
+	return &proxyMetrics{
+		registry:        r,
+		requests:        r.newCounterVec("k8s_proxy_requests_total", "Requests served, by route class, method and status code.", "route", "method", "code"),
+		inFlight:        r.newGaugeVec("k8s_proxy_requests_in_flight", "Requests currently being served, by route class.", "route"),
+		upstreamLatency: r.newHistogramVec("k8s_proxy_upstream_request_duration_seconds", "Latency of requests to the Kubernetes master, by cluster, upstream and method.", defaultLatencyBuckets, "cluster", "upstream", "method"),
+
+		upstreamRetries: r.newCounterVec("k8s_proxy_upstream_retries_total", "Requests to the Kubernetes master retried after a connection error or 503, by cluster.", "cluster"),
+		breakerOpen:     r.newGaugeVec("k8s_proxy_upstream_circuit_breaker_open", "Whether the circuit breaker for the Kubernetes master is open, by cluster.", "cluster"),
+		masterHealthy:   r.newGaugeVec("k8s_proxy_upstream_master_healthy", "Whether each Kubernetes master is healthy and being sent requests, by cluster and master.", "cluster", "master"),
+
+		rateLimited:       r.newCounterVec("k8s_proxy_rate_limited_requests_total", "Requests rejected by the rate limiter, by request class and reason (rate or concurrency).", "class", "reason"),
+		rateLimitInFlight: r.newGaugeVec("k8s_proxy_rate_limit_in_flight", "Requests counted against the per-client in-flight limit, by request class.", "class"),
+		rateLimitClients:  r.newGaugeVec("k8s_proxy_rate_limit_clients", "Clients the rate limiter is tracking."),
+	}
+}
+
+// Instrument counts every request served by h and tracks how many are in flight.
+func (m *proxyMetrics) Instrument(h http.Handler, routes *routeClassifier) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := routes.classify(r.URL.Path)
+		m.inFlight.Inc(route)
+		defer m.inFlight.Dec(route)
+		rec := &responseRecorder{ResponseWriter: w}
+		h.ServeHTTP(rec, r)
+		status := rec.statusCode()
+		if route == routeStatic && status == http.StatusNotFound && routes.has404Fallback {
+			route = route404Fallback
+		}
+		m.requests.Inc(route, r.Method, strconv.Itoa(status))
+	})
+}
+
+// InstrumentTransport records the latency of every round trip made through rt.
+func (m *proxyMetrics) InstrumentTransport(rt http.RoundTripper, cluster, upstream string) http.RoundTripper {
+	return &instrumentedTransport{rt: rt, cluster: cluster, upstream: upstream, latency: m.upstreamLatency}
+}
+
+type instrumentedTransport struct {
+	rt                http.RoundTripper
+	cluster, upstream string
+	latency           *histogramVec
+}
+
+func (t *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.rt.RoundTrip(req)
+	t.latency.Observe(time.Since(start).Seconds(), t.cluster, t.upstream, req.Method)
+	return resp, err
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsTextFormat(t *testing.T) {
+	r := newMetricsRegistry()
+	requests := r.newCounterVec("requests_total", "Requests served.", "route", "code")
+	inFlight := r.newGaugeVec("in_flight", "Requests in flight.")
+	requests.Inc("static", "200")
+	requests.Add(2, "api", "200")
+	requests.Inc("api", `say "hi"`+"\n\\")
+	inFlight.Inc()
+	inFlight.Inc()
+	inFlight.Dec()
+
+	server := httptest.NewServer(r)
+	defer server.Close()
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/plain; version=0.0.4" {
+		t.Errorf("got Content-Type %q", ct)
+	}
+	var body bytes.Buffer
+	body.ReadFrom(resp.Body)
+
+	// Metrics come in registration order & series sorted by label values.
+	want := `# HELP requests_total Requests served.
+# TYPE requests_total counter
+requests_total{route="api",code="200"} 2
+requests_total{route="api",code="say \"hi\"\n\\"} 1
+requests_total{route="static",code="200"} 1
+# HELP in_flight Requests in flight.
+# TYPE in_flight gauge
+in_flight 1
+`
+	if body.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", body.String(), want)
+	}
+}
+
+func TestMetricsHistogramBuckets(t *testing.T) {
+	r := newMetricsRegistry()
+	latency := r.newHistogramVec("latency_seconds", "Latency.", []float64{.1, .5, 1}, "method")
+	for _, v := range []float64{.05, .1, .3, .7, 2} {
+		latency.Observe(v, "GET")
+	}
+	latency.Observe(.2, "POST")
+
+	var buf bytes.Buffer
+	r.Write(&buf)
+	// Buckets are cumulative, each counting observations up to & including
+	// its upper bound.
+	want := `# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{method="GET",le="0.1"} 2
+latency_seconds_bucket{method="GET",le="0.5"} 3
+latency_seconds_bucket{method="GET",le="1"} 4
+latency_seconds_bucket{method="GET",le="+Inf"} 5
+latency_seconds_sum{method="GET"} 3.15
+latency_seconds_count{method="GET"} 5
+latency_seconds_bucket{method="POST",le="0.1"} 0
+latency_seconds_bucket{method="POST",le="0.5"} 1
+latency_seconds_bucket{method="POST",le="1"} 1
+latency_seconds_bucket{method="POST",le="+Inf"} 1
+latency_seconds_sum{method="POST"} 0.2
+latency_seconds_count{method="POST"} 1
+`
+	if buf.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", buf.String(), want)
+	}
+}
+
+func TestRouteClassifier(t *testing.T) {
+	routes := &routeClassifier{apiPrefix: "/api/", osApiPrefix: "/osapi/", metricsPath: "/metrics"}
+	tests := map[string]string{
+		"/api/v1beta3/pods":                    routeApi,
+		"/api/":                                routeApi,
+		"/osapi/v1beta1/builds":                routeOsApi,
+		"/clusters/prod/api/v1beta3/pods":      routeApi,
+		"/clusters/prod/osapi/v1beta1/builds":  routeOsApi,
+		"/clusters/prod/":                      routeStatic,
+		"/clusters":                            routeClusters,
+		"/osconsole/config.js":                 routeConfigJs,
+		"/oauth/login":                         routeOAuth,
+		"/oauth/callback":                      routeOAuth,
+		"/oauth/logout":                        routeOAuth,
+		"/oauth/other":                         routeStatic,
+		"/healthz":                             routeHealth,
+		"/readyz":                              routeHealth,
+		"/metrics":                             routeMetrics,
+		"/":                                    routeStatic,
+		"/osconsole/index.html":                routeStatic,
+		"/apis/extensions/v1beta1/deployments": routeStatic,
+	}
+	for path, want := range tests {
+		if got := routes.classify(path); got != want {
+			t.Errorf("classify(%q) = %q, want %q", path, got, want)
+		}
+	}
+	// Without an OpenShift API or in-band metrics, those paths are static.
+	routes = &routeClassifier{apiPrefix: "/api/"}
+	for _, path := range []string{"/osapi/v1beta1/builds", "/metrics"} {
+		if got := routes.classify(path); got != routeStatic {
+			t.Errorf("classify(%q) = %q, want %q", path, got, routeStatic)
+		}
+	}
+}
+
+func TestMetricsInstrument(t *testing.T) {
+	m := newProxyMetrics()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "DELETE" {
+			http.Error(w, "forbidden", http.StatusForbidden)
+		}
+	})
+	handler := m.Instrument(mux, &routeClassifier{apiPrefix: "/api/", has404Fallback: true})
+	for _, req := range []struct{ method, path string }{
+		{"GET", "/api/v1beta3/pods"},
+		{"GET", "/api/v1beta3/pods"},
+		{"DELETE", "/api/v1beta3/namespaces/web/pods/p1"},
+		{"GET", "/missing"},
+	} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(req.method, req.path, nil))
+	}
+
+	var buf bytes.Buffer
+	m.registry.Write(&buf)
+	for _, line := range []string{
+		`k8s_proxy_requests_total{route="api",method="GET",code="200"} 2`,
+		`k8s_proxy_requests_total{route="api",method="DELETE",code="403"} 1`,
+		// Static 404s are served by the fallback page.
+		`k8s_proxy_requests_total{route="404-fallback",method="GET",code="404"} 1`,
+		`k8s_proxy_requests_in_flight{route="api"} 0`,
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("missing %s in\n%s", line, buf.String())
+		}
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode"
+
+	k8sclient "github.com/GoogleCloudPlatform/kubernetes/pkg/client"
+)
+
+// Paths of the OAuth login flow handled by the proxy.
+const (
+	oauthPrefix       = "/oauth/"
+	oauthLoginPath    = "/oauth/login"
+	oauthCallbackPath = "/oauth/callback"
+	oauthLogoutPath   = "/oauth/logout"
+)
+
+// oauthStateCookie holds the state of a login in progress.
+const oauthStateCookie = "k8s_proxy_oauth_state"
+
+// oauthLoginTimeout is how long a user has to log in with the OAuth server.
+const oauthLoginTimeout = 10 * time.Minute
+
+// loginFlow logs users in & out through the /oauth/ endpoints.
+type loginFlow interface {
+	Login(w http.ResponseWriter, r *http.Request)
+	Callback(w http.ResponseWriter, r *http.Request)
+	Logout(w http.ResponseWriter, r *http.Request)
+}
+
+// oauthLogin runs the OAuth authorization code flow against the OpenShift
+// OAuth server on behalf of the browser, keeping the token it gets in a
+// session cookie rather than handing it to the browser.
+type oauthLogin struct {
+	clientID     string
+	clientSecret string
+	authorizeURI string
+	tokenURI     string
+	redirectURI  string
+	sessions     *sessionCookies
+	client       *http.Client
+}
+
+// oauthState is kept in the state cookie while the user logs in.
+type oauthState struct {
+	State    string `json:"state"`
+	Then     string `json:"then"`
+	Nonce    string `json:"nonce,omitempty"`
+	Verifier string `json:"verifier,omitempty"`
+}
+
+// newOAuthLogin creates an oauthLogin for the client with the secret in
+// clientSecretFile. tokenURI defaults to authorizeURI with its last path
+// segment replaced by token, and redirectURI to /oauth/callback on the host
+// the login was started from.
+func newOAuthLogin(clientID, clientSecretFile, authorizeURI, tokenURI, redirectURI string, sessions *sessionCookies) (*oauthLogin, error) {
+	clientSecret, err := readClientSecret(clientSecretFile)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokenURI) == 0 {
+		u, err := url.Parse(authorizeURI)
+		if err != nil {
+			return nil, err
+		}
+		u.Path = u.Path[:strings.LastIndex(u.Path, "/")+1] + "token"
+		tokenURI = u.String()
+	}
+	return &oauthLogin{
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		authorizeURI: authorizeURI,
+		tokenURI:     tokenURI,
+		redirectURI:  redirectURI,
+		sessions:     sessions,
+		client:       &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+// readClientSecret returns the OAuth client secret in path, if given.
+func readClientSecret(path string) (string, error) {
+	if len(path) == 0 {
+		return "", nil
+	}
+	secret, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(secret)), nil
+}
+
+// trust makes the token exchange trust the same certificates as config, as
+// the OAuth server is normally the master itself.
+func (o *oauthLogin) trust(config *k8sclient.Config) error {
+	tlsConfig, err := k8sclient.TLSConfigFor(config)
+	if err != nil || tlsConfig == nil {
+		return err
+	}
+	o.client.Transport = &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: tlsConfig}
+	return nil
+}
+
+// Login sends the browser to the OAuth server to log in, coming back to the
+// local path in the then parameter afterwards.
+func (o *oauthLogin) Login(w http.ResponseWriter, r *http.Request) {
+	params := url.Values{"client_id": {o.clientID}, "redirect_uri": {callbackURI(r, o.redirectURI)}}
+	beginLogin(w, r, o.sessions, o.authorizeURI, params, &oauthState{})
+}
+
+// Callback exchanges the code the OAuth server sent the browser back with for
+// a token & starts a session with it.
+func (o *oauthLogin) Callback(w http.ResponseWriter, r *http.Request) {
+	state, ok := finishLogin(w, r, o.sessions)
+	if !ok {
+		return
+	}
+	form := url.Values{
+		"code":         {r.URL.Query().Get("code")},
+		"redirect_uri": {callbackURI(r, o.redirectURI)},
+		"client_id":    {o.clientID},
+	}
+	if len(o.clientSecret) > 0 {
+		form.Set("client_secret", o.clientSecret)
+	}
+	token, err := exchangeCode(r.Context(), o.client, o.tokenURI, form)
+	if err != nil {
+		log.Printf("Couldn't get OAuth token: %v", err)
+		http.Error(w, "502 couldn't get a token from the OAuth server", http.StatusBadGateway)
+		return
+	}
+	if err := o.sessions.Set(w, r, &session{Token: token.AccessToken}, token.lifetime()); err != nil {
+		log.Printf("Couldn't start session: %v", err)
+		http.Error(w, "500 internal server error", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, state.Then, http.StatusFound)
+}
+
+// Logout ends the session and sends the browser to the local path in the then
+// parameter.
+func (o *oauthLogin) Logout(w http.ResponseWriter, r *http.Request) {
+	o.sessions.Clear(w, r)
+	http.Redirect(w, r, localPath(r.URL.Query().Get("then")), http.StatusFound)
+}
+
+// localPath returns path if it is a path on this server, so that redirects
+// can't be used to send users elsewhere, and / otherwise. Control characters
+// are rejected outright, as browsers drop tabs & newlines from URLs, turning
+// e.g. "/\t/evil.com" into "//evil.com".
+func localPath(path string) string {
+	if strings.IndexFunc(path, unicode.IsControl) >= 0 {
+		return "/"
+	}
+	if !strings.HasPrefix(path, "/") || strings.HasPrefix(path, "//") || strings.HasPrefix(path, "/\\") {
+		return "/"
+	}
+	if u, err := url.Parse(path); err != nil || len(u.Scheme) > 0 || len(u.Host) > 0 {
+		return "/"
+	}
+	return path
+}
+
+// callbackURI returns the redirect URI for logins started by r: configured if
+// set and /oauth/callback on the requested host otherwise.
+func callbackURI(r *http.Request, configured string) string {
+	if len(configured) > 0 {
+		return configured
+	}
+	scheme := "http"
+	if isSecure(r) {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + oauthCallbackPath
+}
+
+// randomString returns n random bytes, base64url encoded.
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// beginLogin redirects the browser to authorizeURI with params to ask for a
+// code, keeping state, plus a random state parameter & where to go afterwards,
+// in the state cookie for the callback.
+func beginLogin(w http.ResponseWriter, r *http.Request, sessions *sessionCookies, authorizeURI string, params url.Values, state *oauthState) {
+	var err error
+	if state.State, err = randomString(32); err != nil {
+		http.Error(w, "500 internal server error", http.StatusInternalServerError)
+		return
+	}
+	state.Then = localPath(r.URL.Query().Get("then"))
+	if err := sessions.setCookie(w, r, oauthStateCookie, oauthPrefix, state, time.Now().Add(oauthLoginTimeout)); err != nil {
+		log.Printf("Couldn't start login: %v", err)
+		http.Error(w, "500 internal server error", http.StatusInternalServerError)
+		return
+	}
+	params.Set("response_type", "code")
+	params.Set("state", state.State)
+	sep := "?"
+	if strings.Contains(authorizeURI, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, r, authorizeURI+sep+params.Encode(), http.StatusFound)
+}
+
+// finishLogin checks the callback r belongs to a login started by this
+// browser & didn't fail, returning the state kept by beginLogin. Otherwise it
+// responds with an error & returns false.
+func finishLogin(w http.ResponseWriter, r *http.Request, sessions *sessionCookies) (*oauthState, bool) {
+	var state oauthState
+	if err := sessions.getCookie(r, oauthStateCookie, &state); err != nil {
+		http.Error(w, "400 login expired or not started here, please try again", http.StatusBadRequest)
+		return nil, false
+	}
+	clearCookie(w, r, oauthStateCookie, oauthPrefix)
+	q := r.URL.Query()
+	if q.Get("state") != state.State {
+		http.Error(w, "400 login state mismatch, please try again", http.StatusBadRequest)
+		return nil, false
+	}
+	if e := q.Get("error"); len(e) > 0 {
+		log.Printf("Login failed: %s %s", e, q.Get("error_description"))
+		http.Error(w, fmt.Sprintf("403 login failed: %s", e), http.StatusForbidden)
+		return nil, false
+	}
+	return &state, true
+}
+
+// tokenResponse is the response of an OAuth token endpoint.
+type tokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	IDToken          string `json:"id_token"`
+	ExpiresIn        int64  `json:"expires_in"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// lifetime returns how long the access token is valid for, or 0 if the OAuth
+// server didn't say.
+func (t *tokenResponse) lifetime() time.Duration {
+	return time.Duration(t.ExpiresIn) * time.Second
+}
+
+// exchangeCode swaps the authorization code in form, which carries the other
+// parameters the OAuth server wants too, for a token at tokenURI.
+func exchangeCode(ctx context.Context, client *http.Client, tokenURI string, form url.Values) (*tokenResponse, error) {
+	form.Set("grant_type", "authorization_code")
+	req, err := http.NewRequestWithContext(ctx, "POST", tokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var token tokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return nil, fmt.Errorf("%s from %s: %v", resp.Status, tokenURI, err)
+	}
+	if resp.StatusCode != http.StatusOK || len(token.AccessToken) == 0 {
+		return nil, fmt.Errorf("%s from %s: %s %s", resp.Status, tokenURI, token.Error, token.ErrorDescription)
+	}
+	return &token, nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newFakeOAuthServer returns an OAuth server whose token endpoint swaps the
+// code "good" for the access token "t0ken".
+func newFakeOAuthServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/oauth/token" || r.Method != "POST" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.FormValue("grant_type") != "authorization_code" || r.FormValue("client_id") != "proxy" ||
+			r.FormValue("client_secret") != "s3cret" || r.FormValue("code") != "good" ||
+			r.FormValue("redirect_uri") != "http://proxy.example.com/oauth/callback" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant", "error_description": "bad code"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"access_token": "t0ken", "expires_in": 600})
+	}))
+}
+
+func newTestOAuthLogin(t *testing.T, server string) *oauthLogin {
+	dir, err := ioutil.TempDir("", "oauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	secretFile := filepath.Join(dir, "secret")
+	if err := ioutil.WriteFile(secretFile, []byte("s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	o, err := newOAuthLogin("proxy", secretFile, server+"/oauth/authorize", "", "", newTestSessionCookies(t, "0123456789abcdef0123456789abcdef"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return o
+}
+
+// startOAuthLogin starts logging in through o, returning the state cookie &
+// the authorization request the browser was sent to.
+func startOAuthLogin(t *testing.T, o *oauthLogin, then string) (*http.Cookie, url.Values) {
+	w := httptest.NewRecorder()
+	o.Login(w, httptest.NewRequest("GET", "http://proxy.example.com/oauth/login?then="+url.QueryEscape(then), nil))
+	if w.Code != http.StatusFound {
+		t.Fatalf("login: got %d", w.Code)
+	}
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(location.Path, "/oauth/authorize") {
+		t.Fatalf("login redirected to %s", location)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != oauthStateCookie || cookies[0].Path != oauthPrefix || !cookies[0].HttpOnly {
+		t.Fatalf("got state cookies %v", cookies)
+	}
+	return cookies[0], location.Query()
+}
+
+func oauthCallback(o *oauthLogin, cookie *http.Cookie, query string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", "http://proxy.example.com/oauth/callback?"+query, nil)
+	if cookie != nil {
+		r.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	o.Callback(w, r)
+	return w
+}
+
+func TestOAuthLogin(t *testing.T) {
+	server := newFakeOAuthServer(t)
+	defer server.Close()
+	o := newTestOAuthLogin(t, server.URL)
+
+	cookie, params := startOAuthLogin(t, o, "/ui/pods?x=1")
+	if params.Get("client_id") != "proxy" || params.Get("response_type") != "code" ||
+		params.Get("redirect_uri") != "http://proxy.example.com/oauth/callback" || len(params.Get("state")) == 0 {
+		t.Fatalf("got authorization request %v", params)
+	}
+
+	w := oauthCallback(o, cookie, "code=good&state="+params.Get("state"))
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/ui/pods?x=1" {
+		t.Fatalf("callback: got %d %s to %s", w.Code, w.Body, w.Header().Get("Location"))
+	}
+	var sessionCookie *http.Cookie
+	for _, c := range w.Result().Cookies() {
+		switch c.Name {
+		case oauthStateCookie:
+			if c.MaxAge >= 0 {
+				t.Errorf("state cookie not cleared")
+			}
+		case o.sessions.name:
+			sessionCookie = c
+		}
+	}
+	if sessionCookie == nil {
+		t.Fatal("no session cookie set")
+	}
+	// The session lasts as long as the token.
+	if until := time.Until(sessionCookie.Expires); until > 10*time.Minute || until < 9*time.Minute {
+		t.Errorf("session lasts %v, want the token's 10 minutes", until)
+	}
+	r := httptest.NewRequest("GET", "/api/v1beta3/pods", nil)
+	r.AddCookie(sessionCookie)
+	if sess := o.sessions.Get(r); sess == nil || sess.Token != "t0ken" {
+		t.Fatalf("got session %+v", sess)
+	}
+
+	w = httptest.NewRecorder()
+	o.Logout(w, httptest.NewRequest("GET", "http://proxy.example.com/oauth/logout?then=/bye", nil))
+	cookies := w.Result().Cookies()
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/bye" ||
+		len(cookies) != 1 || cookies[0].Name != o.sessions.name || cookies[0].MaxAge >= 0 {
+		t.Errorf("logout: got %d to %s, cookies %v", w.Code, w.Header().Get("Location"), cookies)
+	}
+}
+
+func TestOAuthCallbackErrors(t *testing.T) {
+	server := newFakeOAuthServer(t)
+	defer server.Close()
+	o := newTestOAuthLogin(t, server.URL)
+	cookie, params := startOAuthLogin(t, o, "/")
+	state := params.Get("state")
+
+	expired, err := o.sessions.seal(oauthStateCookie, &oauthState{State: state, Then: "/"}, time.Now().Add(-time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A session cookie can't stand in for the state cookie.
+	session, err := o.sessions.seal(o.sessions.name, &oauthState{State: state, Then: "/"}, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		cookie *http.Cookie
+		query  string
+		status int
+	}{
+		{"no state cookie", nil, "code=good&state=" + state, http.StatusBadRequest},
+		{"expired state cookie", &http.Cookie{Name: oauthStateCookie, Value: expired}, "code=good&state=" + state, http.StatusBadRequest},
+		{"session cookie as state", &http.Cookie{Name: oauthStateCookie, Value: session}, "code=good&state=" + state, http.StatusBadRequest},
+		{"state mismatch", cookie, "code=good&state=other", http.StatusBadRequest},
+		{"login refused", cookie, "error=access_denied&state=" + state, http.StatusForbidden},
+		{"bad code", cookie, "code=bad&state=" + state, http.StatusBadGateway},
+	}
+	for _, test := range tests {
+		if w := oauthCallback(o, test.cookie, test.query); w.Code != test.status {
+			t.Errorf("%s: got %d, want %d", test.name, w.Code, test.status)
+		} else if len(w.Result().Cookies()) > 0 && w.Result().Cookies()[0].Name == o.sessions.name {
+			t.Errorf("%s: started a session", test.name)
+		}
+	}
+}
+
+func TestOAuthLocalPath(t *testing.T) {
+	for path, want := range map[string]string{
+		"/ui/":                "/ui/",
+		"":                    "/",
+		"ui":                  "/",
+		"//evil.example.com":  "/",
+		"/\\evil.example.com": "/",
+		"https://evil.com/":   "/",
+		"/\t/evil.com":        "/",
+		"/\n/evil.com":        "/",
+		"/ui/\r\nX: y":        "/",
+		"/ui/pods?x=1#top":    "/ui/pods?x=1#top",
+	} {
+		if got := localPath(path); got != want {
+			t.Errorf("localPath(%q) = %q, want %q", path, got, want)
+		}
+	}
+
+	o := newTestOAuthLogin(t, "http://oauth.example.com")
+	w := httptest.NewRecorder()
+	o.Logout(w, httptest.NewRequest("GET", "http://proxy.example.com/oauth/logout?then=/%09/evil.com", nil))
+	if location := w.Header().Get("Location"); location != "/" {
+		t.Errorf("logout redirected to %q, want /", location)
+	}
+}
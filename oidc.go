@@ -0,0 +1,313 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// What the proxy sends the master for users logged in with OIDC.
+const (
+	oidcForwardIDToken     = "id-token"
+	oidcForwardImpersonate = "impersonate"
+)
+
+// oidcLogin logs users in with an OpenID Connect provider such as Dex or
+// Keycloak, using the authorization code flow with PKCE, and checks the ID
+// tokens it issues. It then acts as the front door to the API: every request
+// must carry a valid ID token, either in its session or as a bearer token,
+// of a user in the allowed groups & emails. The master is sent the ID token
+// or, when impersonating, the proxy's own credentials plus the user's
+// identity.
+type oidcLogin struct {
+	provider      *oidcProvider
+	clientID      string
+	clientSecret  string
+	scopes        []string
+	redirectURI   string
+	usernameClaim string
+	groupsClaim   string
+	extraClaims   []string
+	allowedGroups []string
+	allowedEmails []string
+	impersonate   bool
+	sessions      *sessionCookies
+	client        *http.Client
+}
+
+// oidcOptions configure an oidcLogin.
+type oidcOptions struct {
+	issuer           string
+	caFile           string
+	clientID         string
+	clientSecretFile string
+	scopes           []string
+	redirectURI      string
+	usernameClaim    string
+	groupsClaim      string
+	extraClaims      []string
+	allowedGroups    []string
+	allowedEmails    []string
+	forward          string
+}
+
+func newOIDCLogin(opts *oidcOptions, sessions *sessionCookies) (*oidcLogin, error) {
+	if len(opts.clientID) == 0 {
+		return nil, fmt.Errorf("an OIDC client ID is needed to log in with %s", opts.issuer)
+	}
+	if opts.forward != oidcForwardIDToken && opts.forward != oidcForwardImpersonate {
+		return nil, fmt.Errorf("unknown OIDC forwarding mode %q, expected %s or %s", opts.forward, oidcForwardIDToken, oidcForwardImpersonate)
+	}
+	clientSecret, err := readClientSecret(opts.clientSecretFile)
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	if len(opts.caFile) > 0 {
+		pem, err := ioutil.ReadFile(opts.caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", opts.caFile)
+		}
+		client.Transport = &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: &tls.Config{RootCAs: pool}}
+	}
+	scopes := opts.scopes
+	if !containsString(scopes, "openid") {
+		scopes = append([]string{"openid"}, scopes...)
+	}
+	return &oidcLogin{
+		provider:      newOIDCProvider(opts.issuer, client),
+		clientID:      opts.clientID,
+		clientSecret:  clientSecret,
+		scopes:        scopes,
+		redirectURI:   opts.redirectURI,
+		usernameClaim: opts.usernameClaim,
+		groupsClaim:   opts.groupsClaim,
+		extraClaims:   opts.extraClaims,
+		allowedGroups: opts.allowedGroups,
+		allowedEmails: opts.allowedEmails,
+		impersonate:   opts.forward == oidcForwardImpersonate,
+		sessions:      sessions,
+		client:        client,
+	}, nil
+}
+
+// Login sends the browser to the OIDC provider to log in, coming back to the
+// local path in the then parameter afterwards.
+func (o *oidcLogin) Login(w http.ResponseWriter, r *http.Request) {
+	metadata, err := o.provider.discover(r.Context())
+	if err != nil {
+		log.Printf("Couldn't discover OIDC issuer: %v", err)
+		http.Error(w, "502 couldn't reach the OIDC provider", http.StatusBadGateway)
+		return
+	}
+	state := &oauthState{}
+	if state.Nonce, err = randomString(32); err == nil {
+		state.Verifier, err = randomString(32)
+	}
+	if err != nil {
+		http.Error(w, "500 internal server error", http.StatusInternalServerError)
+		return
+	}
+	challenge := sha256.Sum256([]byte(state.Verifier))
+	params := url.Values{
+		"client_id":             {o.clientID},
+		"redirect_uri":          {callbackURI(r, o.redirectURI)},
+		"scope":                 {strings.Join(o.scopes, " ")},
+		"nonce":                 {state.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	beginLogin(w, r, o.sessions, metadata.AuthorizationEndpoint, params, state)
+}
+
+// Callback exchanges the code the OIDC provider sent the browser back with
+// for an ID token & starts a session for its user if they are allowed in.
+func (o *oidcLogin) Callback(w http.ResponseWriter, r *http.Request) {
+	state, ok := finishLogin(w, r, o.sessions)
+	if !ok {
+		return
+	}
+	metadata, err := o.provider.discover(r.Context())
+	if err != nil {
+		log.Printf("Couldn't discover OIDC issuer: %v", err)
+		http.Error(w, "502 couldn't reach the OIDC provider", http.StatusBadGateway)
+		return
+	}
+	form := url.Values{
+		"code":          {r.URL.Query().Get("code")},
+		"redirect_uri":  {callbackURI(r, o.redirectURI)},
+		"client_id":     {o.clientID},
+		"code_verifier": {state.Verifier},
+	}
+	if len(o.clientSecret) > 0 {
+		form.Set("client_secret", o.clientSecret)
+	}
+	response, err := exchangeCode(r.Context(), o.client, metadata.TokenEndpoint, form)
+	if err == nil && len(response.IDToken) == 0 {
+		err = fmt.Errorf("no ID token from %s", metadata.TokenEndpoint)
+	}
+	if err != nil {
+		log.Printf("Couldn't get OIDC token: %v", err)
+		http.Error(w, "502 couldn't get a token from the OIDC provider", http.StatusBadGateway)
+		return
+	}
+	token, err := o.provider.verify(r.Context(), response.IDToken, o.clientID)
+	if err == nil && token.Nonce != state.Nonce {
+		err = fmt.Errorf("nonce mismatch")
+	}
+	if err != nil {
+		log.Printf("Invalid ID token from %s: %v", o.provider.issuer, err)
+		http.Error(w, "502 invalid ID token from the OIDC provider", http.StatusBadGateway)
+		return
+	}
+	sess, err := o.session(token)
+	if err != nil {
+		log.Printf("OIDC login refused: %v", err)
+		http.Error(w, "403 forbidden", http.StatusForbidden)
+		return
+	}
+	// The session can outlive the ID token when impersonating, as the master
+	// never sees the token.
+	var lifetime time.Duration
+	if !o.impersonate {
+		lifetime = time.Until(token.Expiry)
+	}
+	if err := o.sessions.Set(w, r, sess, lifetime); err != nil {
+		log.Printf("Couldn't start session: %v", err)
+		http.Error(w, "500 internal server error", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, state.Then, http.StatusFound)
+}
+
+// Logout ends the session and sends the browser to the local path in the then
+// parameter.
+func (o *oidcLogin) Logout(w http.ResponseWriter, r *http.Request) {
+	o.sessions.Clear(w, r)
+	http.Redirect(w, r, localPath(r.URL.Query().Get("then")), http.StatusFound)
+}
+
+// session returns the session for the user token was issued to, or an error
+// if they aren't allowed in.
+func (o *oidcLogin) session(token *idToken) (*session, error) {
+	sess := &session{Groups: token.stringsClaim(o.groupsClaim)}
+	if !token.claim(o.usernameClaim, &sess.User) || len(sess.User) == 0 {
+		return nil, fmt.Errorf("no %s claim in ID token", o.usernameClaim)
+	}
+	var verified = true
+	token.claim("email_verified", &verified)
+	if token.claim("email", &sess.Email) && !verified {
+		sess.Email = ""
+	}
+	if o.impersonate {
+		for _, claim := range o.extraClaims {
+			if values := token.stringsClaim(claim); len(values) > 0 {
+				if sess.Extra == nil {
+					sess.Extra = make(map[string][]string)
+				}
+				sess.Extra[claim] = values
+			}
+		}
+	} else {
+		sess.Token = token.Raw
+	}
+	return sess, o.allow(sess)
+}
+
+// allow returns an error unless the user of sess is in one of the allowed
+// groups and has one of the allowed emails, where either is restricted.
+func (o *oidcLogin) allow(sess *session) error {
+	if len(o.allowedGroups) > 0 {
+		allowed := false
+		for _, group := range sess.Groups {
+			allowed = allowed || containsString(o.allowedGroups, group)
+		}
+		if !allowed {
+			return fmt.Errorf("%s is not in any allowed group", sess.User)
+		}
+	}
+	if len(o.allowedEmails) > 0 {
+		allowed := false
+		for _, email := range o.allowedEmails {
+			if strings.HasPrefix(email, "@") {
+				allowed = allowed || strings.HasSuffix(strings.ToLower(sess.Email), strings.ToLower(email))
+			} else {
+				allowed = allowed || strings.EqualFold(sess.Email, email)
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("%s does not have an allowed (verified) email", sess.User)
+		}
+	}
+	return nil
+}
+
+// Wrap lets through only requests from allowed users, with a session or an
+// ID token as their bearer token, passing on the ID token or the user's
+// identity. Neither the session cookie nor any other credentials are sent to
+// the master.
+func (o *oidcLogin) Wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sess, err := o.authenticate(r)
+		if sess == nil {
+			if err != nil {
+				log.Printf("OIDC authentication failed: %v", err)
+			}
+			w.Header().Set("WWW-Authenticate", `Bearer realm="k8s-proxy"`)
+			http.Error(w, "401 unauthorized", http.StatusUnauthorized)
+			return
+		}
+		removeCookie(r, o.sessions.name)
+		stripWebSocketToken(r)
+		if o.impersonate {
+			r.Header.Del("Authorization")
+			r = setIdentity(r, &identity{Name: sess.User, Groups: sess.Groups, Extra: sess.Extra})
+		} else {
+			r.Header.Set("Authorization", "Bearer "+sess.Token)
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// authenticate returns the session of the user making r: from the ID token
+// it carries as a bearer token if any and from its session cookie otherwise.
+func (o *oidcLogin) authenticate(r *http.Request) (*session, error) {
+	raw := webSocketToken(r)
+	if auth := r.Header.Get("Authorization"); len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		raw = strings.TrimSpace(auth[7:])
+	}
+	if len(raw) > 0 {
+		token, err := o.provider.verify(r.Context(), raw, o.clientID)
+		if err != nil {
+			return nil, err
+		}
+		sess, err := o.session(token)
+		if err != nil {
+			return nil, err
+		}
+		// Bearer tokens are always what the user presented.
+		sess.Token = raw
+		return sess, nil
+	}
+	sess := o.sessions.Get(r)
+	if sess == nil {
+		return nil, nil
+	}
+	// The allowed groups & emails may have changed since the user logged in.
+	if err := o.allow(sess); err != nil {
+		return nil, err
+	}
+	return sess, nil
+}
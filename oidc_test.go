@@ -0,0 +1,415 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testKey is a signing key of the fake issuer.
+type testKey struct {
+	id  string
+	alg string
+	key crypto.Signer
+}
+
+func newTestRSAKey(t *testing.T, id string) *testKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testKey{id: id, alg: "RS256", key: key}
+}
+
+func newTestECKey(t *testing.T, id string) *testKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testKey{id: id, alg: "ES256", key: key}
+}
+
+// jwk returns k as a JSON web key, restricted to keyAlg if it isn't empty.
+func (k *testKey) jwk(keyAlg string) map[string]string {
+	jwk := map[string]string{"kid": k.id, "use": "sig"}
+	if len(keyAlg) > 0 {
+		jwk["alg"] = keyAlg
+	}
+	switch key := k.key.Public().(type) {
+	case *rsa.PublicKey:
+		jwk["kty"] = "RSA"
+		jwk["n"] = base64.RawURLEncoding.EncodeToString(key.N.Bytes())
+		jwk["e"] = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes())
+	case *ecdsa.PublicKey:
+		jwk["kty"] = "EC"
+		jwk["crv"] = "P-256"
+		jwk["x"] = base64.RawURLEncoding.EncodeToString(key.X.Bytes())
+		jwk["y"] = base64.RawURLEncoding.EncodeToString(key.Y.Bytes())
+	}
+	return jwk
+}
+
+// sign returns a JWT of claims signed by k, with alg & kid in its header.
+func (k *testKey) sign(t *testing.T, alg string, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": k.id, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	var signature []byte
+	var err error
+	switch key := k.key.(type) {
+	case *rsa.PrivateKey:
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, key, digest[:])
+		signature = make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// fakeIssuer is an OpenID Connect provider serving discovery, its keys & a
+// token endpoint that checks PKCE.
+type fakeIssuer struct {
+	*httptest.Server
+	t *testing.T
+
+	mu          sync.Mutex
+	keys        []map[string]string
+	signer      *testKey
+	maxAge      int
+	jwksFetches int
+	jwksDown    bool
+	// grants are the codes issued, with the code challenge & nonce of the
+	// login each was issued for.
+	grants map[string]fakeGrant
+	// claims, if set, changes the claims of the ID tokens issued.
+	claims func(map[string]interface{})
+}
+
+type fakeGrant struct {
+	challenge, nonce string
+}
+
+func newFakeIssuer(t *testing.T, signer *testKey) *fakeIssuer {
+	f := &fakeIssuer{t: t, signer: signer, keys: []map[string]string{signer.jwk("")}, grants: map[string]fakeGrant{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 f.URL,
+			"authorization_endpoint": f.URL + "/authorize",
+			"token_endpoint":         f.URL + "/token",
+			"jwks_uri":               f.URL + "/keys",
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.jwksFetches++
+		if f.jwksDown {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		if f.maxAge > 0 {
+			w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", f.maxAge))
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": f.keys})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		grant, ok := f.grants[r.FormValue("code")]
+		delete(f.grants, r.FormValue("code"))
+		verifier := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+		if !ok || r.FormValue("grant_type") != "authorization_code" || r.FormValue("client_id") != "proxy" ||
+			base64.RawURLEncoding.EncodeToString(verifier[:]) != grant.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		claims := f.idClaims()
+		claims["nonce"] = grant.nonce
+		if f.claims != nil {
+			f.claims(claims)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "access",
+			"id_token":     f.signer.sign(t, f.signer.alg, claims),
+			"expires_in":   3600,
+		})
+	})
+	f.Server = httptest.NewServer(mux)
+	return f
+}
+
+// authorize issues a code for the login the proxy redirected to location.
+func (f *fakeIssuer) authorize(location string) (code, state string) {
+	u, err := url.Parse(location)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	q := u.Query()
+	if u.Path != "/authorize" || q.Get("code_challenge_method") != "S256" || len(q.Get("code_challenge")) == 0 ||
+		q.Get("response_type") != "code" || !strings.Contains(q.Get("scope"), "openid") {
+		f.t.Fatalf("bad authorization request %s", location)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	code = fmt.Sprintf("code-%d", len(f.grants)+1)
+	f.grants[code] = fakeGrant{challenge: q.Get("code_challenge"), nonce: q.Get("nonce")}
+	return code, q.Get("state")
+}
+
+// idClaims returns the claims of a valid ID token for the proxy.
+func (f *fakeIssuer) idClaims() map[string]interface{} {
+	now := time.Now()
+	return map[string]interface{}{
+		"iss":    f.URL,
+		"sub":    "1234",
+		"aud":    "proxy",
+		"exp":    now.Add(time.Hour).Unix(),
+		"iat":    now.Unix(),
+		"email":  "jo@example.com",
+		"groups": []string{"admins"},
+	}
+}
+
+func (f *fakeIssuer) fetches() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.jwksFetches
+}
+
+func TestOIDCVerify(t *testing.T) {
+	rsaKey := newTestRSAKey(t, "rsa")
+	ecKey := newTestECKey(t, "ec")
+	restricted := newTestRSAKey(t, "rs512-only")
+	issuer := newFakeIssuer(t, rsaKey)
+	defer issuer.Close()
+	issuer.keys = append(issuer.keys, ecKey.jwk(""), restricted.jwk("RS512"))
+	provider := newOIDCProvider(issuer.URL, http.DefaultClient)
+
+	with := func(changes map[string]interface{}) map[string]interface{} {
+		claims := issuer.idClaims()
+		for name, value := range changes {
+			if value == nil {
+				delete(claims, name)
+			} else {
+				claims[name] = value
+			}
+		}
+		return claims
+	}
+	unsigned := func(alg string, claims map[string]interface{}) string {
+		header, _ := json.Marshal(map[string]string{"alg": alg, "kid": "rsa"})
+		payload, _ := json.Marshal(claims)
+		return base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload) + "."
+	}
+	// An HS256 token "signed" with the issuer's public key, which a verifier
+	// confusing the two would accept.
+	hmacToken := func() string {
+		header, _ := json.Marshal(map[string]string{"alg": "HS256", "kid": "rsa"})
+		payload, _ := json.Marshal(issuer.idClaims())
+		signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+		public, _ := x509.MarshalPKIXPublicKey(rsaKey.key.Public())
+		mac := hmac.New(sha256.New, public)
+		mac.Write([]byte(signed))
+		return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+	}
+	tampered := func() string {
+		parts := strings.Split(rsaKey.sign(t, "RS256", issuer.idClaims()), ".")
+		payload, _ := json.Marshal(with(map[string]interface{}{"sub": "admin"}))
+		return parts[0] + "." + base64.RawURLEncoding.EncodeToString(payload) + "." + parts[2]
+	}
+	hour := time.Hour
+
+	tests := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"RS256", rsaKey.sign(t, "RS256", issuer.idClaims()), true},
+		{"ES256", ecKey.sign(t, "ES256", issuer.idClaims()), true},
+		{"audience list", rsaKey.sign(t, "RS256", with(map[string]interface{}{"aud": []string{"other", "proxy"}})), true},
+		{"matching azp", rsaKey.sign(t, "RS256", with(map[string]interface{}{"aud": []string{"other", "proxy"}, "azp": "proxy"})), true},
+		{"expired within leeway", rsaKey.sign(t, "RS256", with(map[string]interface{}{"exp": time.Now().Add(-idTokenLeeway / 2).Unix()})), true},
+		{"past nbf", rsaKey.sign(t, "RS256", with(map[string]interface{}{"nbf": time.Now().Add(-hour).Unix()})), true},
+
+		{"alg none", unsigned("none", issuer.idClaims()), false},
+		{"alg None", unsigned("None", issuer.idClaims()), false},
+		{"HS256 with the public key", hmacToken(), false},
+		{"RSA key as ES256", rsaKey.sign(t, "ES256", issuer.idClaims()), false},
+		{"EC key as RS256", ecKey.sign(t, "RS256", issuer.idClaims()), false},
+		{"key restricted to another alg", restricted.sign(t, "RS256", issuer.idClaims()), false},
+		{"unknown key", newTestRSAKey(t, "rsa").sign(t, "RS256", issuer.idClaims()), false},
+		{"tampered payload", tampered(), false},
+		{"not a JWT", "abc.def", false},
+		{"wrong issuer", rsaKey.sign(t, "RS256", with(map[string]interface{}{"iss": "https://evil.example.com"})), false},
+		{"wrong audience", rsaKey.sign(t, "RS256", with(map[string]interface{}{"aud": "other"})), false},
+		{"no audience", rsaKey.sign(t, "RS256", with(map[string]interface{}{"aud": nil})), false},
+		{"other azp", rsaKey.sign(t, "RS256", with(map[string]interface{}{"aud": []string{"other", "proxy"}, "azp": "other"})), false},
+		{"expired", rsaKey.sign(t, "RS256", with(map[string]interface{}{"exp": time.Now().Add(-2 * idTokenLeeway).Unix()})), false},
+		{"no expiry", rsaKey.sign(t, "RS256", with(map[string]interface{}{"exp": nil})), false},
+		{"future nbf", rsaKey.sign(t, "RS256", with(map[string]interface{}{"nbf": time.Now().Add(hour).Unix()})), false},
+	}
+	for _, test := range tests {
+		token, err := provider.verify(context.Background(), test.token, "proxy")
+		if test.ok && err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if !test.ok && err == nil {
+			t.Errorf("%s: verified %v", test.name, token.claims)
+		}
+	}
+}
+
+func TestOIDCKeyRotation(t *testing.T) {
+	oldKey := newTestRSAKey(t, "old")
+	newKey := newTestECKey(t, "new")
+	issuer := newFakeIssuer(t, oldKey)
+	defer issuer.Close()
+	issuer.maxAge = 600
+	provider := newOIDCProvider(issuer.URL, http.DefaultClient)
+	verify := func(key *testKey) error {
+		_, err := provider.verify(context.Background(), key.sign(t, key.alg, issuer.idClaims()), "proxy")
+		return err
+	}
+
+	if err := verify(oldKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := verify(oldKey); err != nil || issuer.fetches() != 1 {
+		t.Fatalf("got %v after %d fetches, want the keys cached", err, issuer.fetches())
+	}
+	if provider.keysExpire.Sub(provider.keysFetched) != 600*time.Second {
+		t.Errorf("keys cached for %v, want the issuer's max-age", provider.keysExpire.Sub(provider.keysFetched))
+	}
+
+	// The issuer rotates its keys. Unknown keys only make the proxy fetch the
+	// keys again every so often, so that bad tokens can't hammer the issuer.
+	issuer.mu.Lock()
+	issuer.keys = []map[string]string{newKey.jwk("")}
+	issuer.mu.Unlock()
+	if err := verify(newKey); err == nil || issuer.fetches() != 1 {
+		t.Fatalf("got %v after %d fetches, want no refetch so soon", err, issuer.fetches())
+	}
+	provider.keysFetched = provider.keysFetched.Add(-jwksMinRefresh)
+	if err := verify(newKey); err != nil || issuer.fetches() != 2 {
+		t.Fatalf("got %v after %d fetches, want the new key fetched", err, issuer.fetches())
+	}
+	if err := verify(oldKey); err == nil {
+		t.Errorf("token signed with a rotated out key verified")
+	}
+
+	// Expired keys are fetched again, but kept if the issuer can't be reached.
+	issuer.mu.Lock()
+	issuer.jwksDown = true
+	issuer.mu.Unlock()
+	provider.keysExpire = time.Now().Add(-time.Second)
+	if err := verify(newKey); err != nil || issuer.fetches() != 3 {
+		t.Fatalf("got %v after %d fetches, want the old keys used", err, issuer.fetches())
+	}
+}
+
+// testOIDCLogin logs in through o with issuer, returning the callback's
+// response. other & otherState, if set, replace the state cookie & parameter
+// of the login with those of another.
+func testOIDCLogin(t *testing.T, o *oidcLogin, issuer *fakeIssuer, other *http.Cookie, otherState string) *httptest.ResponseRecorder {
+	login := httptest.NewRecorder()
+	o.Login(login, httptest.NewRequest("GET", "http://proxy.example.com/oauth/login?then=/ui/", nil))
+	if login.Code != http.StatusFound {
+		t.Fatalf("login: got %d", login.Code)
+	}
+	code, state := issuer.authorize(login.Header().Get("Location"))
+	cookie := login.Result().Cookies()[0]
+	if other != nil {
+		cookie, state = other, otherState
+	}
+	callback := httptest.NewRequest("GET", "http://proxy.example.com/oauth/callback?code="+code+"&state="+state, nil)
+	callback.AddCookie(cookie)
+	rec := httptest.NewRecorder()
+	o.Callback(rec, callback)
+	return rec
+}
+
+func TestOIDCLogin(t *testing.T) {
+	key := newTestRSAKey(t, "rsa")
+	issuer := newFakeIssuer(t, key)
+	defer issuer.Close()
+	sessions, err := newSessionCookies("session", "", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o, err := newOIDCLogin(&oidcOptions{
+		issuer:        issuer.URL,
+		clientID:      "proxy",
+		usernameClaim: "email",
+		groupsClaim:   "groups",
+		allowedGroups: []string{"admins"},
+		forward:       oidcForwardIDToken,
+	}, sessions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := testOIDCLogin(t, o, issuer, nil, "")
+	if rec.Code != http.StatusFound || rec.Header().Get("Location") != "/ui/" {
+		t.Fatalf("callback: got %d %s", rec.Code, rec.Body)
+	}
+	var sessionCookie *http.Cookie
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.Name == "session" {
+			sessionCookie = cookie
+		}
+	}
+	if sessionCookie == nil {
+		t.Fatal("no session cookie set")
+	}
+	r := httptest.NewRequest("GET", "/api/v1beta3/pods", nil)
+	r.AddCookie(sessionCookie)
+	sess := sessions.Get(r)
+	if sess == nil || sess.User != "jo@example.com" || len(sess.Token) == 0 {
+		t.Fatalf("got session %+v", sess)
+	}
+
+	// The code of one login can't be redeemed with the verifier of another.
+	first := httptest.NewRecorder()
+	o.Login(first, httptest.NewRequest("GET", "http://proxy.example.com/oauth/login", nil))
+	_, firstState := issuer.authorize(first.Header().Get("Location"))
+	if rec := testOIDCLogin(t, o, issuer, first.Result().Cookies()[0], firstState); rec.Code != http.StatusBadGateway {
+		t.Errorf("code redeemed with another login's verifier: got %d", rec.Code)
+	}
+
+	// Nor can an ID token from another login be used in its place.
+	issuer.claims = func(claims map[string]interface{}) { claims["nonce"] = "replayed" }
+	if rec := testOIDCLogin(t, o, issuer, nil, ""); rec.Code != http.StatusBadGateway {
+		t.Errorf("ID token with the wrong nonce: got %d", rec.Code)
+	}
+
+	// Users outside the allowed groups aren't let in.
+	issuer.claims = func(claims map[string]interface{}) { claims["groups"] = []string{"devs"} }
+	if rec := testOIDCLogin(t, o, issuer, nil, ""); rec.Code != http.StatusForbidden {
+		t.Errorf("user outside the allowed groups: got %d", rec.Code)
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/GoogleCloudPlatform/kubernetes/pkg/api"
+	"github.com/ghodss/yaml"
+)
+
+const (
+	policyAllow = "allow"
+	policyDeny  = "deny"
+)
+
+// PolicyRule matches API requests by path prefix, namespace, resource & verb.
+// An empty list matches anything; otherwise entries may be exact values, "*"
+// or a prefix ending in "*". Requests allowed by a rule with Unredacted set
+// are exempt from --redact.
+type PolicyRule struct {
+	Paths      []string `json:"paths,omitempty"`
+	Namespaces []string `json:"namespaces,omitempty"`
+	Resources  []string `json:"resources,omitempty"`
+	Verbs      []string `json:"verbs,omitempty"`
+	Action     string   `json:"action"`
+	Unredacted bool     `json:"unredacted,omitempty"`
+}
+
+// Policy decides which API requests are forwarded to the master. Rules are
+// checked in order and the first match wins; requests matching no rule get
+// the default action.
+type Policy struct {
+	Default string       `json:"default,omitempty"`
+	Rules   []PolicyRule `json:"rules"`
+}
+
+// loadPolicy reads a YAML or JSON policy file.
+func loadPolicy(path string) (*Policy, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parsePolicy(data, path)
+}
+
+// parsePolicy parses a YAML or JSON policy read from path.
+func parsePolicy(data []byte, path string) (*Policy, error) {
+	var p Policy
+	if err := yaml.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("couldn't parse policy %s: %v", path, err)
+	}
+	if len(p.Default) == 0 {
+		p.Default = policyAllow
+	}
+	if p.Default != policyAllow && p.Default != policyDeny {
+		return nil, fmt.Errorf("invalid default action %q in policy %s", p.Default, path)
+	}
+	for i, rule := range p.Rules {
+		if rule.Action != policyAllow && rule.Action != policyDeny {
+			return nil, fmt.Errorf("invalid action %q for rule %d in policy %s", rule.Action, i+1, path)
+		}
+	}
+	return &p, nil
+}
+
+func (rule *PolicyRule) matches(path string, a *apiRequest) bool {
+	return matchesAny(rule.Paths, path, func(pattern, value string) bool { return strings.HasPrefix(value, pattern) }) &&
+		matchesAny(rule.Namespaces, a.Namespace, matchNamespace) &&
+		matchesAny(rule.Resources, a.Resource, matchPattern) &&
+		matchesAny(rule.Verbs, a.Verb, matchPattern)
+}
+
+// Decide returns the rule matching the request for path described by a, or
+// nil if none do, along with whether the request is allowed.
+func (p *Policy) Decide(path string, a *apiRequest) (*PolicyRule, bool) {
+	for i := range p.Rules {
+		if rule := &p.Rules[i]; rule.matches(path, a) {
+			return rule, rule.Action == policyAllow
+		}
+	}
+	return nil, p.Default == policyAllow
+}
+
+func (p *Policy) describeRule(rule *PolicyRule) string {
+	for i := range p.Rules {
+		if rule == &p.Rules[i] {
+			return fmt.Sprintf("rule %d", i+1)
+		}
+	}
+	return "default"
+}
+
+func matchesAny(patterns []string, value string, match func(pattern, value string) bool) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if match(pattern, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchPattern compares case-insensitively, as v1beta1 & v1beta2 use
+// camelCase resource names where v1beta3 uses lower case.
+func matchPattern(pattern, value string) bool {
+	switch {
+	case pattern == "*":
+		return true
+	case strings.HasSuffix(pattern, "*"):
+		prefix := pattern[:len(pattern)-1]
+		return len(value) >= len(prefix) && strings.EqualFold(value[:len(prefix)], prefix)
+	}
+	return strings.EqualFold(pattern, value)
+}
+
+// matchNamespace is matchPattern, except that requests across all namespaces,
+// or for resources outside any, only match "*".
+func matchNamespace(pattern, value string) bool {
+	if len(value) == 0 {
+		return pattern == "*"
+	}
+	return matchPattern(pattern, value)
+}
+
+// Enforce rejects requests to h that p doesn't allow with a 403 Status.
+func (p *Policy) Enforce(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a := parseApiRequest(r)
+		path := requestPath(r)
+		rule, ok := p.Decide(path, a)
+		if !ok {
+			log.Printf("Policy (%s) denied %s %s: verb=%s namespace=%s resource=%s user=%s",
+				p.describeRule(rule), r.Method, path, a.Verb, a.Namespace, a.Resource, accessLogUsername(r))
+			writeStatus(w, http.StatusForbidden, api.StatusReasonForbidden,
+				fmt.Sprintf("%s %s is forbidden by proxy policy", a.Verb, describeResource(a)))
+			return
+		}
+		if rule != nil && rule.Unredacted {
+			r = exemptFromRedaction(r)
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// reloadablePolicy is the policy in force, if any, which a config reload may
+// replace while requests are being served.
+type reloadablePolicy struct {
+	mu     sync.RWMutex
+	policy *Policy
+}
+
+func (rp *reloadablePolicy) get() *Policy {
+	rp.mu.RLock()
+	defer rp.mu.RUnlock()
+	return rp.policy
+}
+
+func (rp *reloadablePolicy) set(p *Policy) {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	rp.policy = p
+}
+
+// Enforce rejects requests to h that the current policy doesn't allow, and
+// lets everything through while there is no policy.
+func (rp *reloadablePolicy) Enforce(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p := rp.get(); p != nil {
+			p.Enforce(h).ServeHTTP(w, r)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// requestPath returns the path of r as originally requested, before any
+// prefixes were stripped.
+func requestPath(r *http.Request) string {
+	if u, err := url.ParseRequestURI(r.RequestURI); err == nil {
+		return u.Path
+	}
+	return r.URL.Path
+}
+
+func describeResource(a *apiRequest) string {
+	desc := a.Resource
+	if len(desc) == 0 {
+		desc = "the API"
+	}
+	if len(a.Name) > 0 {
+		desc += " " + a.Name
+	}
+	if len(a.Namespace) > 0 {
+		desc += " in namespace " + a.Namespace
+	}
+	return desc
+}
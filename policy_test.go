@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestPolicyNamespaces(t *testing.T) {
+	policy := &Policy{Default: policyAllow, Rules: []PolicyRule{
+		{Namespaces: []string{"kube-system"}, Verbs: []string{verbDelete}, Action: policyDeny},
+		{Namespaces: []string{"default"}, Verbs: []string{verbDelete}, Action: policyDeny},
+		{Namespaces: []string{"web-*"}, Verbs: []string{verbList}, Action: policyDeny},
+		{Namespaces: []string{""}, Verbs: []string{verbUpdate}, Action: policyDeny},
+		{Namespaces: []string{"*"}, Verbs: []string{verbCreate}, Action: policyDeny},
+	}}
+	tests := []struct {
+		method, url string
+		allowed     bool
+	}{
+		{"DELETE", "/v1beta3/namespaces/kube-system", false},
+		{"DELETE", "/v1beta3/namespaces/kube-system/pods/p1", false},
+		{"DELETE", "/v1beta1/pods/p1?namespace=kube-system", false},
+		{"DELETE", "/v1beta1/pods/p1", false},
+		{"DELETE", "/v1beta3/namespaces/web/pods/p1", true},
+		{"GET", "/v1beta3/namespaces/web-1/pods", false},
+		{"GET", "/v1beta3/pods", true},
+		{"PUT", "/v1beta3/nodes/n1", true},
+		{"POST", "/v1beta3/pods", false},
+		{"POST", "/v1beta3/namespaces/web/pods", false},
+	}
+	for _, test := range tests {
+		r, err := http.NewRequest(test.method, test.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, allowed := policy.Decide(r.URL.Path, parseApiRequest(r)); allowed != test.allowed {
+			t.Errorf("%s %s: got allowed %v, want %v", test.method, test.url, allowed, test.allowed)
+		}
+	}
+
+	// Allowing the default namespace doesn't allow legacy lists & watches
+	// across all namespaces.
+	policy = &Policy{Default: policyDeny, Rules: []PolicyRule{
+		{Namespaces: []string{"default"}, Action: policyAllow},
+	}}
+	tests = []struct {
+		method, url string
+		allowed     bool
+	}{
+		{"GET", "/v1beta1/secrets?namespace=", false},
+		{"GET", "/v1beta1/secrets", false},
+		{"GET", "/v1beta2/watch/secrets", false},
+		{"GET", "/v1beta1/secrets?namespace=default", true},
+		{"GET", "/v1beta1/secrets/s1", true},
+		{"POST", "/v1beta1/pods", true},
+	}
+	for _, test := range tests {
+		r, err := http.NewRequest(test.method, test.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, allowed := policy.Decide(r.URL.Path, parseApiRequest(r)); allowed != test.allowed {
+			t.Errorf("%s %s: got allowed %v, want %v", test.method, test.url, allowed, test.allowed)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+
+	k8sclient "github.com/GoogleCloudPlatform/kubernetes/pkg/client"
+	"github.com/GoogleCloudPlatform/kubernetes/pkg/kubectl"
+)
+
+// newApiProxy creates a kubectl.ProxyServer for the Kubernetes API described by
+// cfg. Unlike kubectl.NewProxyServer it does not register itself anywhere, so
+// callers are free to wrap it before adding it to a mux.
+func newApiProxy(cfg *k8sclient.Config) (*kubectl.ProxyServer, error) {
+	prefix := cfg.Prefix
+	if prefix == "" {
+		prefix = "/api"
+	}
+	target, err := url.Parse(singleJoiningSlash(cfg.Host, prefix))
+	if err != nil {
+		return nil, err
+	}
+	transport, err := k8sclient.TransportFor(cfg)
+	if err != nil {
+		return nil, err
+	}
+	director := func(req *http.Request) {
+		req.URL.Scheme = target.Scheme
+		req.URL.Host = target.Host
+		req.URL.Path = singleJoiningSlash(target.Path, req.URL.Path)
+	}
+	return &kubectl.ProxyServer{
+		ReverseProxy: httputil.ReverseProxy{Director: director, Transport: transport},
+	}, nil
+}
+
+// newOsApiProxy creates a reverse proxy for the OpenShift API on the master
+// described by cfg.
+func newOsApiProxy(cfg *k8sclient.Config) (*httputil.ReverseProxy, error) {
+	master, err := url.Parse(cfg.Host)
+	if err != nil {
+		return nil, err
+	}
+	transport, err := k8sclient.TransportFor(cfg)
+	if err != nil {
+		return nil, err
+	}
+	proxy := httputil.NewSingleHostReverseProxy(&url.URL{
+		Scheme: master.Scheme,
+		Host:   master.Host,
+		Path:   "/osapi/",
+	})
+	proxy.Transport = transport
+	return proxy, nil
+}
+
+// isWatchRequest returns true if r is for a watch stream, using either the
+// watch=true query parameter or the watch/ path prefix of v1beta1-3.
+func isWatchRequest(r *http.Request) bool {
+	if r.URL.Query().Get("watch") == "true" {
+		return true
+	}
+	for _, segment := range strings.Split(strings.Trim(r.URL.Path, "/"), "/") {
+		if segment == "watch" {
+			return true
+		}
+	}
+	return false
+}
+
+func singleJoiningSlash(a, b string) string {
+	aslash := strings.HasSuffix(a, "/")
+	bslash := strings.HasPrefix(b, "/")
+	switch {
+	case aslash && bslash:
+		return a + b[1:]
+	case !aslash && !bslash:
+		return a + "/" + b
+	}
+	return a + b
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/kubernetes/pkg/api"
+)
+
+// statusReasonTooManyRequests is the reason the master gives when it throttles
+// a request, which this version of the API types doesn't define.
+const statusReasonTooManyRequests api.StatusReason = "TooManyRequests"
+
+// Classes of request that are rate limited separately.
+const (
+	rateClassRead  = "read"
+	rateClassWrite = "write"
+	rateClassWatch = "watch"
+	rateClassOsApi = "osapi"
+)
+
+// How clients are told apart for --rate-limit-by.
+const (
+	RateLimitByUser = "user"
+	RateLimitByIP   = "ip"
+)
+
+// rateLimitIdle is how long a client's limiter state is kept after its last
+// request.
+const rateLimitIdle = 10 * time.Minute
+
+// rateLimit is a token bucket's refill rate per second & capacity.
+type rateLimit struct {
+	rate  float64
+	burst float64
+}
+
+// newRateLimit returns the limit of rate requests per second with bursts of
+// up to burst, which defaults to the rate (but at least 1) if not positive.
+func newRateLimit(rate float64, burst int) rateLimit {
+	if burst <= 0 {
+		burst = int(math.Max(1, math.Ceil(rate)))
+	}
+	return rateLimit{rate: rate, burst: float64(burst)}
+}
+
+// rateLimiter limits how fast each client can make requests of each class,
+// with a token bucket per client & class, and how many requests each client
+// can have in flight at once. Watches & other long-running requests only
+// count against their rate, as otherwise a client's open watches would use
+// up its in-flight allowance.
+type rateLimiter struct {
+	limits      map[string]rateLimit
+	maxInFlight int
+	byUser      bool
+	metrics     *proxyMetrics
+
+	mu      sync.Mutex
+	clients map[string]*clientLimits
+}
+
+// clientLimits is the limiter state of one client.
+type clientLimits struct {
+	buckets  map[string]*tokenBucket
+	inFlight int
+	lastSeen time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter creates a rateLimiter for the limits of each class, where a
+// class without a limit is unlimited, and tells clients apart by by.
+func newRateLimiter(limits map[string]rateLimit, maxInFlight int, by string, metrics *proxyMetrics) (*rateLimiter, error) {
+	if err := checkRateLimitBy(by); err != nil {
+		return nil, err
+	}
+	l := &rateLimiter{
+		limits:      limits,
+		maxInFlight: maxInFlight,
+		byUser:      by == RateLimitByUser,
+		metrics:     metrics,
+		clients:     make(map[string]*clientLimits),
+	}
+	go l.expire()
+	return l, nil
+}
+
+func checkRateLimitBy(by string) error {
+	if by != RateLimitByUser && by != RateLimitByIP {
+		return fmt.Errorf("unknown rate limit key %q, expected %s or %s", by, RateLimitByUser, RateLimitByIP)
+	}
+	return nil
+}
+
+// update replaces the limits, as on a config reload. Clients keep the tokens
+// they have left, up to any new burst, and their requests in flight.
+func (l *rateLimiter) update(limits map[string]rateLimit, maxInFlight int, by string) error {
+	if err := checkRateLimitBy(by); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limits, l.maxInFlight, l.byUser = limits, maxInFlight, by == RateLimitByUser
+	return nil
+}
+
+// key returns the client making r: the authenticated user if limiting by user
+// & there is one, otherwise the address it connected from.
+func (l *rateLimiter) key(r *http.Request) string {
+	l.mu.Lock()
+	byUser := l.byUser
+	l.mu.Unlock()
+	if byUser {
+		if id := identityFrom(r); id != nil {
+			return "user:" + id.Name
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// rateClass returns the class of API request r to upstream.
+func rateClass(r *http.Request, upstream string) string {
+	if upstream == routeOsApi {
+		return rateClassOsApi
+	}
+	a := parseApiRequest(r)
+	switch {
+	case a.Verb == verbWatch:
+		return rateClassWatch
+	case a.IsReadOnly():
+		return rateClassRead
+	}
+	return rateClassWrite
+}
+
+// isLongRunning returns true for requests that stay open indefinitely.
+func isLongRunning(r *http.Request, class string) bool {
+	return class == rateClassWatch || isUpgradeRequest(r) || r.URL.Query().Get("follow") == "true"
+}
+
+// acquire takes a token for a request of class by key, and a slot in flight
+// unless longRunning. It returns how long to wait before trying again, and
+// why, if the request must be rejected.
+func (l *rateLimiter) acquire(key, class string, longRunning bool) (time.Duration, string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	client, ok := l.clients[key]
+	if !ok {
+		client = &clientLimits{buckets: make(map[string]*tokenBucket)}
+		l.clients[key] = client
+		l.reportClients()
+	}
+	client.lastSeen = now
+
+	if !longRunning && l.maxInFlight > 0 && client.inFlight >= l.maxInFlight {
+		return time.Second, "concurrency"
+	}
+	if limit, ok := l.limits[class]; ok && limit.rate > 0 {
+		bucket, ok := client.buckets[class]
+		if !ok {
+			bucket = &tokenBucket{tokens: limit.burst, last: now}
+			client.buckets[class] = bucket
+		}
+		bucket.tokens = math.Min(limit.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*limit.rate)
+		bucket.last = now
+		if bucket.tokens < 1 {
+			return time.Duration((1 - bucket.tokens) / limit.rate * float64(time.Second)), "rate"
+		}
+		bucket.tokens--
+	}
+	if !longRunning {
+		client.inFlight++
+		if l.metrics != nil {
+			l.metrics.rateLimitInFlight.Inc(class)
+		}
+	}
+	return 0, ""
+}
+
+func (l *rateLimiter) release(key, class string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if client, ok := l.clients[key]; ok {
+		client.inFlight--
+		client.lastSeen = time.Now()
+	}
+	if l.metrics != nil {
+		l.metrics.rateLimitInFlight.Dec(class)
+	}
+}
+
+// expire forgets clients that have been idle long enough for their buckets to
+// have refilled.
+func (l *rateLimiter) expire() {
+	for range time.Tick(time.Minute) {
+		l.mu.Lock()
+		for key, client := range l.clients {
+			if client.inFlight == 0 && time.Since(client.lastSeen) > rateLimitIdle {
+				delete(l.clients, key)
+			}
+		}
+		l.reportClients()
+		l.mu.Unlock()
+	}
+}
+
+func (l *rateLimiter) reportClients() {
+	if l.metrics != nil {
+		l.metrics.rateLimitClients.Set(float64(len(l.clients)))
+	}
+}
+
+// Limit returns h limited as requests to upstream.
+func (l *rateLimiter) Limit(h http.Handler, upstream string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, class := l.key(r), rateClass(r, upstream)
+		longRunning := isLongRunning(r, class)
+		if wait, reason := l.acquire(key, class, longRunning); len(reason) > 0 {
+			if l.metrics != nil {
+				l.metrics.rateLimited.Inc(class, reason)
+			}
+			retryAfter := int(math.Ceil(wait.Seconds()))
+			if retryAfter < 1 {
+				retryAfter = 1
+			}
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			writeStatus(w, http.StatusTooManyRequests, statusReasonTooManyRequests,
+				fmt.Sprintf("too many requests, please try again in %s", time.Duration(retryAfter)*time.Second))
+			return
+		}
+		if !longRunning {
+			defer l.release(key, class)
+		}
+		h.ServeHTTP(w, r)
+	})
+}
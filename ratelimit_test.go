@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/kubernetes/pkg/api"
+)
+
+// limitedRequest serves a request from addr, as user if given, through h.
+func limitedRequest(h http.Handler, method, path, addr, user string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, nil)
+	r.RemoteAddr = addr
+	if len(user) > 0 {
+		r = setIdentity(r, &identity{Name: user})
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestRateLimiterBuckets(t *testing.T) {
+	limits := map[string]rateLimit{
+		rateClassRead:  newRateLimit(0.5, 2),
+		rateClassWrite: newRateLimit(0.5, 1),
+	}
+	l, err := newRateLimiter(limits, 0, RateLimitByUser, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := l.Limit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), routeApi)
+
+	// Each user has a bucket per class, whatever address they come from.
+	for i, addr := range []string{"192.0.2.1:1000", "192.0.2.2:1000"} {
+		if w := limitedRequest(h, "GET", "/v1beta3/pods", addr, "jo"); w.Code != http.StatusOK {
+			t.Fatalf("read %d: got %d", i+1, w.Code)
+		}
+	}
+	w := limitedRequest(h, "GET", "/v1beta3/pods", "192.0.2.3:1000", "jo")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("read past the burst: got %d, want 429", w.Code)
+	}
+	if retryAfter := w.Header().Get("Retry-After"); retryAfter != "2" {
+		t.Errorf("got Retry-After %q, want the 2s until a token is back", retryAfter)
+	}
+	var status api.Status
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatalf("%v in %q", err, w.Body)
+	}
+	if status.Kind != "Status" || status.Code != http.StatusTooManyRequests || status.Reason != statusReasonTooManyRequests || status.Status != api.StatusFailure {
+		t.Errorf("got status %+v", status)
+	}
+	if w := limitedRequest(h, "POST", "/v1beta3/namespaces/web/pods", "192.0.2.1:1000", "jo"); w.Code != http.StatusOK {
+		t.Errorf("write after the reads ran out: got %d", w.Code)
+	}
+	if w := limitedRequest(h, "GET", "/v1beta3/pods", "192.0.2.1:1000", "sam"); w.Code != http.StatusOK {
+		t.Errorf("another user: got %d", w.Code)
+	}
+	// A class without a limit isn't limited.
+	for i := 0; i < 5; i++ {
+		if w := limitedRequest(h, "GET", "/v1beta3/watch/pods", "192.0.2.1:1000", "jo"); w.Code != http.StatusOK {
+			t.Fatalf("watch %d: got %d", i+1, w.Code)
+		}
+	}
+
+	// Limiting by address, users share the bucket of the address they come
+	// from.
+	if err := l.update(limits, 0, RateLimitByIP); err != nil {
+		t.Fatal(err)
+	}
+	for i, user := range []string{"jo", "sam"} {
+		if w := limitedRequest(h, "GET", "/v1beta3/pods", "192.0.2.9:1000", user); w.Code != http.StatusOK {
+			t.Fatalf("read %d: got %d", i+1, w.Code)
+		}
+	}
+	if w := limitedRequest(h, "GET", "/v1beta3/pods", "192.0.2.9:2000", "alex"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("read past the address's burst: got %d, want 429", w.Code)
+	}
+}
+
+func TestRateLimiterInFlight(t *testing.T) {
+	l, err := newRateLimiter(map[string]rateLimit{}, 1, RateLimitByIP, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	started, finish := make(chan struct{}), make(chan struct{})
+	h := l.Limit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("block") == "true" {
+			started <- struct{}{}
+			<-finish
+		}
+	}), routeApi)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		limitedRequest(h, "GET", "/v1beta3/pods?block=true", "192.0.2.1:1000", "")
+	}()
+	<-started
+
+	w := limitedRequest(h, "GET", "/v1beta3/pods", "192.0.2.1:2000", "")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "1" {
+		t.Errorf("second request in flight: got %d, Retry-After %q, want 429 & 1", w.Code, w.Header().Get("Retry-After"))
+	}
+	if w := limitedRequest(h, "GET", "/v1beta3/pods", "192.0.2.2:1000", ""); w.Code != http.StatusOK {
+		t.Errorf("another client: got %d", w.Code)
+	}
+	// Long-running requests don't take a slot, nor need one.
+	if w := limitedRequest(h, "GET", "/v1beta3/watch/pods", "192.0.2.1:2000", ""); w.Code != http.StatusOK {
+		t.Errorf("watch: got %d", w.Code)
+	}
+	if w := limitedRequest(h, "GET", "/v1beta3/namespaces/web/pods/p1/log?follow=true", "192.0.2.1:2000", ""); w.Code != http.StatusOK {
+		t.Errorf("followed log: got %d", w.Code)
+	}
+
+	close(finish)
+	wg.Wait()
+	if w := limitedRequest(h, "GET", "/v1beta3/pods", "192.0.2.1:2000", ""); w.Code != http.StatusOK {
+		t.Errorf("after the first finished: got %d", w.Code)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if n := l.clients["ip:192.0.2.1"].inFlight; n != 0 {
+		t.Errorf("%d still in flight", n)
+	}
+}
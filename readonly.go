@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/GoogleCloudPlatform/kubernetes/pkg/api"
+)
+
+// How --read-only treats requests proxied through the master to pods & services.
+const (
+	ReadOnlyProxyPassThrough = "pass-through"
+	ReadOnlyProxyGetOnly     = "get-only"
+)
+
+// ReadOnly returns a filter rejecting API requests that could modify anything
+// on the master. Requests proxied to pods & services are either all let
+// through or limited to GET & HEAD, depending on proxyMode.
+func ReadOnly(proxyMode string) (func(http.Handler) http.Handler, error) {
+	if proxyMode != ReadOnlyProxyPassThrough && proxyMode != ReadOnlyProxyGetOnly {
+		return nil, fmt.Errorf("unknown read-only proxy mode %q", proxyMode)
+	}
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			a := parseApiRequest(r)
+			isProxy := a.Verb == verbProxy || a.Verb == verbRedirect || a.Subresource == verbProxy
+			if a.IsReadOnly() || (isProxy && proxyMode == ReadOnlyProxyPassThrough) {
+				h.ServeHTTP(w, r)
+				return
+			}
+			log.Printf("Read-only mode rejected %s %s", r.Method, requestPath(r))
+			w.Header().Set("Allow", "GET, HEAD")
+			writeStatus(w, http.StatusMethodNotAllowed, api.StatusReasonMethodNotAllowed,
+				fmt.Sprintf("%s %s is not allowed, the proxy is read-only", a.Verb, describeResource(a)))
+		})
+	}, nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/kubernetes/pkg/api"
+)
+
+func TestReadOnly(t *testing.T) {
+	tests := []struct {
+		method, path string
+		passThrough  bool
+		getOnly      bool
+	}{
+		{"GET", "/v1beta3/namespaces/web/pods", true, true},
+		{"HEAD", "/v1beta3/namespaces/web/pods/p1", true, true},
+		{"GET", "/v1beta3/watch/namespaces/web/pods", true, true},
+		{"GET", "/v1beta1/pods?namespace=web", true, true},
+		{"GET", "/version", true, true},
+		{"POST", "/v1beta3/namespaces/web/pods", false, false},
+		{"PUT", "/v1beta3/namespaces/web/pods/p1", false, false},
+		{"PATCH", "/v1beta3/namespaces/web/pods/p1", false, false},
+		{"DELETE", "/v1beta1/pods/p1?namespace=web", false, false},
+		{"POST", "/v1beta3/namespaces/web/pods/p1/binding", false, false},
+		{"POST", "/api", false, false},
+
+		// Requests proxied to pods & services.
+		{"GET", "/v1beta3/proxy/namespaces/web/services/s1/status", true, true},
+		{"HEAD", "/v1beta3/namespaces/web/pods/p1/proxy/", true, true},
+		{"GET", "/v1beta1/redirect/services/s1?namespace=web", true, true},
+		{"POST", "/v1beta3/proxy/namespaces/web/services/s1/orders", true, false},
+		{"DELETE", "/v1beta3/namespaces/web/pods/p1/proxy/cache", true, false},
+		{"PUT", "/v1beta1/proxy/pods/p1/config?namespace=web", true, false},
+	}
+	for _, mode := range []string{ReadOnlyProxyPassThrough, ReadOnlyProxyGetOnly} {
+		filter, err := ReadOnly(mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h := filter(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		for _, test := range tests {
+			want := test.passThrough
+			if mode == ReadOnlyProxyGetOnly {
+				want = test.getOnly
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(test.method, test.path, nil))
+			if allowed := w.Code == http.StatusOK; allowed != want {
+				t.Errorf("%s: %s %s: got %d", mode, test.method, test.path, w.Code)
+				continue
+			}
+			if want {
+				continue
+			}
+			var status api.Status
+			if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil || status.Reason != api.StatusReasonMethodNotAllowed {
+				t.Errorf("%s: %s %s: got status %q, %v", mode, test.method, test.path, w.Body, err)
+			}
+			if allow := w.Header().Get("Allow"); allow != "GET, HEAD" {
+				t.Errorf("%s: %s %s: got Allow %q", mode, test.method, test.path, allow)
+			}
+		}
+	}
+
+	if _, err := ReadOnly("get-some"); err == nil {
+		t.Errorf("accepted an unknown proxy mode")
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/kubernetes/pkg/api"
+)
+
+// unredactedKey marks a request context as exempt from redaction.
+type unredactedKey struct{}
+
+func exemptFromRedaction(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), unredactedKey{}, true))
+}
+
+func isExemptFromRedaction(r *http.Request) bool {
+	exempt, _ := r.Context().Value(unredactedKey{}).(bool)
+	return exempt
+}
+
+// redactKey marks a request context as needing its response redacted, with a
+// bool value saying whether the response is a watch stream.
+type redactKey struct{}
+
+// redactor blanks the values in the data of objects of the configured kinds
+// (Secrets by default) in API responses, for plain get & list responses as
+// well as each event of a watch stream.
+type redactor struct {
+	kinds     map[string]bool
+	resources map[string]bool
+	// Requests carrying exemptHeader with the value exemptValue aren't redacted.
+	exemptHeader, exemptValue string
+}
+
+// newRedactor creates a redactor for kinds. exemptHeader, if not empty, is a
+// "Name: value" header that exempts requests carrying it from redaction.
+func newRedactor(kinds []string, exemptHeader string) (*redactor, error) {
+	r := &redactor{kinds: map[string]bool{}, resources: map[string]bool{}}
+	for _, kind := range kinds {
+		r.kinds[kind] = true
+		r.resources[resourceForKind(kind)] = true
+	}
+	if len(exemptHeader) > 0 {
+		parts := strings.SplitN(exemptHeader, ":", 2)
+		if len(parts) != 2 || len(strings.TrimSpace(parts[0])) == 0 || len(strings.TrimSpace(parts[1])) == 0 {
+			return nil, fmt.Errorf("redaction exemption header must be of the form \"Name: value\", got %q", exemptHeader)
+		}
+		r.exemptHeader, r.exemptValue = http.CanonicalHeaderKey(strings.TrimSpace(parts[0])), strings.TrimSpace(parts[1])
+	}
+	return r, nil
+}
+
+// resourceForKind returns the lower case resource name for kind, e.g. secrets
+// for Secret.
+func resourceForKind(kind string) string {
+	resource := strings.ToLower(kind)
+	switch {
+	case strings.HasSuffix(resource, "s"):
+		return resource + "es"
+	case strings.HasSuffix(resource, "y"):
+		return resource[:len(resource)-1] + "ies"
+	}
+	return resource + "s"
+}
+
+// Filter handles the header exemption and marks requests for redacted
+// resources so that ModifyResponse rewrites their responses. It has to run
+// before the request is proxied, while its path is still relative to the API
+// prefix.
+func (rd *redactor) Filter(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(rd.exemptHeader) > 0 && len(r.Header.Get(rd.exemptHeader)) > 0 {
+			if r.Header.Get(rd.exemptHeader) == rd.exemptValue {
+				r = exemptFromRedaction(r)
+			}
+			r.Header.Del(rd.exemptHeader)
+		}
+		a := parseApiRequest(r)
+		if !isExemptFromRedaction(r) && rd.resources[strings.ToLower(a.Resource)] &&
+			a.Verb != verbProxy && a.Verb != verbRedirect {
+			watch := a.Verb == verbWatch || isWatchRequest(r)
+			r = r.WithContext(context.WithValue(r.Context(), redactKey{}, watch))
+			// Let the transport negotiate (and undo) compression itself.
+			r.Header.Del("Accept-Encoding")
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// ModifyResponse implements httputil.ReverseProxy.ModifyResponse.
+func (rd *redactor) ModifyResponse(resp *http.Response) error {
+	req := resp.Request
+	watch, redact := req.Context().Value(redactKey{}).(bool)
+	if !redact || !strings.Contains(resp.Header.Get("Content-Type"), "json") {
+		return nil
+	}
+	if enc := resp.Header.Get("Content-Encoding"); len(enc) > 0 && !strings.EqualFold(enc, "identity") {
+		// The master shouldn't compress what wasn't asked to be, but if it does
+		// the response has to be decoded to be redacted.
+		body, err := decodeBody(resp.Body, enc)
+		if err != nil {
+			log.Printf("Couldn't redact response to %s: %v", req.URL.Path, err)
+			resp.Body.Close()
+			rd.refuse(resp)
+			return nil
+		}
+		resp.Body = body
+		resp.ContentLength = -1
+		resp.Header.Del("Content-Encoding")
+		resp.Header.Del("Content-Length")
+	}
+
+	if watch {
+		pr, pw := io.Pipe()
+		go rd.redactStream(resp.Body, pw)
+		resp.Body = pr
+		resp.ContentLength = -1
+		resp.Header.Del("Content-Length")
+		return nil
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	redacted, err := rd.redactDocument(body)
+	if err != nil {
+		log.Printf("Couldn't redact response to %s: %v", req.URL.Path, err)
+		rd.refuse(resp)
+		return nil
+	}
+	setBody(resp, redacted)
+	return nil
+}
+
+// refuse replaces resp with a 502 Status, so as not to risk leaking data that
+// couldn't be redacted.
+func (rd *redactor) refuse(resp *http.Response) {
+	resp.StatusCode = http.StatusBadGateway
+	resp.Status = "502 Bad Gateway"
+	resp.Header.Set("Content-Type", "application/json")
+	setBody(resp, statusBody(http.StatusBadGateway, api.StatusReasonUnknown, "couldn't redact response from the master"))
+}
+
+func setBody(resp *http.Response, body []byte) {
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+}
+
+// decodeBody undoes the Content-Encoding enc of body.
+func decodeBody(body io.ReadCloser, enc string) (io.ReadCloser, error) {
+	var r io.Reader
+	var err error
+	switch strings.ToLower(enc) {
+	case "gzip", "x-gzip":
+		r, err = gzip.NewReader(body)
+	case "deflate":
+		r, err = zlib.NewReader(body)
+	default:
+		return nil, fmt.Errorf("unsupported Content-Encoding %q", enc)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &decodedBody{r, body}, nil
+}
+
+type decodedBody struct {
+	io.Reader
+	body io.Closer
+}
+
+func (b *decodedBody) Close() error {
+	return b.body.Close()
+}
+
+func (rd *redactor) redactDocument(data []byte) ([]byte, error) {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	var obj map[string]interface{}
+	if err := d.Decode(&obj); err != nil {
+		return nil, err
+	}
+	rd.redactObject(obj, "")
+	return json.Marshal(obj)
+}
+
+// redactStream redacts a watch stream of JSON events event by event.
+func (rd *redactor) redactStream(body io.ReadCloser, w *io.PipeWriter) {
+	defer body.Close()
+	d := json.NewDecoder(body)
+	d.UseNumber()
+	e := json.NewEncoder(w)
+	for {
+		var event map[string]interface{}
+		if err := d.Decode(&event); err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			w.CloseWithError(err)
+			return
+		}
+		if obj, ok := event["object"].(map[string]interface{}); ok {
+			rd.redactObject(obj, "")
+		}
+		if err := e.Encode(event); err != nil {
+			w.CloseWithError(err)
+			return
+		}
+	}
+}
+
+// redactObject blanks the data values of obj if it is of a redacted kind, or
+// of any of its items if it is a list. listKind is the kind of the list obj
+// is an item of, as items don't always have their own kind.
+func (rd *redactor) redactObject(obj map[string]interface{}, listKind string) {
+	kind, _ := obj["kind"].(string)
+	if len(kind) == 0 && strings.HasSuffix(listKind, "List") {
+		kind = strings.TrimSuffix(listKind, "List")
+	}
+	if rd.kinds[kind] {
+		if data, ok := obj["data"].(map[string]interface{}); ok {
+			for key := range data {
+				data[key] = ""
+			}
+		}
+	}
+	if items, ok := obj["items"].([]interface{}); ok {
+		for _, item := range items {
+			if itemObj, ok := item.(map[string]interface{}); ok {
+				rd.redactObject(itemObj, kind)
+			}
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const secretList = `{"kind":"SecretList","items":[{"metadata":{"name":"s1"},"data":{"password":"c2VjcmV0"}}]}`
+
+// redactedResponse passes a response to a list of secrets with body, encoded
+// with enc, through rd.
+func redactedResponse(t *testing.T, rd *redactor, enc string, body []byte) (*http.Response, string) {
+	var req *http.Request
+	rd.Filter(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req = r
+	})).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/v1beta3/namespaces/web/secrets", nil))
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Status:     "200 OK",
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       ioutil.NopCloser(bytes.NewReader(body)),
+		Request:    req,
+	}
+	if len(enc) > 0 {
+		resp.Header.Set("Content-Encoding", enc)
+	}
+	if err := rd.ModifyResponse(resp); err != nil {
+		t.Fatal(err)
+	}
+	redacted, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(redacted)
+}
+
+func TestRedactEncodedResponses(t *testing.T) {
+	rd, err := newRedactor([]string{"Secret"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var gzipped bytes.Buffer
+	gz := gzip.NewWriter(&gzipped)
+	gz.Write([]byte(secretList))
+	gz.Close()
+
+	for _, test := range []struct {
+		enc  string
+		body []byte
+	}{
+		{"", []byte(secretList)},
+		{"identity", []byte(secretList)},
+		{"gzip", gzipped.Bytes()},
+	} {
+		resp, body := redactedResponse(t, rd, test.enc, test.body)
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Encoding") == "gzip" ||
+			!strings.Contains(body, `"password":""`) || strings.Contains(body, "c2VjcmV0") {
+			t.Errorf("%q: got %d %q, want the secret redacted", test.enc, resp.StatusCode, body)
+		}
+	}
+
+	for _, test := range []struct {
+		enc  string
+		body []byte
+	}{
+		{"br", []byte(secretList)},
+		{"gzip", []byte(secretList)},
+		{"", []byte(`{"kind":"SecretList",`)},
+	} {
+		resp, body := redactedResponse(t, rd, test.enc, test.body)
+		if resp.StatusCode != http.StatusBadGateway || strings.Contains(body, "c2VjcmV0") {
+			t.Errorf("%q: got %d %q, want a 502", test.enc, resp.StatusCode, body)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/kubernetes/pkg/api"
+)
+
+// Verbs an API request can be classified as.
+const (
+	verbGet      = "get"
+	verbList     = "list"
+	verbWatch    = "watch"
+	verbCreate   = "create"
+	verbUpdate   = "update"
+	verbPatch    = "patch"
+	verbDelete   = "delete"
+	verbProxy    = "proxy"
+	verbRedirect = "redirect"
+)
+
+// apiRequest describes a request to the Kubernetes or OpenShift API in terms
+// of what it does, rather than its URL.
+type apiRequest struct {
+	Version     string
+	Verb        string
+	Namespace   string
+	Resource    string
+	Name        string
+	Subresource string
+	// Method is the HTTP method of the request. For proxy requests it is the
+	// method that will be used against the pod or service.
+	Method string
+}
+
+// IsReadOnly returns true if the request can't modify anything on the
+// master. Proxy & redirect requests are considered read-only only if they use
+// GET or HEAD.
+func (a *apiRequest) IsReadOnly() bool {
+	switch a.Verb {
+	case verbGet, verbList, verbWatch:
+		return true
+	case verbProxy, verbRedirect:
+		return a.Method == "GET" || a.Method == "HEAD"
+	}
+	// Requests that aren't for resources at all, e.g. /api or /version.
+	return a.Verb == "" && (a.Method == "GET" || a.Method == "HEAD")
+}
+
+// parseApiRequest classifies r, whose path must be relative to the root of
+// the Kubernetes or OpenShift API (i.e. with --api-prefix stripped). It
+// understands the v1beta1 & v1beta2 layout, with the namespace in a query
+// parameter:
+//
+//	<version>/[watch|proxy|redirect/]<resource>[/<name>[/<subresource>...]]?namespace=<namespace>
+//
+// as well as the v1beta3 layout with the namespace in the path:
+//
+//	<version>/[watch|proxy|redirect/]ns/<namespace>/<resource>[/<name>[/<subresource>...]]
+func parseApiRequest(r *http.Request) *apiRequest {
+	a := &apiRequest{Method: r.Method}
+	parts := splitPath(r.URL.Path)
+	if len(parts) == 0 {
+		return a
+	}
+	a.Version, parts = parts[0], parts[1:]
+	if len(a.Version) < 2 || a.Version[0] != 'v' || a.Version[1] < '0' || a.Version[1] > '9' {
+		// Not a versioned API path, e.g. /version or /healthz.
+		a.Version = ""
+		return a
+	}
+
+	if len(parts) > 0 {
+		switch parts[0] {
+		case verbWatch, verbProxy, verbRedirect:
+			a.Verb, parts = parts[0], parts[1:]
+		}
+	}
+
+	a.Namespace = r.URL.Query().Get("namespace")
+	switch {
+	case len(parts) >= 2 && parts[0] == "ns":
+		a.Namespace, parts = parts[1], parts[2:]
+	case len(parts) >= 3 && parts[0] == "namespaces":
+		// namespaces/<name> is the namespace itself, but namespaces/<name>/<resource>
+		// is a resource within it.
+		a.Namespace, parts = parts[1], parts[2:]
+	}
+
+	if len(parts) > 0 {
+		a.Resource = parts[0]
+	}
+	if len(parts) > 1 {
+		a.Name = parts[1]
+	}
+	if len(parts) > 2 {
+		a.Subresource = parts[2]
+	}
+
+	switch {
+	case a.Resource == "namespaces":
+		// A namespace is in itself, so that rules for it cover deleting it.
+		a.Namespace = a.Name
+	case len(a.Namespace) == 0 && legacyApiVersions[a.Version] && len(a.Resource) > 0 && !clusterResources[a.Resource] &&
+		(len(a.Name) > 0 || r.Method == "POST"):
+		// v1beta1 & v1beta2 create, & act on named objects, in the default
+		// namespace when none is given, but list & watch across all of them.
+		a.Namespace = api.NamespaceDefault
+	}
+
+	if len(a.Verb) == 0 {
+		a.Verb = verbForMethod(r, len(a.Name) > 0)
+		if streamingSubresources[a.Subresource] && isUpgradeRequest(r) {
+			a.Verb = verbCreate
+		}
+	}
+	return a
+}
+
+// legacyApiVersions are those with the namespace in a query parameter.
+var legacyApiVersions = map[string]bool{"v1beta1": true, "v1beta2": true}
+
+// clusterResources aren't in any namespace.
+var clusterResources = map[string]bool{"minions": true, "nodes": true, "namespaces": true}
+
+func verbForMethod(r *http.Request, hasName bool) string {
+	switch r.Method {
+	case "GET", "HEAD":
+		if r.URL.Query().Get("watch") == "true" {
+			return verbWatch
+		}
+		if hasName {
+			return verbGet
+		}
+		return verbList
+	case "POST":
+		return verbCreate
+	case "PUT":
+		return verbUpdate
+	case "PATCH":
+		return verbPatch
+	case "DELETE":
+		return verbDelete
+	}
+	return strings.ToLower(r.Method)
+}
+
+func splitPath(path string) []string {
+	path = strings.Trim(path, "/")
+	if len(path) == 0 {
+		return nil
+	}
+	return strings.Split(path, "/")
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestParseApiRequest(t *testing.T) {
+	tests := []struct {
+		method, url string
+		want        apiRequest
+	}{
+		// Not versioned API paths.
+		{"GET", "/", apiRequest{}},
+		{"GET", "/version", apiRequest{}},
+
+		// v1beta1 & v1beta2, with the namespace in a query parameter.
+		{"GET", "/v1beta1/pods?namespace=web", apiRequest{Version: "v1beta1", Verb: verbList, Namespace: "web", Resource: "pods"}},
+		{"GET", "/v1beta1/pods/p1?namespace=web", apiRequest{Version: "v1beta1", Verb: verbGet, Namespace: "web", Resource: "pods", Name: "p1"}},
+		{"GET", "/v1beta1/pods", apiRequest{Version: "v1beta1", Verb: verbList, Resource: "pods"}},
+		{"GET", "/v1beta1/secrets?namespace=", apiRequest{Version: "v1beta1", Verb: verbList, Resource: "secrets"}},
+		{"POST", "/v1beta1/pods", apiRequest{Version: "v1beta1", Verb: verbCreate, Namespace: "default", Resource: "pods"}},
+		{"GET", "/v1beta1/pods/p1?namespace=", apiRequest{Version: "v1beta1", Verb: verbGet, Namespace: "default", Resource: "pods", Name: "p1"}},
+		{"DELETE", "/v1beta2/replicationControllers/rc1", apiRequest{Version: "v1beta2", Verb: verbDelete, Namespace: "default", Resource: "replicationControllers", Name: "rc1"}},
+		{"GET", "/v1beta1/watch/pods?namespace=web", apiRequest{Version: "v1beta1", Verb: verbWatch, Namespace: "web", Resource: "pods"}},
+		{"GET", "/v1beta2/pods?watch=true", apiRequest{Version: "v1beta2", Verb: verbWatch, Resource: "pods"}},
+		{"GET", "/v1beta1/watch/pods", apiRequest{Version: "v1beta1", Verb: verbWatch, Resource: "pods"}},
+		{"POST", "/v1beta1/proxy/services/svc/path?namespace=web", apiRequest{Version: "v1beta1", Verb: verbProxy, Namespace: "web", Resource: "services", Name: "svc", Subresource: "path"}},
+		{"GET", "/v1beta1/minions/n1", apiRequest{Version: "v1beta1", Verb: verbGet, Resource: "minions", Name: "n1"}},
+		{"DELETE", "/v1beta1/namespaces/kube-system", apiRequest{Version: "v1beta1", Verb: verbDelete, Namespace: "kube-system", Resource: "namespaces", Name: "kube-system"}},
+		{"GET", "/v1beta1", apiRequest{Version: "v1beta1", Verb: verbList}},
+
+		// v1beta3, with the namespace in the path.
+		{"GET", "/v1beta3/ns/web/pods", apiRequest{Version: "v1beta3", Verb: verbList, Namespace: "web", Resource: "pods"}},
+		{"GET", "/v1beta3/namespaces/web/pods/p1", apiRequest{Version: "v1beta3", Verb: verbGet, Namespace: "web", Resource: "pods", Name: "p1"}},
+		{"PUT", "/v1beta3/namespaces/web/pods/p1/status", apiRequest{Version: "v1beta3", Verb: verbUpdate, Namespace: "web", Resource: "pods", Name: "p1", Subresource: "status"}},
+		{"GET", "/v1beta3/watch/namespaces/web/pods", apiRequest{Version: "v1beta3", Verb: verbWatch, Namespace: "web", Resource: "pods"}},
+		{"GET", "/v1beta3/proxy/namespaces/web/pods/p1:8080/metrics", apiRequest{Version: "v1beta3", Verb: verbProxy, Namespace: "web", Resource: "pods", Name: "p1:8080", Subresource: "metrics"}},
+		{"GET", "/v1beta3/pods", apiRequest{Version: "v1beta3", Verb: verbList, Resource: "pods"}},
+		{"GET", "/v1beta3/nodes/n1", apiRequest{Version: "v1beta3", Verb: verbGet, Resource: "nodes", Name: "n1"}},
+		{"GET", "/v1beta3/namespaces", apiRequest{Version: "v1beta3", Verb: verbList, Resource: "namespaces"}},
+		{"DELETE", "/v1beta3/namespaces/kube-system", apiRequest{Version: "v1beta3", Verb: verbDelete, Namespace: "kube-system", Resource: "namespaces", Name: "kube-system"}},
+		{"PATCH", "/v1beta3/namespaces/kube-system", apiRequest{Version: "v1beta3", Verb: verbPatch, Namespace: "kube-system", Resource: "namespaces", Name: "kube-system"}},
+		{"POST", "/v1beta3/namespaces/web/pods/p1/exec", apiRequest{Version: "v1beta3", Verb: verbCreate, Namespace: "web", Resource: "pods", Name: "p1", Subresource: "exec"}},
+	}
+	for _, test := range tests {
+		r, err := http.NewRequest(test.method, test.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := test.want
+		want.Method = test.method
+		if got := parseApiRequest(r); *got != want {
+			t.Errorf("%s %s: got %+v, want %+v", test.method, test.url, *got, want)
+		}
+	}
+}
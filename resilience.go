@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/kubernetes/pkg/api"
+)
+
+// statusReasonServiceUnavailable is the reason given when the master can't be
+// reached, which this version of the API types doesn't define.
+const statusReasonServiceUnavailable api.StatusReason = "ServiceUnavailable"
+
+// resilienceOptions configure how requests to a master cope with it failing.
+type resilienceOptions struct {
+	// retries is how many times GET & HEAD requests are retried after a
+	// connection error or 503, waiting backoff (doubled each time, with
+	// jitter) in between.
+	retries int
+	backoff time.Duration
+	// timeout limits how long a request, other than a watch or stream, may
+	// take. Zero means no limit.
+	timeout time.Duration
+	// breakerFailures consecutive failures open the circuit breaker, which
+	// then fails requests fast for breakerCooldown before letting one through
+	// to see whether the master is back. Zero disables the breaker.
+	breakerFailures int
+	breakerCooldown time.Duration
+}
+
+// upstreamRequest describes a request to a master, as found by
+// markUpstreamRequest from the request path relative to the API prefix.
+type upstreamRequest struct {
+	// proxied requests go on through the master to a pod or service, so
+	// their 503s say nothing about the master itself.
+	proxied bool
+	// longRunning requests, such as watches, stay open indefinitely.
+	longRunning bool
+}
+
+type upstreamRequestKey struct{}
+
+// markUpstreamRequest records what kind of request r is for the resilient
+// transport, which only sees the path on the master.
+func markUpstreamRequest(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a := parseApiRequest(r)
+		info := &upstreamRequest{
+			proxied:     a.Verb == verbProxy || a.Verb == verbRedirect || a.Subresource == verbProxy,
+			longRunning: a.Verb == verbWatch || isWatchRequest(r) || isUpgradeRequest(r) || r.URL.Query().Get("follow") == "true",
+		}
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), upstreamRequestKey{}, info)))
+	})
+}
+
+func upstreamRequestFrom(req *http.Request) *upstreamRequest {
+	if info, ok := req.Context().Value(upstreamRequestKey{}).(*upstreamRequest); ok {
+		return info
+	}
+	return &upstreamRequest{longRunning: isWatchRequest(req) || isUpgradeRequest(req)}
+}
+
+// circuitBreaker stops requests being sent to a master that is down. It
+// opens after a number of consecutive failures, fails requests fast while
+// open, and after a cooldown lets a single request through: if that succeeds
+// it closes again, otherwise it stays open for another cooldown.
+type circuitBreaker struct {
+	cluster  string
+	failures int
+	cooldown time.Duration
+	metrics  *proxyMetrics
+
+	mu          sync.Mutex
+	consecutive int
+	openUntil   time.Time
+	probing     bool
+}
+
+func newCircuitBreaker(cluster string, failures int, cooldown time.Duration, metrics *proxyMetrics) *circuitBreaker {
+	if metrics != nil {
+		metrics.breakerOpen.Set(0, cluster)
+	}
+	return &circuitBreaker{cluster: cluster, failures: failures, cooldown: cooldown, metrics: metrics}
+}
+
+// allow returns true if a request may be sent, and otherwise how long until
+// the master will be tried again.
+func (b *circuitBreaker) allow() (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.consecutive < b.failures {
+		return true, 0
+	}
+	if wait := time.Until(b.openUntil); wait > 0 {
+		return false, wait
+	}
+	if b.probing {
+		return false, b.cooldown
+	}
+	b.probing = true
+	return true, 0
+}
+
+// record notes the outcome of a request allowed through.
+func (b *circuitBreaker) record(failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if !failed {
+		if b.consecutive >= b.failures {
+			log.Printf("Kubernetes master for cluster %s is back, closing circuit breaker", b.cluster)
+			b.setOpen(false)
+		}
+		b.consecutive = 0
+		return
+	}
+	b.consecutive++
+	if b.consecutive >= b.failures {
+		if b.consecutive == b.failures {
+			log.Printf("Kubernetes master for cluster %s failed %d times in a row, opening circuit breaker", b.cluster, b.consecutive)
+			b.setOpen(true)
+		}
+		b.openUntil = time.Now().Add(b.cooldown)
+	}
+}
+
+// abandon notes that a request allowed through had no clear outcome.
+func (b *circuitBreaker) abandon() {
+	b.mu.Lock()
+	b.probing = false
+	b.mu.Unlock()
+}
+
+func (b *circuitBreaker) setOpen(open bool) {
+	if b.metrics != nil {
+		value := 0.0
+		if open {
+			value = 1
+		}
+		b.metrics.breakerOpen.Set(value, b.cluster)
+	}
+}
+
+// resilientTransport retries idempotent requests that fail because the
+// master couldn't be reached or was unavailable, applies the request timeout
+// and fails fast while the circuit breaker is open.
+type resilientTransport struct {
+	rt      http.RoundTripper
+	cluster string
+	opts    *resilienceOptions
+	breaker *circuitBreaker
+	metrics *proxyMetrics
+}
+
+func newResilientTransport(rt http.RoundTripper, cluster string, opts *resilienceOptions, breaker *circuitBreaker, metrics *proxyMetrics) http.RoundTripper {
+	return &resilientTransport{rt: rt, cluster: cluster, opts: opts, breaker: breaker, metrics: metrics}
+}
+
+func (t *resilientTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.breaker != nil {
+		if ok, wait := t.breaker.allow(); !ok {
+			return t.unavailable(req, wait), nil
+		}
+	}
+	info := upstreamRequestFrom(req)
+	// The client's own context, which the request timeout is added to.
+	client := req.Context()
+	var cancel context.CancelFunc
+	if t.opts.timeout > 0 && !info.longRunning {
+		var ctx context.Context
+		ctx, cancel = context.WithTimeout(client, t.opts.timeout)
+		req = req.WithContext(ctx)
+	}
+	idempotent := (req.Method == "GET" || req.Method == "HEAD") && !isUpgradeRequest(req)
+
+	resp, failed, err := t.roundTrip(req, client, info, idempotent)
+	if t.breaker != nil {
+		if client.Err() != nil {
+			// Cancelled by the client, which says nothing about the master.
+			t.breaker.abandon()
+		} else {
+			t.breaker.record(failed)
+		}
+	}
+	if cancel != nil {
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		resp.Body = &cancelingBody{resp.Body, cancel}
+	}
+	return resp, err
+}
+
+// roundTrip sends req, retrying if it is idempotent & failed, and returns the
+// last response or error along with whether it was a failure of the master.
+// Running out of time counts as one, unless it was the client that gave up.
+func (t *resilientTransport) roundTrip(req *http.Request, client context.Context, info *upstreamRequest, idempotent bool) (*http.Response, bool, error) {
+	for attempt := 0; ; attempt++ {
+		resp, err := t.rt.RoundTrip(req)
+		failed := client.Err() == nil && (err != nil || (resp.StatusCode == http.StatusServiceUnavailable && !info.proxied))
+		if !failed || !idempotent || attempt >= t.opts.retries || req.Context().Err() != nil {
+			return resp, failed, err
+		}
+		if resp != nil {
+			io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4096))
+			resp.Body.Close()
+		}
+		if t.metrics != nil {
+			t.metrics.upstreamRetries.Inc(t.cluster)
+		}
+		// Full jitter on an exponential backoff, so that clients retrying
+		// together don't all hit the master again at the same moment.
+		backoff := t.opts.backoff << uint(attempt)
+		select {
+		case <-time.After(time.Duration(rand.Int63n(int64(backoff) + 1))):
+		case <-req.Context().Done():
+			return nil, client.Err() == nil, req.Context().Err()
+		}
+	}
+}
+
+// unavailable returns the response for a request failed fast by the circuit
+// breaker.
+func (t *resilientTransport) unavailable(req *http.Request, wait time.Duration) *http.Response {
+	retryAfter := int(wait.Seconds() + 0.999)
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+	body := statusBody(http.StatusServiceUnavailable, statusReasonServiceUnavailable,
+		fmt.Sprintf("the Kubernetes master for cluster %s is unavailable, please try again in %s", t.cluster, time.Duration(retryAfter)*time.Second))
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	header.Set("Retry-After", strconv.Itoa(retryAfter))
+	return &http.Response{
+		Status:        "503 Service Unavailable",
+		StatusCode:    http.StatusServiceUnavailable,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
+
+// cancelingBody releases the timeout of a request once its response has been
+// read.
+type cancelingBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// proxyErrorHandler responds to a request that couldn't be proxied to the
+// master of cluster with a Status, rather than the bare 502 of
+// httputil.ReverseProxy.
+func proxyErrorHandler(cluster string) func(http.ResponseWriter, *http.Request, error) {
+	return func(w http.ResponseWriter, r *http.Request, err error) {
+		if r.Context().Err() != nil {
+			// The client has gone away, there's no one to tell.
+			return
+		}
+		log.Printf("Couldn't proxy %s %s to cluster %s: %v", r.Method, requestPath(r), cluster, err)
+		if errors.Is(err, context.DeadlineExceeded) {
+			writeStatus(w, http.StatusGatewayTimeout, api.StatusReasonTimeout,
+				fmt.Sprintf("the Kubernetes master for cluster %s didn't respond in time", cluster))
+			return
+		}
+		writeStatus(w, http.StatusBadGateway, statusReasonServiceUnavailable,
+			fmt.Sprintf("couldn't reach the Kubernetes master for cluster %s", cluster))
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestResilientTransport(opts *resilienceOptions) (http.RoundTripper, *circuitBreaker) {
+	breaker := newCircuitBreaker("test", opts.breakerFailures, opts.breakerCooldown, nil)
+	return newResilientTransport(http.DefaultTransport, "test", opts, breaker, nil), breaker
+}
+
+func roundTripStatus(t *testing.T, rt http.RoundTripper, ctx context.Context, method, url string) (int, error) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := rt.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		return 0, err
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+func TestResilientTransportHangingMaster(t *testing.T) {
+	var hits int32
+	master := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		<-r.Context().Done()
+	}))
+	defer master.Close()
+	rt, _ := newTestResilientTransport(&resilienceOptions{
+		timeout:         20 * time.Millisecond,
+		breakerFailures: 2,
+		breakerCooldown: time.Minute,
+	})
+
+	for i := 0; i < 2; i++ {
+		if _, err := roundTripStatus(t, rt, context.Background(), "GET", master.URL); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("request %d: got %v, want a deadline exceeded error", i+1, err)
+		}
+	}
+	// Both timeouts count against the master, so the breaker is now open.
+	status, err := roundTripStatus(t, rt, context.Background(), "GET", master.URL)
+	if err != nil || status != http.StatusServiceUnavailable {
+		t.Fatalf("got %d, %v, want a 503 from the open breaker", status, err)
+	}
+	if n := atomic.LoadInt32(&hits); n != 2 {
+		t.Errorf("master got %d requests, want 2", n)
+	}
+}
+
+func TestResilientTransportClientCancel(t *testing.T) {
+	master := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer master.Close()
+	rt, breaker := newTestResilientTransport(&resilienceOptions{
+		timeout:         time.Minute,
+		breakerFailures: 1,
+		breakerCooldown: time.Minute,
+	})
+
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		_, err := roundTripStatus(t, rt, ctx, "GET", master.URL)
+		cancel()
+		if err == nil {
+			t.Fatalf("request %d: expected an error", i+1)
+		}
+	}
+	// The client giving up says nothing about the master.
+	if ok, _ := breaker.allow(); !ok {
+		t.Errorf("breaker opened after requests cancelled by the client")
+	}
+}
+
+func TestResilientTransportFlappingMaster(t *testing.T) {
+	var hits, down int32
+	master := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Every other request finds the master unavailable, unless it is down.
+		if atomic.AddInt32(&hits, 1)%2 == 1 || atomic.LoadInt32(&down) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer master.Close()
+	rt, _ := newTestResilientTransport(&resilienceOptions{
+		retries:         2,
+		backoff:         time.Millisecond,
+		breakerFailures: 2,
+		breakerCooldown: 50 * time.Millisecond,
+	})
+
+	// GETs are retried past the 503s, so the breaker never opens.
+	for i := 0; i < 5; i++ {
+		if status, err := roundTripStatus(t, rt, context.Background(), "GET", master.URL); err != nil || status != http.StatusOK {
+			t.Fatalf("GET %d: got %d, %v, want 200", i+1, status, err)
+		}
+	}
+	if n := atomic.LoadInt32(&hits); n != 10 {
+		t.Errorf("master got %d requests, want 10", n)
+	}
+
+	// POSTs aren't retried, so two 503s in a row open the breaker.
+	atomic.StoreInt32(&down, 1)
+	for i := 0; i < 2; i++ {
+		if status, err := roundTripStatus(t, rt, context.Background(), "POST", master.URL); err != nil || status != http.StatusServiceUnavailable {
+			t.Fatalf("POST %d: got %d, %v, want 503", i+1, status, err)
+		}
+	}
+	status, err := roundTripStatus(t, rt, context.Background(), "GET", master.URL)
+	if err != nil || status != http.StatusServiceUnavailable {
+		t.Fatalf("got %d, %v, want a 503 from the open breaker", status, err)
+	}
+	if n := atomic.LoadInt32(&hits); n != 12 {
+		t.Errorf("master got %d requests, want 12", n)
+	}
+
+	// After the cooldown a single request is let through, which closes the
+	// breaker again when it succeeds.
+	atomic.StoreInt32(&down, 0)
+	time.Sleep(60 * time.Millisecond)
+	if status, err := roundTripStatus(t, rt, context.Background(), "GET", master.URL); err != nil || status != http.StatusOK {
+		t.Fatalf("probe: got %d, %v, want 200", status, err)
+	}
+	if status, err := roundTripStatus(t, rt, context.Background(), "GET", master.URL); err != nil || status != http.StatusOK {
+		t.Fatalf("after probe: got %d, %v, want 200", status, err)
+	}
+}
@@ -0,0 +1,446 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The response cache keeps the responses to GET requests for API objects &
+// lists, keyed by URL & credentials. The entries for a collection are dropped
+// whenever a watch of the collection, made with the same credentials, sees a
+// change. Responses are only cached once that watch is running, and only if
+// nothing changed while they were being fetched, so a cached response is
+// never older than the last change. Collections that can't be watched are
+// cached for a fixed TTL instead. A successful write through the proxy drops
+// the entries of its collection straight away, for all credentials, so that
+// clients see their own changes without waiting for the watch.
+
+// responseCacheIdleTimeout is how long the watch of a collection is kept
+// running after the last request for it.
+const responseCacheIdleTimeout = 5 * time.Minute
+
+// Values of the X-Cache header.
+const (
+	cacheHit  = "HIT"
+	cacheMiss = "MISS"
+)
+
+// cacheableKey marks a request context as cacheable, with the *apiRequest
+// it makes as its value.
+type cacheableKey struct{}
+
+// cacheWriteKey marks a request context as a write that may change a cached
+// collection, with the *apiRequest it makes as its value.
+type cacheWriteKey struct{}
+
+type responseCache struct {
+	maxBytes int64
+	ttl      time.Duration
+
+	mu          sync.Mutex
+	size        int64
+	lru         *list.List // of *cacheEntry, most recently used first
+	entries     map[string]*list.Element
+	collections map[string]*cacheCollection
+}
+
+type cacheEntry struct {
+	key        string
+	collection *cacheCollection
+	header     http.Header
+	body       []byte
+	// expires is zero for entries of watched collections.
+	expires time.Time
+}
+
+// cacheCollection holds the entries of a collection fetched with one set of
+// credentials, along with the state of the watch invalidating them.
+type cacheCollection struct {
+	key      string
+	rt       http.RoundTripper
+	watchURL *url.URL
+	header   http.Header
+	ctx      context.Context
+	cancel   context.CancelFunc
+	idle     *time.Timer
+	// The master, resource & namespace listed, which writes are matched
+	// against.
+	host      string
+	resource  string
+	namespace string
+
+	// The rest is guarded by the mutex of the cache.
+	entries     map[*list.Element]bool
+	lastUsed    time.Time
+	watching    bool
+	unwatchable bool
+	// generation is bumped whenever the collection may have changed.
+	generation uint64
+}
+
+func newResponseCache(maxBytes int64, ttl time.Duration) *responseCache {
+	return &responseCache{
+		maxBytes:    maxBytes,
+		ttl:         ttl,
+		lru:         list.New(),
+		entries:     map[string]*list.Element{},
+		collections: map[string]*cacheCollection{},
+	}
+}
+
+// Filter marks GET requests for API objects & lists as cacheable, and writes
+// to API objects as invalidating them. The responses of cacheable requests
+// are always requested uncompressed, so that they can be served to any
+// client.
+func (c *responseCache) Filter(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a := parseApiRequest(r)
+		switch {
+		case len(a.Resource) == 0 || isUpgradeRequest(r):
+		case r.Method == "GET" && (a.Verb == verbGet || a.Verb == verbList) && len(a.Subresource) == 0:
+			r = r.WithContext(context.WithValue(r.Context(), cacheableKey{}, a))
+			r.Header.Del("Accept-Encoding")
+		case !a.IsReadOnly() && a.Verb != verbProxy && a.Verb != verbRedirect:
+			r = r.WithContext(context.WithValue(r.Context(), cacheWriteKey{}, a))
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// Transport returns a transport serving cacheable requests from the cache
+// where possible, and otherwise making requests through rt.
+func (c *responseCache) Transport(rt http.RoundTripper) http.RoundTripper {
+	return &cachingTransport{cache: c, rt: rt}
+}
+
+type cachingTransport struct {
+	cache *responseCache
+	rt    http.RoundTripper
+}
+
+func (t *cachingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if write, ok := req.Context().Value(cacheWriteKey{}).(*apiRequest); ok {
+		resp, err := t.rt.RoundTrip(req)
+		if err == nil && resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			t.cache.invalidateWritten(req.URL.Host, write)
+		}
+		return resp, err
+	}
+	a, cacheable := req.Context().Value(cacheableKey{}).(*apiRequest)
+	if !cacheable {
+		return t.rt.RoundTrip(req)
+	}
+	noCache, noStore := cacheControl(req.Header)
+	key := cacheKey(req)
+	coll := t.cache.collection(t.rt, req, a)
+
+	if !noCache && !noStore {
+		if header, body, ok := t.cache.get(key); ok {
+			header.Set("X-Cache", cacheHit)
+			return &http.Response{
+				Status:        "200 OK",
+				StatusCode:    http.StatusOK,
+				Proto:         "HTTP/1.1",
+				ProtoMajor:    1,
+				ProtoMinor:    1,
+				Header:        header,
+				Body:          ioutil.NopCloser(bytes.NewReader(body)),
+				ContentLength: int64(len(body)),
+				Request:       req,
+			}, nil
+		}
+	}
+
+	generation, storable := t.cache.state(coll)
+	resp, err := t.rt.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Header.Set("X-Cache", cacheMiss)
+	_, respNoStore := cacheControl(resp.Header)
+	if noStore || respNoStore || !storable || resp.StatusCode != http.StatusOK ||
+		len(resp.Header.Get("Set-Cookie")) > 0 || len(resp.Header.Get("Content-Encoding")) > 0 {
+		return resp, nil
+	}
+	header := resp.Header.Clone()
+	resp.Body = &cachingBody{ReadCloser: resp.Body, limit: t.cache.maxEntryBytes(), done: func(body []byte) {
+		t.cache.put(key, coll, generation, header, body)
+	}}
+	return resp, nil
+}
+
+// cacheControl returns whether header asks for a cached response not to be
+// used, or for the response not to be stored.
+func cacheControl(header http.Header) (noCache, noStore bool) {
+	for _, value := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			switch strings.ToLower(strings.TrimSpace(directive)) {
+			case "no-cache":
+				noCache = true
+			case "no-store":
+				noStore = true
+			}
+		}
+	}
+	if strings.EqualFold(header.Get("Pragma"), "no-cache") {
+		noCache = true
+	}
+	return noCache, noStore
+}
+
+func cacheKey(req *http.Request) string {
+	u := *req.URL
+	u.RawQuery = u.Query().Encode()
+	return u.String() + "#" + credentialsKey(req)
+}
+
+// collection returns the collection the object or list requested by req, as
+// described by a, belongs to, starting to watch it if need be.
+func (c *responseCache) collection(rt http.RoundTripper, req *http.Request, a *apiRequest) *cacheCollection {
+	listURL := *req.URL
+	if len(a.Name) > 0 {
+		listURL.Path = strings.TrimSuffix(listURL.Path, "/"+a.Name)
+		listURL.RawPath = ""
+	}
+	// The namespace of v1beta1 & v1beta2 requests is a parameter, but any
+	// others (e.g. selectors) only narrow down the collection.
+	q := url.Values{}
+	if namespace := req.URL.Query().Get("namespace"); len(namespace) > 0 {
+		q.Set("namespace", namespace)
+	}
+	listURL.RawQuery = q.Encode()
+	key := listURL.String() + "#" + credentialsKey(req)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	coll, ok := c.collections[key]
+	if !ok {
+		coll = &cacheCollection{
+			key:       key,
+			host:      req.URL.Host,
+			resource:  a.Resource,
+			namespace: a.Namespace,
+			rt:        rt,
+			watchURL:  watchURLFor(&listURL),
+			header:    req.Header.Clone(),
+			entries:   map[*list.Element]bool{},
+		}
+		coll.ctx, coll.cancel = context.WithCancel(contextWithIdentity(context.Background(), identityFrom(req)))
+		coll.idle = time.AfterFunc(responseCacheIdleTimeout, func() { c.expireCollection(coll) })
+		c.collections[key] = coll
+		go c.watch(coll)
+	}
+	coll.lastUsed = time.Now()
+	return coll
+}
+
+// watchURLFor returns the URL watching the collection listed by u, using the
+// watch/ prefix that every API version understands.
+func watchURLFor(u *url.URL) *url.URL {
+	watch := *u
+	segments := strings.Split(u.Path, "/")
+	for i, segment := range segments {
+		if isApiVersion(segment) {
+			segments = append(segments[:i+1], append([]string{verbWatch}, segments[i+1:]...)...)
+			break
+		}
+	}
+	watch.Path, watch.RawPath = strings.Join(segments, "/"), ""
+	return &watch
+}
+
+// expireCollection stops watching coll if it hasn't been used for
+// responseCacheIdleTimeout.
+func (c *responseCache) expireCollection(coll *cacheCollection) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if idle := time.Since(coll.lastUsed); idle < responseCacheIdleTimeout {
+		coll.idle.Reset(responseCacheIdleTimeout - idle)
+		return
+	}
+	coll.cancel()
+	for elem := range coll.entries {
+		c.remove(elem)
+	}
+	delete(c.collections, coll.key)
+}
+
+// watch drops the entries of coll whenever it changes, for as long as coll is
+// in use. Collections that can't be watched fall back to a TTL.
+func (c *responseCache) watch(coll *cacheCollection) {
+	backoff := time.Second
+	for coll.ctx.Err() == nil {
+		req, err := http.NewRequestWithContext(coll.ctx, "GET", coll.watchURL.String(), nil)
+		if err != nil {
+			return
+		}
+		req.Header = coll.header.Clone()
+		resp, err := coll.rt.RoundTrip(req)
+		if err == nil && resp.StatusCode >= 400 && resp.StatusCode < 500 {
+			resp.Body.Close()
+			log.Printf("Can't watch %s for changes (%s), caching it for %v", coll.watchURL.Path, resp.Status, c.ttl)
+			c.mu.Lock()
+			coll.unwatchable = true
+			c.mu.Unlock()
+			return
+		}
+		if err == nil && resp.StatusCode == http.StatusOK {
+			c.setWatching(coll, true)
+			backoff = time.Second
+			d := json.NewDecoder(resp.Body)
+			for {
+				var event watchEvent
+				if err := d.Decode(&event); err != nil {
+					break
+				}
+				c.invalidate(coll)
+			}
+			// Changes could be missed until the watch is back.
+			c.setWatching(coll, false)
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+		select {
+		case <-time.After(backoff):
+		case <-coll.ctx.Done():
+		}
+		if backoff *= 2; backoff > 30*time.Second {
+			backoff = 30 * time.Second
+		}
+	}
+}
+
+func (c *responseCache) setWatching(coll *cacheCollection, watching bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	coll.watching = watching
+	c.invalidateLocked(coll)
+}
+
+func (c *responseCache) invalidate(coll *cacheCollection) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.invalidateLocked(coll)
+}
+
+// invalidateWritten drops the collections on the master at host that the
+// write described by a may have changed, whatever credentials they were
+// fetched with: the collection of the object written, in any API version, and
+// the list of that resource across all namespaces.
+func (c *responseCache) invalidateWritten(host string, a *apiRequest) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, coll := range c.collections {
+		if coll.host == host && strings.EqualFold(coll.resource, a.Resource) &&
+			(coll.namespace == a.Namespace || len(coll.namespace) == 0) {
+			c.invalidateLocked(coll)
+		}
+	}
+}
+
+func (c *responseCache) invalidateLocked(coll *cacheCollection) {
+	coll.generation++
+	for elem := range coll.entries {
+		c.remove(elem)
+	}
+}
+
+// state returns the generation of coll and whether responses fetched from
+// now on can be cached.
+func (c *responseCache) state(coll *cacheCollection) (uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return coll.generation, coll.watching || (coll.unwatchable && c.ttl > 0)
+}
+
+func (c *responseCache) get(key string) (http.Header, []byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, nil, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if !entry.expires.IsZero() && time.Now().After(entry.expires) {
+		c.remove(elem)
+		return nil, nil, false
+	}
+	c.lru.MoveToFront(elem)
+	return entry.header.Clone(), entry.body, true
+}
+
+// put caches body as the response for key, unless coll has changed since
+// generation or the cache no longer tracks it.
+func (c *responseCache) put(key string, coll *cacheCollection, generation uint64, header http.Header, body []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.collections[coll.key] != coll || coll.generation != generation {
+		return
+	}
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+	entry := &cacheEntry{key: key, collection: coll, header: header, body: body}
+	if !coll.watching {
+		entry.expires = time.Now().Add(c.ttl)
+	}
+	elem := c.lru.PushFront(entry)
+	c.entries[key] = elem
+	coll.entries[elem] = true
+	c.size += int64(len(body))
+	for c.size > c.maxBytes {
+		c.remove(c.lru.Back())
+	}
+}
+
+// remove drops the entry in elem. It must be called with c.mu held.
+func (c *responseCache) remove(elem *list.Element) {
+	entry := elem.Value.(*cacheEntry)
+	c.lru.Remove(elem)
+	delete(c.entries, entry.key)
+	delete(entry.collection.entries, elem)
+	c.size -= int64(len(entry.body))
+}
+
+// maxEntryBytes is the size of the largest response worth caching.
+func (c *responseCache) maxEntryBytes() int64 {
+	return c.maxBytes / 4
+}
+
+// cachingBody hands the body read through it to done once it has been read
+// in full, unless it turns out to be larger than limit.
+type cachingBody struct {
+	io.ReadCloser
+	limit int64
+	buf   bytes.Buffer
+	done  func([]byte)
+	over  bool
+}
+
+func (b *cachingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if !b.over {
+		if int64(b.buf.Len()+n) > b.limit {
+			b.over = true
+			b.buf = bytes.Buffer{}
+		} else {
+			b.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF && !b.over && b.done != nil {
+		b.done(b.buf.Bytes())
+		b.done = nil
+	}
+	return n, err
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// cacheRoundTrip makes a request for path, relative to the API prefix,
+// through the filter & transport of c to master.
+func cacheRoundTrip(t *testing.T, c *responseCache, master, method, path string) (*http.Response, string) {
+	var ctx context.Context
+	c.Filter(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx = r.Context()
+	})).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(method, path, nil))
+	req, err := http.NewRequestWithContext(ctx, method, master+"/api"+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := c.Transport(http.DefaultTransport).RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	return resp, string(body)
+}
+
+func TestResponseCacheInvalidatedByWatch(t *testing.T) {
+	var lists int32
+	events, stop := make(chan string, 1), make(chan struct{})
+	master := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.URL.Path, "/watch/") {
+			fmt.Fprintf(w, `{"kind":"PodList","n":%d}`, atomic.AddInt32(&lists, 1))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		for {
+			select {
+			case event := <-events:
+				fmt.Fprintln(w, event)
+				w.(http.Flusher).Flush()
+			case <-r.Context().Done():
+				return
+			case <-stop:
+				return
+			}
+		}
+	}))
+	defer master.Close()
+	defer close(stop)
+	c := newResponseCache(1<<20, 0)
+
+	// Responses are only cached once the watch of the collection is running.
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		if resp, _ := cacheRoundTrip(t, c, master.URL, "GET", "/v1beta3/namespaces/web/pods"); resp.Header.Get("X-Cache") == cacheHit {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("list never cached")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	resp, cached := cacheRoundTrip(t, c, master.URL, "GET", "/v1beta3/namespaces/web/pods")
+	if resp.Header.Get("X-Cache") != cacheHit {
+		t.Fatalf("got %s, want the list cached", resp.Header.Get("X-Cache"))
+	}
+
+	// A change seen by the watch drops the cached list.
+	events <- `{"type":"MODIFIED","object":{"kind":"Pod","metadata":{"name":"p1","resourceVersion":"2"}}}`
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		if resp, body := cacheRoundTrip(t, c, master.URL, "GET", "/v1beta3/namespaces/web/pods"); resp.Header.Get("X-Cache") == cacheMiss {
+			if body == cached {
+				t.Errorf("got the cached %s after a change", body)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("cached list kept after a change")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestResponseCacheInvalidatedByWrites(t *testing.T) {
+	var lists int32
+	stop := make(chan struct{})
+	master := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.Contains(r.URL.Path, "/watch/"):
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			select {
+			case <-r.Context().Done():
+			case <-stop:
+			}
+		case r.Method == "GET":
+			fmt.Fprintf(w, `{"kind":"PodList","n":%d}`, atomic.AddInt32(&lists, 1))
+		case r.URL.Query().Get("conflict") == "true":
+			w.WriteHeader(http.StatusConflict)
+		}
+	}))
+	defer master.Close()
+	defer close(stop)
+	c := newResponseCache(1<<20, 0)
+
+	// Responses are only cached once the watch of the collection is running.
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		if resp, _ := cacheRoundTrip(t, c, master.URL, "GET", "/v1beta3/namespaces/web/pods"); resp.Header.Get("X-Cache") == cacheHit {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("list never cached")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	_, cached := cacheRoundTrip(t, c, master.URL, "GET", "/v1beta3/namespaces/web/pods")
+
+	// A failed write changes nothing.
+	cacheRoundTrip(t, c, master.URL, "PUT", "/v1beta3/namespaces/web/pods/p1?conflict=true")
+	if resp, body := cacheRoundTrip(t, c, master.URL, "GET", "/v1beta3/namespaces/web/pods"); resp.Header.Get("X-Cache") != cacheHit || body != cached {
+		t.Fatalf("got %s %s after a failed write, want the cached %s", resp.Header.Get("X-Cache"), body, cached)
+	}
+
+	// Writes elsewhere don't invalidate the collection.
+	cacheRoundTrip(t, c, master.URL, "DELETE", "/v1beta3/namespaces/other/pods/p1")
+	cacheRoundTrip(t, c, master.URL, "POST", "/v1beta3/namespaces/web/services")
+	if resp, _ := cacheRoundTrip(t, c, master.URL, "GET", "/v1beta3/namespaces/web/pods"); resp.Header.Get("X-Cache") != cacheHit {
+		t.Fatalf("got %s after writes to other collections, want %s", resp.Header.Get("X-Cache"), cacheHit)
+	}
+
+	// A successful write to the collection does, even in another API version.
+	cacheRoundTrip(t, c, master.URL, "DELETE", "/v1beta1/pods/p1?namespace=web")
+	resp, body := cacheRoundTrip(t, c, master.URL, "GET", "/v1beta3/namespaces/web/pods")
+	if resp.Header.Get("X-Cache") != cacheMiss || body == cached {
+		t.Fatalf("got %s %s after a write, want a fresh response", resp.Header.Get("X-Cache"), body)
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// session is what the proxy remembers about a logged in user. It is kept by
+// the browser in a cookie, encrypted & signed so that it can't be read or
+// tampered with.
+type session struct {
+	Token  string              `json:"token,omitempty"`
+	User   string              `json:"user,omitempty"`
+	Email  string              `json:"email,omitempty"`
+	Groups []string            `json:"groups,omitempty"`
+	Extra  map[string][]string `json:"extra,omitempty"`
+}
+
+// sessionCookies seals values into cookies: they are encrypted with AES-CTR
+// and then signed with HMAC-SHA256, using keys derived from a secret. The
+// name of the cookie is part of the signature so that one cookie can't be
+// passed off as another.
+type sessionCookies struct {
+	name           string
+	maxAge         time.Duration
+	encKey, macKey []byte
+}
+
+// newSessionCookies creates a sessionCookies using the secret in secretFile,
+// or a random one if secretFile is empty.
+func newSessionCookies(name, secretFile string, maxAge time.Duration) (*sessionCookies, error) {
+	var secret []byte
+	if len(secretFile) > 0 {
+		data, err := ioutil.ReadFile(secretFile)
+		if err != nil {
+			return nil, err
+		}
+		if secret = []byte(strings.TrimSpace(string(data))); len(secret) < 32 {
+			return nil, fmt.Errorf("session secret in %s must be at least 32 bytes long", secretFile)
+		}
+	} else {
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+		log.Printf("No session secret given, sessions will end when the proxy restarts")
+	}
+	return &sessionCookies{
+		name:   name,
+		maxAge: maxAge,
+		encKey: deriveKey(secret, "encryption"),
+		macKey: deriveKey(secret, "signing"),
+	}, nil
+}
+
+func deriveKey(secret []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("k8s-proxy session " + purpose))
+	return mac.Sum(nil)
+}
+
+// sealed is the content of a cookie before it is encrypted.
+type sealed struct {
+	Expires int64           `json:"exp"`
+	Value   json.RawMessage `json:"v"`
+}
+
+// seal encrypts & signs v for the cookie called name, valid until expires.
+func (s *sessionCookies) seal(name string, v interface{}, expires time.Time) (string, error) {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := json.Marshal(&sealed{Expires: expires.Unix(), Value: value})
+	if err != nil {
+		return "", err
+	}
+	block, err := aes.NewCipher(s.encKey)
+	if err != nil {
+		return "", err
+	}
+	data := make([]byte, aes.BlockSize+len(plaintext), aes.BlockSize+len(plaintext)+sha256.Size)
+	iv := data[:aes.BlockSize]
+	if _, err := rand.Read(iv); err != nil {
+		return "", err
+	}
+	cipher.NewCTR(block, iv).XORKeyStream(data[aes.BlockSize:], plaintext)
+	data = append(data, s.sign(name, data)...)
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// open checks & decrypts a value sealed for the cookie called name into v.
+func (s *sessionCookies) open(name, cookie string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(cookie)
+	if err != nil {
+		return err
+	}
+	if len(data) < aes.BlockSize+sha256.Size {
+		return errors.New("cookie too short")
+	}
+	signed, signature := data[:len(data)-sha256.Size], data[len(data)-sha256.Size:]
+	if !hmac.Equal(signature, s.sign(name, signed)) {
+		return errors.New("bad cookie signature")
+	}
+	block, err := aes.NewCipher(s.encKey)
+	if err != nil {
+		return err
+	}
+	plaintext := make([]byte, len(signed)-aes.BlockSize)
+	cipher.NewCTR(block, signed[:aes.BlockSize]).XORKeyStream(plaintext, signed[aes.BlockSize:])
+	var content sealed
+	if err := json.Unmarshal(plaintext, &content); err != nil {
+		return err
+	}
+	if time.Now().Unix() >= content.Expires {
+		return errors.New("cookie expired")
+	}
+	return json.Unmarshal(content.Value, v)
+}
+
+func (s *sessionCookies) sign(name string, data []byte) []byte {
+	mac := hmac.New(sha256.New, s.macKey)
+	mac.Write([]byte(name))
+	mac.Write([]byte{0})
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// setCookie sets the cookie called name to v, sealed, for path.
+func (s *sessionCookies) setCookie(w http.ResponseWriter, r *http.Request, name, path string, v interface{}, expires time.Time) error {
+	value, err := s.seal(name, v, expires)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		Expires:  expires,
+		MaxAge:   int(time.Until(expires).Seconds()),
+		HttpOnly: true,
+		Secure:   isSecure(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// getCookie opens the cookie called name in r into v.
+func (s *sessionCookies) getCookie(r *http.Request, name string, v interface{}) error {
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return err
+	}
+	return s.open(name, cookie.Value, v)
+}
+
+func clearCookie(w http.ResponseWriter, r *http.Request, name, path string) {
+	http.SetCookie(w, &http.Cookie{Name: name, Path: path, MaxAge: -1, HttpOnly: true, Secure: isSecure(r)})
+}
+
+// Get returns the session of r, or nil if it hasn't got a valid one.
+func (s *sessionCookies) Get(r *http.Request) *session {
+	var sess session
+	if err := s.getCookie(r, s.name, &sess); err != nil {
+		return nil
+	}
+	return &sess
+}
+
+// Set starts sess, ending it after at most lifetime if that is shorter than
+// the maximum session age.
+func (s *sessionCookies) Set(w http.ResponseWriter, r *http.Request, sess *session, lifetime time.Duration) error {
+	if lifetime <= 0 || lifetime > s.maxAge {
+		lifetime = s.maxAge
+	}
+	return s.setCookie(w, r, s.name, "/", sess, time.Now().Add(lifetime))
+}
+
+// Clear ends the session of r.
+func (s *sessionCookies) Clear(w http.ResponseWriter, r *http.Request) {
+	clearCookie(w, r, s.name, "/")
+}
+
+// Wrap sends the token of the session of each request to the master, unless
+// the request carries its own credentials. The session cookie itself is
+// never passed on.
+func (s *sessionCookies) Wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if sess := s.Get(r); sess != nil && len(r.Header.Get("Authorization")) == 0 {
+			r.Header.Set("Authorization", "Bearer "+sess.Token)
+		}
+		removeCookie(r, s.name)
+		h.ServeHTTP(w, r)
+	})
+}
+
+// removeCookie removes the cookie called name from r, keeping any others.
+func removeCookie(r *http.Request, name string) {
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+	for _, cookie := range cookies {
+		if cookie.Name != name {
+			r.AddCookie(cookie)
+		}
+	}
+}
+
+// isSecure returns true if r was made over HTTPS, either directly or through
+// a TLS terminating proxy.
+func isSecure(r *http.Request) bool {
+	return r.TLS != nil || strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https")
+}
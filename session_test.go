@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestSessionCookies(t *testing.T, secret string) *sessionCookies {
+	dir, err := ioutil.TempDir("", "session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "secret")
+	if err := ioutil.WriteFile(path, []byte(secret+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	s, err := newSessionCookies("session", path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestSessionCookieSeal(t *testing.T) {
+	s := newTestSessionCookies(t, "0123456789abcdef0123456789abcdef")
+	sess := &session{Token: "t0ken", User: "jo", Groups: []string{"admins"}}
+	sealed, err := s.seal("session", sess, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var opened session
+	if err := s.open("session", sealed, &opened); err != nil {
+		t.Fatal(err)
+	}
+	if opened.Token != "t0ken" || opened.User != "jo" || len(opened.Groups) != 1 {
+		t.Errorf("got %+v, want %+v", opened, sess)
+	}
+	// Sealing the same value twice gives different cookies.
+	if again, _ := s.seal("session", sess, time.Now().Add(time.Hour)); again == sealed {
+		t.Errorf("sealed the same value to the same cookie twice")
+	}
+
+	// Flipping a bit anywhere, in the IV, ciphertext or signature, is caught.
+	data, _ := base64.RawURLEncoding.DecodeString(sealed)
+	for i := range data {
+		tampered := append([]byte(nil), data...)
+		tampered[i] ^= 1
+		if err := s.open("session", base64.RawURLEncoding.EncodeToString(tampered), &opened); err == nil {
+			t.Fatalf("opened a cookie with byte %d tampered with", i)
+		}
+	}
+	for _, bad := range []string{"", "not base64!", sealed[:20], sealed + "AA"} {
+		if err := s.open("session", bad, &opened); err == nil {
+			t.Errorf("opened %q", bad)
+		}
+	}
+
+	// A value sealed for one cookie can't be passed off as another.
+	if err := s.open(oauthStateCookie, sealed, &opened); err == nil {
+		t.Errorf("opened a session cookie as the state cookie")
+	}
+	// Nor opened with another secret.
+	other := newTestSessionCookies(t, "fedcba9876543210fedcba9876543210")
+	if err := other.open("session", sealed, &opened); err == nil {
+		t.Errorf("opened a cookie sealed with another secret")
+	}
+
+	expired, err := s.seal("session", sess, time.Now().Add(-time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.open("session", expired, &opened); err == nil {
+		t.Errorf("opened an expired cookie")
+	}
+}
+
+func TestSessionSecretTooShort(t *testing.T) {
+	dir, err := ioutil.TempDir("", "session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "secret")
+	ioutil.WriteFile(path, []byte("too short"), 0600)
+	if _, err := newSessionCookies("session", path, time.Hour); err == nil {
+		t.Errorf("accepted a short secret")
+	}
+}
+
+func TestSessionSetAndGet(t *testing.T) {
+	s := newTestSessionCookies(t, "0123456789abcdef0123456789abcdef")
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "https://proxy.example.com/", nil)
+	if err := s.Set(w, r, &session{Token: "t0ken"}, 2*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	cookie := w.Result().Cookies()[0]
+	if cookie.Name != "session" || !cookie.HttpOnly || !cookie.Secure || cookie.Path != "/" {
+		t.Errorf("got cookie %+v", cookie)
+	}
+	// Sessions never outlive the maximum age, whatever the token's lifetime.
+	if until := time.Until(cookie.Expires); until > time.Hour || until < time.Hour-time.Minute {
+		t.Errorf("session lasts %v, want an hour", until)
+	}
+
+	r = httptest.NewRequest("GET", "/api/v1beta3/pods", nil)
+	r.AddCookie(cookie)
+	if sess := s.Get(r); sess == nil || sess.Token != "t0ken" {
+		t.Fatalf("got session %+v", sess)
+	}
+
+	// The session cookie is swapped for the token on the way to the master.
+	var forwarded string
+	var cookies int
+	h := s.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r.Header.Get("Authorization")
+		cookies = len(r.Cookies())
+	}))
+	r.AddCookie(&http.Cookie{Name: "other", Value: "value"})
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	if forwarded != "Bearer t0ken" || cookies != 1 {
+		t.Errorf("forwarded %q with %d cookies, want the token & only the other cookie", forwarded, cookies)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// drainer coordinates a graceful shutdown: once draining starts readiness
+// fails and, after any delay, new connections are refused and long-running
+// watches & upgraded connections are ended so that they don't hold the
+// shutdown up until the timeout.
+type drainer struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu       sync.Mutex
+	draining bool
+}
+
+func newDrainer() *drainer {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &drainer{ctx: ctx, cancel: cancel}
+}
+
+// check is a readiness check that fails once draining has started.
+func (d *drainer) check() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.draining {
+		return errors.New("shutting down")
+	}
+	return nil
+}
+
+// EndStreams cancels watch & upgrade requests passing through h when draining
+// starts, so the client sees the stream end cleanly and can reconnect
+// elsewhere. Upgraded connections are hijacked, so the server wouldn't wait
+// for them, but the proxy closes them once their request is cancelled.
+func (d *drainer) EndStreams(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isWatchRequest(r) && !isUpgradeRequest(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+		stop := context.AfterFunc(d.ctx, cancel)
+		defer stop()
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// waitForSignal blocks until SIGTERM or SIGINT is received and then shuts srv
+// down.
+func (d *drainer) waitForSignal(srv *http.Server, delay, timeout time.Duration) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	d.shutdown(srv, signals, delay, timeout)
+}
+
+// shutdown shuts srv down once a signal is received on signals. It first
+// fails readiness while still serving for delay, giving load balancers time
+// to stop sending requests here, and then waits up to timeout for in-flight
+// requests to complete. A second signal ends the delay early.
+func (d *drainer) shutdown(srv *http.Server, signals <-chan os.Signal, delay, timeout time.Duration) {
+	sig := <-signals
+
+	d.mu.Lock()
+	d.draining = true
+	d.mu.Unlock()
+
+	if delay > 0 {
+		log.Printf("Received %v, failing readiness for %v before draining connections", sig, delay)
+		select {
+		case <-time.After(delay):
+		case sig = <-signals:
+			log.Printf("Received %v, draining connections now", sig)
+		}
+	}
+	log.Printf("Draining connections for up to %v", timeout)
+	d.cancel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("Connections not drained cleanly: %v", err)
+		srv.Close()
+		return
+	}
+	log.Printf("All connections drained")
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// newDrainingServer serves a watch stream, that stays open until its request
+// is cancelled, & other requests through d.
+func newDrainingServer(d *drainer) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1beta3/watch/pods", func(w http.ResponseWriter, r *http.Request) {
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	})
+	mux.HandleFunc("/api/v1beta3/pods", func(w http.ResponseWriter, r *http.Request) {})
+	return httptest.NewServer(d.EndStreams(mux))
+}
+
+func TestDrainerShutdown(t *testing.T) {
+	d := newDrainer()
+	srv := newDrainingServer(d)
+	defer srv.Close()
+	watch, err := http.Get(srv.URL + "/api/v1beta3/watch/pods")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watch.Body.Close()
+	watchEnded := make(chan error, 1)
+	go func() {
+		_, err := ioutil.ReadAll(watch.Body)
+		watchEnded <- err
+	}()
+
+	signals := make(chan os.Signal, 2)
+	done := make(chan struct{})
+	go func() {
+		d.shutdown(srv.Config, signals, 200*time.Millisecond, time.Minute)
+		close(done)
+	}()
+	signals <- syscall.SIGTERM
+
+	// Readiness fails straight away, but requests are served, & streams kept
+	// open, until the delay is up.
+	deadline := time.Now().Add(5 * time.Second)
+	for d.check() == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("readiness still passing after SIGTERM")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	resp, err := http.Get(srv.URL + "/api/v1beta3/pods")
+	if err != nil {
+		t.Fatalf("request during the delay: %v", err)
+	}
+	resp.Body.Close()
+	select {
+	case err := <-watchEnded:
+		t.Fatalf("watch ended during the delay: %v", err)
+	case <-done:
+		t.Fatal("shut down before the delay was up")
+	default:
+	}
+
+	// Then the watch is ended cleanly, so the server can shut down without
+	// waiting for the timeout.
+	select {
+	case err := <-watchEnded:
+		if err != nil {
+			t.Errorf("watch ended with %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("watch not ended")
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("server not shut down")
+	}
+	if _, err := http.Get(srv.URL + "/api/v1beta3/pods"); err == nil {
+		t.Errorf("request served after shutting down")
+	}
+}
+
+func TestDrainerSecondSignal(t *testing.T) {
+	d := newDrainer()
+	srv := newDrainingServer(d)
+	defer srv.Close()
+
+	signals := make(chan os.Signal, 2)
+	signals <- syscall.SIGTERM
+	signals <- syscall.SIGINT
+	done := make(chan struct{})
+	go func() {
+		d.shutdown(srv.Config, signals, time.Hour, time.Minute)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("second signal didn't end the delay")
+	}
+}
+
+func TestDrainerEndStreams(t *testing.T) {
+	d := newDrainer()
+	contexts, release := make(chan context.Context), make(chan struct{})
+	h := d.EndStreams(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contexts <- r.Context()
+		<-release
+	}))
+	defer close(release)
+	serve := func(r *http.Request) context.Context {
+		go h.ServeHTTP(httptest.NewRecorder(), r)
+		return <-contexts
+	}
+
+	list := serve(httptest.NewRequest("GET", "/api/v1beta3/pods", nil))
+	watch := serve(httptest.NewRequest("GET", "/api/v1beta3/pods?watch=true", nil))
+	r := httptest.NewRequest("POST", "/api/v1beta3/namespaces/web/pods/p1/exec", nil)
+	r.Header.Set("Connection", "Upgrade")
+	r.Header.Set("Upgrade", "SPDY/3.1")
+	upgrade := serve(r)
+	if watch.Err() != nil || upgrade.Err() != nil {
+		t.Fatal("streams ended before draining")
+	}
+
+	d.cancel()
+	for name, ctx := range map[string]context.Context{"watch": watch, "upgrade": upgrade} {
+		select {
+		case <-ctx.Done():
+		case <-time.After(5 * time.Second):
+			t.Errorf("%s not ended by draining", name)
+		}
+	}
+	// Other requests are left to finish.
+	if list.Err() != nil {
+		t.Errorf("list request cancelled by draining")
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/GoogleCloudPlatform/kubernetes/pkg/api"
+)
+
+// writeStatus responds with a Kubernetes Status object describing why the
+// request failed, so that API clients can handle errors raised by the proxy
+// the same way as those from the master itself.
+func writeStatus(w http.ResponseWriter, code int, reason api.StatusReason, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(statusBody(code, reason, message))
+}
+
+// statusBody returns the JSON encoding of a failure Status.
+func statusBody(code int, reason api.StatusReason, message string) []byte {
+	body, _ := json.Marshal(&api.Status{
+		TypeMeta: api.TypeMeta{Kind: "Status"},
+		Status:   api.StatusFailure,
+		Message:  message,
+		Reason:   reason,
+		Code:     code,
+	})
+	return body
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// certStore serves TLS certificates that are reloaded from disk when they
+// change, so certificates can be rotated without restarting the proxy. As well
+// as a single default cert/key pair it can load a directory of pairs, laid out
+// like mounted Kubernetes TLS secrets (<dir>/<name>/tls.crt & tls.key), and
+// select between them by SNI server name.
+type certStore struct {
+	certFile, keyFile string
+	dir               string
+
+	mu sync.RWMutex
+	// pairs holds the last successfully loaded pair for each cert file, so
+	// that a bad update leaves the previous certificate in place.
+	pairs       map[string]*tls.Certificate
+	modTimes    map[string]time.Time
+	defaultCert *tls.Certificate
+	byName      map[string]*tls.Certificate
+}
+
+func newCertStore(certFile, keyFile, dir string) (*certStore, error) {
+	s := &certStore{
+		certFile: certFile,
+		keyFile:  keyFile,
+		dir:      dir,
+		pairs:    map[string]*tls.Certificate{},
+		modTimes: map[string]time.Time{},
+	}
+	s.reload()
+	if s.defaultCert == nil {
+		return nil, errors.New("no usable TLS certificates found")
+	}
+	return s, nil
+}
+
+// keyPairFiles returns the cert/key file pairs that should currently be loaded.
+func (s *certStore) keyPairFiles() [][2]string {
+	var files [][2]string
+	if len(s.certFile) > 0 && len(s.keyFile) > 0 {
+		files = append(files, [2]string{s.certFile, s.keyFile})
+	}
+	if len(s.dir) > 0 {
+		entries, err := ioutil.ReadDir(s.dir)
+		if err != nil {
+			log.Printf("Couldn't read TLS cert dir %s: %v", s.dir, err)
+		}
+		for _, entry := range entries {
+			// Secret mounts are directories or symlinks to them.
+			certFile := filepath.Join(s.dir, entry.Name(), "tls.crt")
+			keyFile := filepath.Join(s.dir, entry.Name(), "tls.key")
+			if _, err := os.Stat(certFile); err == nil {
+				files = append(files, [2]string{certFile, keyFile})
+			}
+		}
+	}
+	return files
+}
+
+// reload (re)loads any key pairs that have changed on disk since they were
+// last loaded. Any change of modification time counts, not just a later one,
+// so that restoring an older pair (e.g. rolling back a secret) is noticed.
+func (s *certStore) reload() {
+	files := s.keyPairFiles()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pairs := make(map[string]*tls.Certificate, len(files))
+	for _, f := range files {
+		certFile, keyFile := f[0], f[1]
+		modTime := latestModTime(certFile, keyFile)
+		if prev, ok := s.pairs[certFile]; ok && modTime.Equal(s.modTimes[certFile]) {
+			pairs[certFile] = prev
+			continue
+		}
+		cert, err := loadKeyPair(certFile, keyFile)
+		if err != nil {
+			log.Printf("Couldn't load TLS key pair %s: %v", certFile, err)
+			// Don't retry until the files change again.
+			s.modTimes[certFile] = modTime
+			if prev, ok := s.pairs[certFile]; ok {
+				log.Printf("Continuing to use previous certificate for %s", certFile)
+				pairs[certFile] = prev
+			}
+			continue
+		}
+		if _, ok := s.pairs[certFile]; ok {
+			log.Printf("Reloaded TLS certificate %s for %s", certFile, strings.Join(certNames(cert), ", "))
+		}
+		pairs[certFile] = cert
+		s.modTimes[certFile] = modTime
+	}
+	s.pairs = pairs
+
+	s.byName = map[string]*tls.Certificate{}
+	s.defaultCert = nil
+	if cert, ok := pairs[s.certFile]; ok {
+		s.defaultCert = cert
+	}
+	// Index in a stable order so that the first name wins on conflicts.
+	certFiles := make([]string, 0, len(pairs))
+	for certFile := range pairs {
+		certFiles = append(certFiles, certFile)
+	}
+	sort.Strings(certFiles)
+	for _, certFile := range certFiles {
+		cert := pairs[certFile]
+		if s.defaultCert == nil {
+			s.defaultCert = cert
+		}
+		for _, name := range certNames(cert) {
+			name = strings.ToLower(name)
+			if _, ok := s.byName[name]; !ok {
+				s.byName[name] = cert
+			}
+		}
+	}
+}
+
+// watch polls for changed certificates every interval.
+func (s *certStore) watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		s.reload()
+	}
+}
+
+// GetCertificate implements tls.Config.GetCertificate, selecting a certificate
+// by SNI server name and falling back to the default certificate.
+func (s *certStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	name := strings.ToLower(hello.ServerName)
+	if cert, ok := s.byName[name]; ok {
+		return cert, nil
+	}
+	if i := strings.Index(name, "."); i > 0 {
+		if cert, ok := s.byName["*"+name[i:]]; ok {
+			return cert, nil
+		}
+	}
+	if s.defaultCert == nil {
+		return nil, fmt.Errorf("no certificate for %q", hello.ServerName)
+	}
+	return s.defaultCert, nil
+}
+
+func loadKeyPair(certFile, keyFile string) (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+// certNames returns the host names a certificate is valid for.
+func certNames(cert *tls.Certificate) []string {
+	if len(cert.Leaf.DNSNames) > 0 {
+		return cert.Leaf.DNSNames
+	}
+	if len(cert.Leaf.Subject.CommonName) > 0 {
+		return []string{cert.Leaf.Subject.CommonName}
+	}
+	return nil
+}
+
+func latestModTime(files ...string) time.Time {
+	var latest time.Time
+	for _, f := range files {
+		if fi, err := os.Stat(f); err == nil && fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest
+}
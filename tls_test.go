@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestKeyPair writes a self-signed certificate for name to certFile &
+// keyFile, modified at modTime.
+func writeTestKeyPair(t *testing.T, certFile, keyFile, name string, modTime time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.MkdirAll(filepath.Dir(certFile), 0755)
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	for _, f := range []string{certFile, keyFile} {
+		if err := os.Chtimes(f, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func servedName(t *testing.T, s *certStore, serverName string) string {
+	cert, err := s.GetCertificate(&tls.ClientHelloInfo{ServerName: serverName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert.Leaf.Subject.CommonName
+}
+
+func TestCertStoreReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	now := time.Now().Truncate(time.Second)
+	writeTestKeyPair(t, certFile, keyFile, "old.example.com", now)
+
+	s, err := newCertStore(certFile, keyFile, filepath.Join(dir, "sni"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := servedName(t, s, ""); name != "old.example.com" {
+		t.Fatalf("serving %s", name)
+	}
+
+	writeTestKeyPair(t, certFile, keyFile, "new.example.com", now.Add(time.Minute))
+	writeTestKeyPair(t, filepath.Join(dir, "sni", "a", "tls.crt"), filepath.Join(dir, "sni", "a", "tls.key"), "a.example.com", now)
+	s.reload()
+	if name := servedName(t, s, ""); name != "new.example.com" {
+		t.Errorf("after an update, serving %s", name)
+	}
+	if name := servedName(t, s, "A.example.com"); name != "a.example.com" {
+		t.Errorf("for a.example.com, serving %s", name)
+	}
+
+	// Restoring an older pair, which keeps its older modification time, is
+	// still a change.
+	writeTestKeyPair(t, certFile, keyFile, "restored.example.com", now.Add(-time.Hour))
+	s.reload()
+	if name := servedName(t, s, ""); name != "restored.example.com" {
+		t.Errorf("after a rollback, serving %s", name)
+	}
+
+	// A bad update leaves the previous pair in place.
+	ioutil.WriteFile(certFile, []byte("garbage"), 0644)
+	s.reload()
+	if name := servedName(t, s, ""); name != "restored.example.com" {
+		t.Errorf("after a bad update, serving %s", name)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	k8sclient "github.com/GoogleCloudPlatform/kubernetes/pkg/client"
+)
+
+// tokenFile is a bearer token read from a file that may be rotated, such as a
+// mounted service account token. The file is checked for changes at most once
+// per interval, or straight away after the master rejects the token.
+type tokenFile struct {
+	path     string
+	interval time.Duration
+
+	mu      sync.Mutex
+	token   string
+	modTime time.Time
+	checked time.Time
+}
+
+func newTokenFile(path string, interval time.Duration) (*tokenFile, error) {
+	t := &tokenFile{path: path, interval: interval}
+	if err := t.reload(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// reload re-reads the token if the file has changed. It must be called with
+// t.mu held, or before t is shared.
+func (t *tokenFile) reload() error {
+	t.checked = time.Now()
+	fi, err := os.Stat(t.path)
+	if err != nil {
+		return err
+	}
+	if len(t.token) > 0 && fi.ModTime().Equal(t.modTime) {
+		return nil
+	}
+	data, err := ioutil.ReadFile(t.path)
+	if err != nil {
+		return err
+	}
+	token := strings.TrimSpace(string(data))
+	if len(token) == 0 {
+		return fmt.Errorf("token file %s is empty", t.path)
+	}
+	if len(t.token) > 0 && token != t.token {
+		log.Printf("Reloaded token from %s", t.path)
+	}
+	t.token, t.modTime = token, fi.ModTime()
+	return nil
+}
+
+// Token returns the current token, re-reading the file if it is due a check.
+// If the file can't be read the previous token continues to be used.
+func (t *tokenFile) Token() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if time.Since(t.checked) >= t.interval {
+		if err := t.reload(); err != nil {
+			log.Printf("Couldn't reload token from %s: %v", t.path, err)
+		}
+	}
+	return t.token
+}
+
+// expire forces the file to be checked on the next call to Token.
+func (t *tokenFile) expire() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.checked = time.Time{}
+}
+
+// tokenFileTransport authenticates requests with the current token from a
+// tokenFile.
+type tokenFileTransport struct {
+	tokens *tokenFile
+	rt     http.RoundTripper
+}
+
+func (t *tokenFileTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	r2 := new(http.Request)
+	*r2 = *req
+	r2.Header = make(http.Header, len(req.Header))
+	for k, v := range req.Header {
+		r2.Header[k] = v
+	}
+	r2.Header.Set("Authorization", fmt.Sprintf("Bearer %s", t.tokens.Token()))
+	resp, err := t.rt.RoundTrip(r2)
+	if err == nil && resp.StatusCode == http.StatusUnauthorized {
+		t.tokens.expire()
+	}
+	return resp, err
+}
+
+// withTokenFile returns a copy of config that authenticates using tokens
+// instead of any credentials in config. The TLS settings of config are
+// folded into its Transport, which the Kubernetes client doesn't allow to be
+// combined with them.
+func withTokenFile(config *k8sclient.Config, tokens *tokenFile) (*k8sclient.Config, error) {
+	tlsConfig, err := k8sclient.TLSConfigFor(config)
+	if err != nil {
+		return nil, err
+	}
+	rt := config.Transport
+	if rt == nil {
+		rt = http.DefaultTransport
+		if tlsConfig != nil {
+			// Keep the proxy, timeouts & connection limits of the default.
+			transport := http.DefaultTransport.(*http.Transport).Clone()
+			transport.TLSClientConfig = tlsConfig
+			rt = transport
+		}
+	}
+	c := *config
+	c.Transport = &tokenFileTransport{tokens: tokens, rt: rt}
+	c.TLSClientConfig = k8sclient.TLSClientConfig{}
+	c.Insecure = false
+	c.BearerToken, c.Username, c.Password = "", "", ""
+	return &c, nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	k8sclient "github.com/GoogleCloudPlatform/kubernetes/pkg/client"
+)
+
+// tokenMaster accepts only its current token, recording those it is sent.
+type tokenMaster struct {
+	*httptest.Server
+	mu    sync.Mutex
+	token string
+	sent  []string
+}
+
+func newTokenMaster(token string) *tokenMaster {
+	m := &tokenMaster{token: token}
+	m.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.sent = append(m.sent, r.Header.Get("Authorization"))
+		if r.Header.Get("Authorization") != "Bearer "+m.token {
+			http.Error(w, "401 unauthorized", http.StatusUnauthorized)
+		}
+	}))
+	return m
+}
+
+func (m *tokenMaster) rotate(token string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.token = token
+}
+
+func writeToken(t *testing.T, path, token string, modTime time.Time) {
+	if err := ioutil.WriteFile(path, []byte(token+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTokenFileTransport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "token")
+	now := time.Now()
+	writeToken(t, path, "first", now)
+
+	master := newTokenMaster("first")
+	defer master.Close()
+	tokens, err := newTokenFile(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := withTokenFile(&k8sclient.Config{Host: master.URL, BearerToken: "static", Username: "u", Password: "p"}, tokens)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.BearerToken) > 0 || len(config.Username) > 0 || len(config.Password) > 0 {
+		t.Errorf("other credentials kept: %+v", config)
+	}
+	client := &http.Client{Transport: config.Transport}
+	get := func() int {
+		resp, err := client.Get(master.URL + "/api")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := get(); code != http.StatusOK {
+		t.Fatalf("got %d", code)
+	}
+
+	// Once rotated, the old token is used until the master rejects it, and
+	// the file is then re-read straight away.
+	writeToken(t, path, "second", now.Add(time.Minute))
+	master.rotate("second")
+	if code := get(); code != http.StatusUnauthorized {
+		t.Errorf("got %d before the token was re-read, want 401", code)
+	}
+	if code := get(); code != http.StatusOK {
+		t.Errorf("got %d after a 401, want the new token accepted", code)
+	}
+
+	// Otherwise it is re-read when the interval is up.
+	writeToken(t, path, "third", now.Add(2*time.Minute))
+	if token := tokens.Token(); token != "second" {
+		t.Errorf("re-read within the interval: got %q", token)
+	}
+	tokens.mu.Lock()
+	tokens.checked = time.Now().Add(-time.Hour)
+	tokens.mu.Unlock()
+	if token := tokens.Token(); token != "third" {
+		t.Errorf("after the interval: got %q, want the new token", token)
+	}
+
+	// A file that can't be read leaves the last token in use.
+	os.Remove(path)
+	tokens.expire()
+	if token := tokens.Token(); token != "third" {
+		t.Errorf("without the file: got %q, want the last token", token)
+	}
+
+	master.mu.Lock()
+	defer master.mu.Unlock()
+	want := []string{"Bearer first", "Bearer first", "Bearer second"}
+	for i := range want {
+		if master.sent[i] != want[i] {
+			t.Errorf("master was sent %v, want %v", master.sent, want)
+			break
+		}
+	}
+}
+
+func TestWithTokenFileTransport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "token")
+	writeToken(t, path, "t0ken", time.Now())
+	tokens, err := newTokenFile(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := withTokenFile(&k8sclient.Config{Host: "https://master:8443", Insecure: true}, tokens)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport, ok := config.Transport.(*tokenFileTransport).rt.(*http.Transport)
+	if !ok {
+		t.Fatalf("got transport %T", config.Transport.(*tokenFileTransport).rt)
+	}
+	// The TLS settings are folded into a copy of the default transport.
+	if transport == http.DefaultTransport || transport.TLSClientConfig == nil || !transport.TLSClientConfig.InsecureSkipVerify {
+		t.Errorf("TLS settings not in the transport: %+v", transport.TLSClientConfig)
+	}
+	if transport.Proxy == nil || transport.TLSHandshakeTimeout == 0 || transport.IdleConnTimeout == 0 || transport.DialContext == nil {
+		t.Errorf("default transport settings lost: %+v", transport)
+	}
+	if config.Insecure {
+		t.Errorf("TLS settings left in the config")
+	}
+}
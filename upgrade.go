@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"strings"
+)
+
+// Connection upgrades (WebSockets & SPDY, as used by exec, attach &
+// port-forward) are handled by httputil.ReverseProxy itself: the upgrade
+// request is sent through the cluster's transport, so the master is dialed
+// with the same TLS config & credentials as for any other request, and on a
+// 101 response the client connection is hijacked and spliced to the master's
+// both ways. Every ResponseWriter wrapped around the proxies must therefore
+// pass Hijack & Flush through.
+
+// streamingSubresources open interactive streams into a container. The API
+// treats them as creating something whatever the method, as a WebSocket
+// upgrade always uses GET.
+var streamingSubresources = map[string]bool{
+	"exec":        true,
+	"attach":      true,
+	"portforward": true,
+}
+
+// isUpgradeRequest returns true if r asks to switch to another protocol.
+func isUpgradeRequest(r *http.Request) bool {
+	if len(r.Header.Get("Upgrade")) == 0 {
+		return false
+	}
+	for _, value := range r.Header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// bearerProtocolPrefix is the WebSocket subprotocol browsers, which can't set
+// headers on WebSocket requests, use to send a bearer token to Kubernetes.
+const bearerProtocolPrefix = "base64url.bearer.authorization.k8s.io."
+
+// webSocketToken returns the bearer token sent as a WebSocket subprotocol in
+// r, if any.
+func webSocketToken(r *http.Request) string {
+	for _, protocol := range webSocketProtocols(r) {
+		if strings.HasPrefix(protocol, bearerProtocolPrefix) {
+			token, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(protocol[len(bearerProtocolPrefix):], "="))
+			if err == nil {
+				return string(token)
+			}
+		}
+	}
+	return ""
+}
+
+// stripWebSocketToken removes any bearer token subprotocol from r, leaving the
+// others for the master to choose from.
+func stripWebSocketToken(r *http.Request) {
+	protocols := webSocketProtocols(r)
+	if len(protocols) == 0 {
+		return
+	}
+	r.Header.Del("Sec-WebSocket-Protocol")
+	for _, protocol := range protocols {
+		if !strings.HasPrefix(protocol, bearerProtocolPrefix) {
+			r.Header.Add("Sec-WebSocket-Protocol", protocol)
+		}
+	}
+}
+
+func webSocketProtocols(r *http.Request) []string {
+	var protocols []string
+	for _, value := range r.Header.Values("Sec-WebSocket-Protocol") {
+		for _, protocol := range strings.Split(value, ",") {
+			if protocol = strings.TrimSpace(protocol); len(protocol) > 0 {
+				protocols = append(protocols, protocol)
+			}
+		}
+	}
+	return protocols
+}
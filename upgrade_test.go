@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	k8sclient "github.com/GoogleCloudPlatform/kubernetes/pkg/client"
+)
+
+// newUpgradeMaster returns a master that switches exec requests to a
+// protocol echoing back each line upper-cased, and that streams watches an
+// event at a time, sending the second only once next is signalled.
+func newUpgradeMaster(next chan struct{}) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/exec") && isUpgradeRequest(r):
+			conn, rw, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: test\r\n\r\n")
+			rw.Flush()
+			for {
+				line, err := rw.ReadString('\n')
+				if err != nil {
+					return
+				}
+				rw.WriteString(strings.ToUpper(line))
+				rw.Flush()
+			}
+		case strings.Contains(r.URL.Path, "/watch/"):
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintln(w, `{"type":"ADDED","object":{"kind":"Pod","metadata":{"name":"p1"}}}`)
+			w.(http.Flusher).Flush()
+			select {
+			case <-next:
+			case <-r.Context().Done():
+				return
+			}
+			fmt.Fprintln(w, `{"type":"DELETED","object":{"kind":"Pod","metadata":{"name":"p1"}}}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+// newTestProxy returns a proxy to master with every filter, transport &
+// ResponseWriter wrapper that can sit in front of an upgrade or stream.
+func newTestProxy(t *testing.T, master string) *httptest.Server {
+	dir, err := ioutil.TempDir("", "static")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "404.html"), []byte("<p>not found</p>"), 0644)
+
+	metrics := newProxyMetrics()
+	rateLimiter, err := newRateLimiter(map[string]rateLimit{}, 10, RateLimitByUser, metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	redactor, err := newRedactor([]string{"Secret"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := newResponseCache(1<<20, 0)
+	upstream := &upstreamOptions{
+		metrics:       metrics,
+		redactor:      redactor,
+		shareWatches:  true,
+		cache:         cache,
+		rateLimiter:   rateLimiter,
+		masterBalance: MasterBalanceLeastConnections,
+		resilience:    &resilienceOptions{retries: 1, backoff: time.Millisecond, timeout: time.Second, breakerFailures: 5, breakerCooldown: time.Second},
+		filters: []func(http.Handler) http.Handler{
+			(&reloadablePolicy{policy: &Policy{Default: policyAllow}}).Enforce,
+			redactor.Filter,
+			ShareWatches,
+			cache.Filter,
+		},
+	}
+	c, err := newCluster("test", &k8sclient.Config{Host: master, Version: "v1beta3"}, []string{master, master}, "", upstream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/api/", c.ApiHandler("/api/"))
+
+	authProxy, err := newAuthProxy([]string{"X-Remote-User"}, nil, nil, []string{"127.0.0.1/32"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var handler http.Handler = newDrainer().EndStreams(mux)
+	handler = Handle404(handler, http.Dir(dir), "404.html")
+	handler = authProxy.Wrap(handler)
+	handler = ClientCertAuthenticator(handler)
+	handler = metrics.Instrument(handler, &routeClassifier{apiPrefix: "/api/", has404Fallback: true})
+	if handler, err = AccessLogger(handler, JSONLogFormat); err != nil {
+		t.Fatal(err)
+	}
+	return httptest.NewServer(handler)
+}
+
+func TestUpgradePassesThroughWrappers(t *testing.T) {
+	master := newUpgradeMaster(nil)
+	defer master.Close()
+	proxy := newTestProxy(t, master.URL)
+	defer proxy.Close()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(proxy.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprint(conn, "POST /api/v1beta3/namespaces/web/pods/p1/exec HTTP/1.1\r\nHost: proxy\r\n"+
+		"X-Remote-User: jo\r\nConnection: Upgrade\r\nUpgrade: test\r\n\r\n")
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		body, _ := ioutil.ReadAll(resp.Body)
+		t.Fatalf("got %s %s, want 101", resp.Status, body)
+	}
+	for _, line := range []string{"hello\n", "again\n"} {
+		fmt.Fprint(conn, line)
+		echoed, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if echoed != strings.ToUpper(line) {
+			t.Errorf("got %q back, want %q", echoed, strings.ToUpper(line))
+		}
+	}
+}
+
+func TestStreamsFlushThroughWrappers(t *testing.T) {
+	next := make(chan struct{})
+	master := newUpgradeMaster(next)
+	defer master.Close()
+	proxy := newTestProxy(t, master.URL)
+	defer proxy.Close()
+
+	req, err := http.NewRequest("GET", proxy.URL+"/api/v1beta3/watch/namespaces/web/pods", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Remote-User", "jo")
+	resp, err := (&http.Client{Timeout: 5 * time.Second}).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	r := bufio.NewReader(resp.Body)
+	// The master only sends the second event once the first has arrived,
+	// which it only does if every wrapper flushes it.
+	first, err := r.ReadString('\n')
+	if err != nil || !strings.Contains(first, "ADDED") {
+		t.Fatalf("got %q, %v, want the first event", first, err)
+	}
+	close(next)
+	second, err := r.ReadString('\n')
+	if err != nil || !strings.Contains(second, "DELETED") {
+		t.Fatalf("got %q, %v, want the second event", second, err)
+	}
+}
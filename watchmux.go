@@ -0,0 +1,714 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/kubernetes/pkg/api"
+	"github.com/GoogleCloudPlatform/kubernetes/pkg/client/cache"
+	"github.com/GoogleCloudPlatform/kubernetes/pkg/runtime"
+	"github.com/GoogleCloudPlatform/kubernetes/pkg/watch"
+)
+
+// Watches of a whole collection can be shared: the first client to watch a
+// collection (with a given label & field selector, and credentials) starts a
+// reflector against the master, and every other client watching the same
+// collection is served from it. Clients joining late are sent the current
+// state as ADDED events or, if they ask for a resourceVersion, the events
+// since then.
+
+const (
+	// sharedWatchQueueLength is how many events can be queued for a client
+	// before it is considered too slow and disconnected.
+	sharedWatchQueueLength = 1000
+	// sharedWatchHistory is how many events are kept to replay to clients
+	// resuming a watch from an earlier resourceVersion.
+	sharedWatchHistory = 1000
+	// sharedWatchIdleTimeout is how long a shared watch is kept running after
+	// its last client has gone.
+	sharedWatchIdleTimeout = 30 * time.Second
+)
+
+// statusReasonGone tells a client that its watch can't be resumed from the
+// resourceVersion it asked for and that it needs to list again.
+const statusReasonGone api.StatusReason = "Gone"
+
+type sharedWatchKey struct{}
+
+// ShareWatches marks requests watching a whole collection, so that the watch
+// multiplexer in the transport of the cluster can serve them.
+func ShareWatches(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a := parseApiRequest(r)
+		if a.Verb == verbWatch && len(a.Resource) > 0 && len(a.Name) == 0 && r.Method == "GET" && !isUpgradeRequest(r) {
+			r = r.WithContext(context.WithValue(r.Context(), sharedWatchKey{}, true))
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// watchMultiplexer is a transport serving the watches marked by ShareWatches
+// from shared watches, which it makes through rt. Other requests go straight
+// to rt.
+type watchMultiplexer struct {
+	rt http.RoundTripper
+
+	mu      sync.Mutex
+	watches map[string]*sharedWatch
+}
+
+func newWatchMultiplexer(rt http.RoundTripper) *watchMultiplexer {
+	return &watchMultiplexer{rt: rt, watches: map[string]*sharedWatch{}}
+}
+
+func (m *watchMultiplexer) RoundTrip(req *http.Request) (*http.Response, error) {
+	if shared, _ := req.Context().Value(sharedWatchKey{}).(bool); !shared {
+		return m.rt.RoundTrip(req)
+	}
+	since, ok := parseResourceVersion(req.URL.Query().Get("resourceVersion"))
+	if !ok {
+		return m.rt.RoundTrip(req)
+	}
+	sw, err := m.acquire(req)
+	if err == nil {
+		var resp *http.Response
+		if resp, err = sw.subscribe(req, since); err == nil {
+			return resp, nil
+		}
+		m.release(sw)
+	}
+	if req.Context().Err() != nil {
+		return nil, req.Context().Err()
+	}
+	log.Printf("Couldn't share watch of %s, passing it through: %v", req.URL.Path, err)
+	return m.rt.RoundTrip(req)
+}
+
+// acquire returns the shared watch req can be served from, starting it if
+// need be. It must be released once the client is done with it.
+func (m *watchMultiplexer) acquire(req *http.Request) (*sharedWatch, error) {
+	key := sharedWatchKeyFor(req)
+	m.mu.Lock()
+	sw, ok := m.watches[key]
+	if !ok {
+		sw = newSharedWatch(m, key, req)
+		m.watches[key] = sw
+		log.Printf("Starting shared watch of %s", sw.describe())
+		sw.start()
+	}
+	sw.clients++
+	if sw.idle != nil {
+		sw.idle.Stop()
+		sw.idle = nil
+	}
+	m.mu.Unlock()
+
+	select {
+	case <-sw.ready:
+	case <-req.Context().Done():
+		m.release(sw)
+		return nil, req.Context().Err()
+	}
+	sw.mu.Lock()
+	err := sw.err
+	sw.mu.Unlock()
+	if err != nil {
+		m.release(sw)
+		return nil, err
+	}
+	return sw, nil
+}
+
+// release stops sw if it has had no clients for sharedWatchIdleTimeout.
+func (m *watchMultiplexer) release(sw *sharedWatch) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sw.clients--
+	if sw.clients > 0 || m.watches[sw.key] != sw {
+		return
+	}
+	sw.idle = time.AfterFunc(sharedWatchIdleTimeout, func() {
+		m.mu.Lock()
+		if sw.clients > 0 || m.watches[sw.key] != sw {
+			m.mu.Unlock()
+			return
+		}
+		delete(m.watches, sw.key)
+		m.mu.Unlock()
+		log.Printf("Stopping idle shared watch of %s", sw.describe())
+		sw.stop()
+	})
+}
+
+func (m *watchMultiplexer) remove(sw *sharedWatch) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.watches[sw.key] == sw {
+		delete(m.watches, sw.key)
+	}
+}
+
+// sharedWatchKeyFor identifies the collection watched by req, along with the
+// credentials it is watched with so that clients only ever see what they
+// could have seen by watching it themselves.
+func sharedWatchKeyFor(req *http.Request) string {
+	return collectionURL(req.URL).String() + "#" + credentialsKey(req)
+}
+
+// collectionURL returns the URL listing the collection watched by u.
+func collectionURL(u *url.URL) *url.URL {
+	list := *u
+	segments := strings.Split(u.Path, "/")
+	for i := 1; i < len(segments); i++ {
+		// The watch/ prefix comes straight after the API version.
+		if segments[i] == verbWatch && isApiVersion(segments[i-1]) {
+			segments = append(segments[:i], segments[i+1:]...)
+			break
+		}
+	}
+	list.Path, list.RawPath = strings.Join(segments, "/"), ""
+	q := watchQuery(u)
+	q.Del("watch")
+	list.RawQuery = q.Encode()
+	return &list
+}
+
+// watchQuery returns the query of the watch u without the parameters that
+// differ between clients watching the same thing.
+func watchQuery(u *url.URL) url.Values {
+	q := u.Query()
+	q.Del("resourceVersion")
+	q.Del("timeoutSeconds")
+	return q
+}
+
+func isApiVersion(segment string) bool {
+	return len(segment) > 1 && segment[0] == 'v' && segment[1] >= '0' && segment[1] <= '9'
+}
+
+// parseResourceVersion parses the resourceVersion a client asks to watch
+// from, with none or "0" meaning from the current state. Resource versions
+// are meant to be opaque, so watches from ones that aren't numbers aren't
+// shared.
+func parseResourceVersion(version string) (uint64, bool) {
+	if len(version) == 0 {
+		return 0, true
+	}
+	n, err := strconv.ParseUint(version, 10, 64)
+	return n, err == nil
+}
+
+// sharedWatch keeps a cache.Store of a collection up to date using a
+// cache.Reflector, and broadcasts every change made to the store to its
+// clients. Events are numbered so that clients too slow to keep up, whose
+// events get dropped, can be disconnected; they then resume from their last
+// resourceVersion by replaying the history of recent events.
+type sharedWatch struct {
+	cache.Store
+
+	m        *watchMultiplexer
+	key      string
+	listURL  *url.URL
+	watchURL *url.URL
+	header   http.Header
+	// ctx carries the identity of the first client and is cancelled when the
+	// shared watch is stopped.
+	ctx    context.Context
+	cancel context.CancelFunc
+	ready  chan struct{}
+	synced sync.Once
+
+	// clients & idle are guarded by m.mu.
+	clients int
+	idle    *time.Timer
+
+	mu          sync.Mutex
+	err         error
+	stopped     bool
+	broadcaster *watch.Broadcaster
+	seq         uint64
+	// listVersion is the resourceVersion of the last list, from the
+	// reflector's goroutine.
+	listVersion uint64
+	// version is the latest resourceVersion seen, and history holds the
+	// events since historyVersion.
+	version        uint64
+	history        []watch.Event
+	historyVersion uint64
+}
+
+func newSharedWatch(m *watchMultiplexer, key string, req *http.Request) *sharedWatch {
+	sw := &sharedWatch{
+		Store:       cache.NewStore(cache.MetaNamespaceKeyFunc),
+		m:           m,
+		key:         key,
+		listURL:     collectionURL(req.URL),
+		header:      req.Header.Clone(),
+		ready:       make(chan struct{}),
+		broadcaster: watch.NewBroadcaster(sharedWatchQueueLength, watch.DropIfChannelFull),
+	}
+	watchURL := *req.URL
+	watchURL.RawQuery = watchQuery(req.URL).Encode()
+	sw.watchURL = &watchURL
+	// Let the transport negotiate compression, as it then undoes it itself.
+	sw.header.Del("Accept-Encoding")
+	sw.ctx, sw.cancel = context.WithCancel(contextWithIdentity(context.Background(), identityFrom(req)))
+	return sw
+}
+
+func (sw *sharedWatch) start() {
+	lw := &cache.ListWatch{ListFunc: sw.listCollection, WatchFunc: sw.watchCollection}
+	cache.NewReflector(lw, &rawObject{}, sw).RunUntil(sw.ctx.Done())
+}
+
+// stop ends the reflector and the streams of all clients.
+func (sw *sharedWatch) stop() {
+	sw.cancel()
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	if !sw.stopped {
+		sw.stopped = true
+		sw.broadcaster.Shutdown()
+	}
+}
+
+// fail stops sw after it couldn't list the collection, so that its clients
+// reconnect & get the error from the master themselves.
+func (sw *sharedWatch) fail(err error) {
+	log.Printf("Stopping shared watch of %s: %v", sw.describe(), err)
+	sw.m.remove(sw)
+	sw.mu.Lock()
+	sw.err = err
+	sw.mu.Unlock()
+	sw.stop()
+	sw.synced.Do(func() { close(sw.ready) })
+}
+
+func (sw *sharedWatch) describe() string {
+	if len(sw.listURL.RawQuery) == 0 {
+		return sw.listURL.Path
+	}
+	return sw.listURL.Path + "?" + sw.listURL.RawQuery
+}
+
+// listCollection lists the collection for the reflector.
+func (sw *sharedWatch) listCollection() (runtime.Object, error) {
+	resp, err := sw.get(sw.listURL)
+	if err == nil {
+		defer resp.Body.Close()
+		var list *rawList
+		if list, err = decodeRawList(resp.Body); err == nil {
+			sw.listVersion, _ = parseResourceVersion(list.ResourceVersion)
+			return list, nil
+		}
+	}
+	if sw.ctx.Err() == nil {
+		sw.fail(err)
+	}
+	return nil, err
+}
+
+// watchCollection watches the collection from resourceVersion for the
+// reflector.
+func (sw *sharedWatch) watchCollection(resourceVersion string) (watch.Interface, error) {
+	u := *sw.watchURL
+	q := u.Query()
+	q.Set("resourceVersion", resourceVersion)
+	u.RawQuery = q.Encode()
+	resp, err := sw.get(&u)
+	if err != nil {
+		if sw.ctx.Err() != nil {
+			// Stopped, which the reflector treats as a normal end to the watch.
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+	return watch.NewStreamWatcher(&rawEventDecoder{ctx: sw.ctx, body: resp.Body, d: json.NewDecoder(resp.Body)}), nil
+}
+
+func (sw *sharedWatch) get(u *url.URL) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(sw.ctx, "GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = sw.header.Clone()
+	resp, err := sw.m.rt.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("%s from %s: %s", resp.Status, u.Path, bytes.TrimSpace(body))
+	}
+	return resp, nil
+}
+
+// Add implements cache.Store.
+func (sw *sharedWatch) Add(obj interface{}) error {
+	return sw.record(watch.Added, obj, sw.Store.Add)
+}
+
+// Update implements cache.Store.
+func (sw *sharedWatch) Update(obj interface{}) error {
+	return sw.record(watch.Modified, obj, sw.Store.Update)
+}
+
+// Delete implements cache.Store.
+func (sw *sharedWatch) Delete(obj interface{}) error {
+	return sw.record(watch.Deleted, obj, sw.Store.Delete)
+}
+
+func (sw *sharedWatch) record(eventType watch.EventType, obj interface{}, apply func(interface{}) error) error {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	if err := apply(obj); err != nil {
+		return err
+	}
+	raw := obj.(*rawObject)
+	version, _ := parseResourceVersion(raw.ResourceVersion)
+	if version > sw.version {
+		sw.version = version
+	}
+	sw.broadcast(eventType, raw, version)
+	return nil
+}
+
+// Replace implements cache.Store. Clients are sent the difference between
+// the old & new contents of the store, but the history starts afresh as the
+// master may have dropped events in between. If the store can't be replaced,
+// sw is stopped as if the list had failed, rather than leaving clients
+// waiting for it to be ready.
+func (sw *sharedWatch) Replace(items []interface{}) error {
+	if err := sw.replace(items); err != nil {
+		sw.fail(err)
+		return err
+	}
+	return nil
+}
+
+func (sw *sharedWatch) replace(items []interface{}) error {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	old := map[string]*rawObject{}
+	for _, obj := range sw.Store.List() {
+		if key, err := cache.MetaNamespaceKeyFunc(obj); err == nil {
+			old[key] = obj.(*rawObject)
+		}
+	}
+	if err := sw.Store.Replace(items); err != nil {
+		return err
+	}
+	for _, item := range items {
+		obj := item.(*rawObject)
+		key, err := cache.MetaNamespaceKeyFunc(obj)
+		if err != nil {
+			continue
+		}
+		if prev, ok := old[key]; !ok {
+			sw.broadcast(watch.Added, obj, 0)
+		} else if prev.ResourceVersion != obj.ResourceVersion {
+			sw.broadcast(watch.Modified, obj, 0)
+		}
+		delete(old, key)
+	}
+	for _, obj := range old {
+		sw.broadcast(watch.Deleted, obj, 0)
+	}
+	sw.version, sw.historyVersion, sw.history = sw.listVersion, sw.listVersion, nil
+	sw.synced.Do(func() { close(sw.ready) })
+	return nil
+}
+
+// broadcast sends an event to all clients & records it in the history. It
+// must be called with sw.mu held. version is 0 for events made up from a
+// relist, which aren't kept.
+func (sw *sharedWatch) broadcast(eventType watch.EventType, obj *rawObject, version uint64) {
+	if sw.stopped {
+		return
+	}
+	sw.seq++
+	event := watch.Event{Type: eventType, Object: &sequencedObject{seq: sw.seq, version: version, object: obj}}
+	sw.broadcaster.Action(event.Type, event.Object)
+	if version == 0 {
+		return
+	}
+	sw.history = append(sw.history, event)
+	if len(sw.history) > sharedWatchHistory {
+		sw.historyVersion = sw.history[0].Object.(*sequencedObject).version
+		sw.history = sw.history[1:]
+	}
+}
+
+// subscribe returns a watch response streaming the events of sw since the
+// resourceVersion since to the client making req.
+func (sw *sharedWatch) subscribe(req *http.Request, since uint64) (*http.Response, error) {
+	sw.mu.Lock()
+	if sw.stopped {
+		sw.mu.Unlock()
+		return nil, errors.New("shared watch stopped")
+	}
+	var backlog []watch.Event
+	switch {
+	case since == 0:
+		items := sw.Store.List()
+		sort.Sort(byKey(items))
+		for _, obj := range items {
+			backlog = append(backlog, watch.Event{Type: watch.Added, Object: obj.(*rawObject)})
+		}
+	case since < sw.historyVersion:
+		version := sw.historyVersion
+		sw.mu.Unlock()
+		sw.m.release(sw)
+		message := fmt.Sprintf("too old resource version: %d (%d)", since, version)
+		body, _ := json.Marshal(&watchEvent{Type: watch.Error, Object: statusBody(http.StatusGone, statusReasonGone, message)})
+		return watchResponse(req, ioutil.NopCloser(bytes.NewReader(body))), nil
+	default:
+		for _, event := range sw.history {
+			if obj := event.Object.(*sequencedObject); obj.version > since {
+				backlog = append(backlog, watch.Event{Type: event.Type, Object: obj.object})
+			}
+		}
+	}
+	w := sw.broadcaster.Watch()
+	seq := sw.seq
+	sw.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if seconds, err := strconv.Atoi(req.URL.Query().Get("timeoutSeconds")); err == nil && seconds > 0 {
+		timeout = time.After(time.Duration(seconds) * time.Second)
+	}
+	pr, pw := io.Pipe()
+	go sw.serve(req.Context(), pw, backlog, w, seq, since, timeout)
+	return watchResponse(req, pr), nil
+}
+
+// serve writes the backlog & then the events of w after seq to pw.
+func (sw *sharedWatch) serve(ctx context.Context, pw *io.PipeWriter, backlog []watch.Event, w watch.Interface, seq, since uint64, timeout <-chan time.Time) {
+	defer sw.m.release(sw)
+	defer w.Stop()
+	e := json.NewEncoder(pw)
+	for _, event := range backlog {
+		if err := e.Encode(&watchEvent{Type: event.Type, Object: event.Object.(*rawObject).raw}); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+	}
+	for {
+		select {
+		case event, ok := <-w.ResultChan():
+			if !ok {
+				pw.Close()
+				return
+			}
+			obj := event.Object.(*sequencedObject)
+			if obj.seq <= seq {
+				continue
+			}
+			if obj.seq != seq+1 {
+				log.Printf("Client of shared watch of %s fell behind, disconnecting it", sw.describe())
+				pw.Close()
+				return
+			}
+			seq = obj.seq
+			if obj.version != 0 && obj.version <= since {
+				// The client asked for a resourceVersion newer than the
+				// shared watch had got to.
+				continue
+			}
+			if err := e.Encode(&watchEvent{Type: event.Type, Object: obj.object.raw}); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		case <-timeout:
+			pw.Close()
+			return
+		case <-ctx.Done():
+			pw.CloseWithError(ctx.Err())
+			return
+		}
+	}
+}
+
+func watchResponse(req *http.Request, body io.ReadCloser) *http.Response {
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"application/json"}},
+		Body:          body,
+		ContentLength: -1,
+		Request:       req,
+	}
+}
+
+type byKey []interface{}
+
+func (s byKey) Len() int      { return len(s) }
+func (s byKey) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byKey) Less(i, j int) bool {
+	a, _ := cache.MetaNamespaceKeyFunc(s[i])
+	b, _ := cache.MetaNamespaceKeyFunc(s[j])
+	return a < b
+}
+
+// sequencedObject wraps the objects of broadcast events with their number.
+type sequencedObject struct {
+	seq     uint64
+	version uint64
+	object  *rawObject
+}
+
+func (*sequencedObject) IsAnAPIObject() {}
+
+type watchEvent struct {
+	Type   watch.EventType `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+// rawObject is an API object as encoded by the master, with just enough of
+// its metadata decoded for it to be kept in a cache.Store. It is sent on to
+// clients as is, so that whatever the API version, nothing is lost.
+type rawObject struct {
+	api.TypeMeta
+	api.ObjectMeta
+	raw json.RawMessage
+}
+
+func (*rawObject) IsAnAPIObject() {}
+
+type rawList struct {
+	api.TypeMeta
+	api.ListMeta
+	Items []runtime.Object
+}
+
+func (*rawList) IsAnAPIObject() {}
+
+// rawMeta holds the metadata of either v1beta1 & v1beta2 objects, where it is
+// at the top level, or v1beta3 ones, where it is under metadata.
+type rawMeta struct {
+	Kind            string          `json:"kind"`
+	APIVersion      string          `json:"apiVersion"`
+	ID              string          `json:"id"`
+	Namespace       string          `json:"namespace"`
+	ResourceVersion json.RawMessage `json:"resourceVersion"`
+	Metadata        struct {
+		Name            string          `json:"name"`
+		Namespace       string          `json:"namespace"`
+		ResourceVersion json.RawMessage `json:"resourceVersion"`
+	} `json:"metadata"`
+}
+
+func (m *rawMeta) resourceVersion() string {
+	if version := resourceVersionString(m.Metadata.ResourceVersion); len(version) > 0 {
+		return version
+	}
+	return resourceVersionString(m.ResourceVersion)
+}
+
+// resourceVersionString returns a resourceVersion, which is a number before
+// v1beta3 and a string from then on, as a string.
+func resourceVersionString(raw json.RawMessage) string {
+	if version := strings.Trim(string(raw), `"`); version != "null" {
+		return version
+	}
+	return ""
+}
+
+func decodeRawList(r io.Reader) (*rawList, error) {
+	var data struct {
+		rawMeta
+		Items []json.RawMessage `json:"items"`
+	}
+	if err := json.NewDecoder(r).Decode(&data); err != nil {
+		return nil, err
+	}
+	list := &rawList{Items: make([]runtime.Object, 0, len(data.Items))}
+	list.Kind, list.APIVersion, list.ResourceVersion = data.Kind, data.APIVersion, data.resourceVersion()
+	itemKind := strings.TrimSuffix(data.Kind, "List")
+	for _, item := range data.Items {
+		obj, err := decodeRawObject(item, itemKind, data.APIVersion)
+		if err != nil {
+			return nil, err
+		}
+		list.Items = append(list.Items, obj)
+	}
+	return list, nil
+}
+
+// decodeRawObject decodes the metadata of data, filling in kind & apiVersion
+// if it is missing them, as list items may be but watch events mustn't.
+func decodeRawObject(data json.RawMessage, kind, apiVersion string) (*rawObject, error) {
+	var m rawMeta
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	obj := &rawObject{raw: data}
+	obj.Kind, obj.APIVersion = m.Kind, m.APIVersion
+	obj.Name, obj.Namespace, obj.ResourceVersion = m.Metadata.Name, m.Metadata.Namespace, m.resourceVersion()
+	if len(obj.Name) == 0 {
+		obj.Name, obj.Namespace = m.ID, m.Namespace
+	}
+	if len(obj.Kind) == 0 && len(kind) > 0 {
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(data, &fields); err != nil {
+			return nil, err
+		}
+		fields["kind"], _ = json.Marshal(kind)
+		if len(obj.APIVersion) == 0 && len(apiVersion) > 0 {
+			fields["apiVersion"], _ = json.Marshal(apiVersion)
+		}
+		var err error
+		if obj.raw, err = json.Marshal(fields); err != nil {
+			return nil, err
+		}
+		obj.Kind = kind
+	}
+	return obj, nil
+}
+
+// rawEventDecoder implements watch.Decoder for a watch stream from the master.
+type rawEventDecoder struct {
+	ctx  context.Context
+	body io.ReadCloser
+	d    *json.Decoder
+}
+
+func (d *rawEventDecoder) Decode() (watch.EventType, runtime.Object, error) {
+	var event watchEvent
+	if err := d.d.Decode(&event); err != nil {
+		if d.ctx.Err() != nil {
+			return "", nil, io.EOF
+		}
+		return "", nil, err
+	}
+	if event.Type == watch.Error {
+		status := &api.Status{}
+		if err := json.Unmarshal(event.Object, status); err != nil {
+			return "", nil, err
+		}
+		return event.Type, status, nil
+	}
+	obj, err := decodeRawObject(event.Object, "", "")
+	return event.Type, obj, err
+}
+
+func (d *rawEventDecoder) Close() {
+	d.body.Close()
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeWatchMaster serves a list of pods in the web namespace & a watch
+// stream of the events sent on events.
+type fakeWatchMaster struct {
+	*httptest.Server
+	events chan string
+
+	mu       sync.Mutex
+	lists    int
+	watches  []string
+	listCode int
+}
+
+func newFakeWatchMaster() *fakeWatchMaster {
+	m := &fakeWatchMaster{events: make(chan string, 2000), listCode: http.StatusOK}
+	m.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.mu.Lock()
+		code := m.listCode
+		switch r.URL.Path {
+		case "/api/v1beta3/namespaces/web/pods":
+			m.lists++
+		case "/api/v1beta3/watch/namespaces/web/pods":
+			m.watches = append(m.watches, r.URL.Query().Get("resourceVersion"))
+		}
+		m.mu.Unlock()
+
+		if code != http.StatusOK {
+			http.Error(w, `{"kind":"Status","code":403}`, code)
+			return
+		}
+		switch r.URL.Path {
+		case "/api/v1beta3/namespaces/web/pods":
+			fmt.Fprint(w, `{"kind":"PodList","apiVersion":"v1beta3","metadata":{"resourceVersion":"10"},"items":[`+
+				testPod("p1", 5)+","+testPod("p2", 10)+`]}`)
+		case "/api/v1beta3/watch/namespaces/web/pods":
+			w.(http.Flusher).Flush()
+			for {
+				select {
+				case event := <-m.events:
+					fmt.Fprintln(w, event)
+					w.(http.Flusher).Flush()
+				case <-r.Context().Done():
+					return
+				}
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	return m
+}
+
+func testPod(name string, version int) string {
+	return fmt.Sprintf(`{"kind":"Pod","apiVersion":"v1beta3","metadata":{"name":%q,"namespace":"web","resourceVersion":"%d"}}`, name, version)
+}
+
+func (m *fakeWatchMaster) send(eventType, name string, version int) {
+	m.events <- fmt.Sprintf(`{"type":%q,"object":%s}`, eventType, testPod(name, version))
+}
+
+// watchShared watches the pods through m from resourceVersion, as a request
+// marked by ShareWatches.
+func watchShared(t *testing.T, m *watchMultiplexer, master, resourceVersion string) (*http.Response, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), sharedWatchKey{}, true))
+	req, err := http.NewRequestWithContext(ctx, "GET", master+"/api/v1beta3/watch/namespaces/web/pods?resourceVersion="+resourceVersion, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := m.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, cancel
+}
+
+type testWatchEvent struct {
+	Type   string
+	Object struct {
+		Kind     string
+		Code     int
+		Reason   string
+		Metadata struct{ Name, ResourceVersion string }
+	}
+}
+
+func (e testWatchEvent) String() string {
+	if e.Object.Kind == "Status" {
+		return fmt.Sprintf("%s %d %s", e.Type, e.Object.Code, e.Object.Reason)
+	}
+	return fmt.Sprintf("%s %s@%s", e.Type, e.Object.Metadata.Name, e.Object.Metadata.ResourceVersion)
+}
+
+// readEvents reads n events from a watch, failing if they don't arrive.
+func readEvents(t *testing.T, d *json.Decoder, n int) []string {
+	events := make(chan []string, 1)
+	go func() {
+		var got []string
+		for len(got) < n {
+			var event testWatchEvent
+			if err := d.Decode(&event); err != nil {
+				got = append(got, err.Error())
+				break
+			}
+			got = append(got, event.String())
+		}
+		events <- got
+	}()
+	select {
+	case got := <-events:
+		return got
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for %d events", n)
+		return nil
+	}
+}
+
+// stopSharedWatches stops the shared watches of m, so that the master's
+// watch handlers return.
+func stopSharedWatches(m *watchMultiplexer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, sw := range m.watches {
+		sw.stop()
+		delete(m.watches, key)
+	}
+}
+
+func TestSharedWatchLateJoiner(t *testing.T) {
+	master := newFakeWatchMaster()
+	defer master.Close()
+	m := newWatchMultiplexer(http.DefaultTransport)
+	defer stopSharedWatches(m)
+
+	first, cancel := watchShared(t, m, master.URL, "")
+	defer cancel()
+	d := json.NewDecoder(first.Body)
+	if got := readEvents(t, d, 2); fmt.Sprint(got) != "[ADDED p1@5 ADDED p2@10]" {
+		t.Fatalf("first client got %v, want the current state", got)
+	}
+	master.send("MODIFIED", "p1", 11)
+	master.send("ADDED", "p3", 12)
+	if got := readEvents(t, d, 2); fmt.Sprint(got) != "[MODIFIED p1@11 ADDED p3@12]" {
+		t.Fatalf("first client got %v", got)
+	}
+
+	// A client resuming from 11 only gets the events since, from the
+	// history, and then live events.
+	late, cancelLate := watchShared(t, m, master.URL, "11")
+	defer cancelLate()
+	lateEvents := json.NewDecoder(late.Body)
+	if got := readEvents(t, lateEvents, 1); fmt.Sprint(got) != "[ADDED p3@12]" {
+		t.Errorf("late client got %v, want the events since 11", got)
+	}
+	master.send("DELETED", "p2", 13)
+	if got := readEvents(t, lateEvents, 1); fmt.Sprint(got) != "[DELETED p2@13]" {
+		t.Errorf("late client got %v", got)
+	}
+	if got := readEvents(t, d, 1); fmt.Sprint(got) != "[DELETED p2@13]" {
+		t.Errorf("first client got %v", got)
+	}
+
+	// A client starting afresh gets the current state.
+	fresh, cancelFresh := watchShared(t, m, master.URL, "0")
+	defer cancelFresh()
+	if got := readEvents(t, json.NewDecoder(fresh.Body), 2); fmt.Sprint(got) != "[ADDED p1@11 ADDED p3@12]" {
+		t.Errorf("new client got %v, want the current state", got)
+	}
+
+	master.mu.Lock()
+	defer master.mu.Unlock()
+	if master.lists != 1 || fmt.Sprint(master.watches) != "[10]" {
+		t.Errorf("master got %d lists & watches from %v, want the one shared watch", master.lists, master.watches)
+	}
+}
+
+func TestSharedWatchGone(t *testing.T) {
+	master := newFakeWatchMaster()
+	defer master.Close()
+	m := newWatchMultiplexer(http.DefaultTransport)
+	defer stopSharedWatches(m)
+
+	first, cancel := watchShared(t, m, master.URL, "")
+	defer cancel()
+	d := json.NewDecoder(first.Body)
+	readEvents(t, d, 2)
+
+	// History starts at the list.
+	old, cancelOld := watchShared(t, m, master.URL, "3")
+	defer cancelOld()
+	if got := readEvents(t, json.NewDecoder(old.Body), 1); fmt.Sprint(got) != "[ERROR 410 Gone]" {
+		t.Errorf("client resuming from before the list got %v, want Gone", got)
+	}
+
+	// And drops the oldest events once full.
+	for version := 11; version <= 11+sharedWatchHistory; version++ {
+		master.send("MODIFIED", "p1", version)
+	}
+	if got := readEvents(t, d, sharedWatchHistory+1); got[len(got)-1] != fmt.Sprintf("MODIFIED p1@%d", 11+sharedWatchHistory) {
+		t.Fatalf("first client got %v", got[len(got)-1])
+	}
+	expired, cancelExpired := watchShared(t, m, master.URL, "10")
+	defer cancelExpired()
+	if got := readEvents(t, json.NewDecoder(expired.Body), 1); fmt.Sprint(got) != "[ERROR 410 Gone]" {
+		t.Errorf("client resuming from a dropped event got %v, want Gone", got)
+	}
+	kept, cancelKept := watchShared(t, m, master.URL, "11")
+	defer cancelKept()
+	if got := readEvents(t, json.NewDecoder(kept.Body), 1); fmt.Sprint(got) != "[MODIFIED p1@12]" {
+		t.Errorf("client resuming from the oldest kept event got %v", got)
+	}
+}
+
+func TestSharedWatchListFails(t *testing.T) {
+	master := newFakeWatchMaster()
+	defer master.Close()
+	master.listCode = http.StatusForbidden
+	m := newWatchMultiplexer(http.DefaultTransport)
+	defer stopSharedWatches(m)
+
+	// The watch is passed through, for the client to get the master's error.
+	resp, cancel := watchShared(t, m, master.URL, "")
+	defer cancel()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("got %d %s, want the master's 403", resp.StatusCode, body)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.watches) > 0 {
+		t.Errorf("failed shared watch kept: %v", m.watches)
+	}
+}
+
+func TestSharedWatchReplaceFails(t *testing.T) {
+	m := newWatchMultiplexer(http.DefaultTransport)
+	req := httptest.NewRequest("GET", "http://master/api/v1beta3/watch/namespaces/web/pods", nil)
+	sw := newSharedWatch(m, sharedWatchKeyFor(req), req)
+	m.watches[sw.key] = sw
+
+	if err := sw.Replace([]interface{}{"not an object"}); err == nil {
+		t.Fatal("replaced the store with something that isn't an object")
+	}
+	// Clients waiting for the watch to be ready are let go, with the error.
+	select {
+	case <-sw.ready:
+	case <-time.After(time.Second):
+		t.Fatal("shared watch never ready")
+	}
+	if sw.err == nil || len(m.watches) > 0 {
+		t.Errorf("got error %v & watches %v, want the watch failed & removed", sw.err, m.watches)
+	}
+}